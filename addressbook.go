@@ -2,33 +2,145 @@
 
 package addressbook
 
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
 
 // Even though the DB has the create timestamp, leaving this out for now
 type AddressBookEntry struct {
-	ID        int64     `json:"id"`
-	Firstname string    `json:"firstname"`
-	Lastname  string    `json:"lastname"`
-	Email     string    `json:"email"`
-	Phone     string    `json:"phone"`
+	ID        int64     `json:"id" xml:"id"`
+	Firstname string    `json:"firstname" xml:"firstname"`
+	Lastname  string    `json:"lastname" xml:"lastname"`
+	Email     string    `json:"email" xml:"email"`
+	Phone     string    `json:"phone" xml:"phone"`
+	// DeletedAt is only set for entries in the trash
+	DeletedAt *time.Time `json:"deletedAt,omitempty" xml:"deletedAt,omitempty"`
+}
+
+// ImportMode selects how imported AddressBookEntries are reconciled with the existing ones.
+type ImportMode string
+
+const (
+	// ImportInsert always adds new entries, any supplied ID is ignored.
+	ImportInsert        ImportMode = "insert"
+	// ImportUpsertByID updates the entry with a matching ID, or adds it if there is none.
+	ImportUpsertByID    ImportMode = "upsert-id"
+	// ImportUpsertByEmail updates the entry with a matching Email, or adds it if there is none.
+	ImportUpsertByEmail ImportMode = "upsert-email"
+	// ImportReplace removes all existing entries before loading the new ones.
+	ImportReplace       ImportMode = "replace"
+)
+
+// ImportResult reports what a bulk import did to the database.
+type ImportResult struct {
+	Inserted int `json:"inserted"`
+	Updated  int `json:"updated"`
+}
+
+// EntryNotFoundError reports an AddressBookEntry that does not exist.
+type EntryNotFoundError struct {
+	ID int64
+}
+
+func (e *EntryNotFoundError) Error() string {
+	return fmt.Sprintf("AddressBookEntry with ID (%d) not found.", e.ID)
+}
+
+// EntryMergedError reports an AddressBookEntry that was merged into another, so can not come back.
+type EntryMergedError struct {
+	ID         int64
+	SurvivorID int64
+}
+
+func (e *EntryMergedError) Error() string {
+	return fmt.Sprintf("AddressBookEntry with ID (%d) was merged into (%d).", e.ID, e.SurvivorID)
 }
 
 // AddressBookDatabase provides thread-safe access to a database of contacts.
+//	The entries are those of one AddressBook, the default one unless WithBook says otherwise.
 type AddressBookDatabase interface {
 	// ListAddressBookEntries returns a list of AddressBookEntries, ordered by lastname, firstname.
 	ListAddressBookEntries() ([]*AddressBookEntry, error)
 
+	// IterateAddressBookEntries calls fn for each AddressBookEntry, in the same order as
+	//	ListAddressBookEntries, without holding them all in memory.
+	//	Iteration stops at the first error returned by fn, or when ctx is done.
+	IterateAddressBookEntries(ctx context.Context, fn func(*AddressBookEntry) error) error
+
 	// GetAddressBookEntry retrieves a AddressBookEntry by its ID.
 	GetAddressBookEntry(id int64) (*AddressBookEntry, error)
 
 	// AddAddressBookEntry saves a given AddressBookEntry, assigning it a new ID.
 	AddAddressBookEntry(abe *AddressBookEntry) (id int64, err error)
 
-	// DeleteAddressBookEntry removes a given AddressBookEntry by its ID.
+	// DeleteAddressBookEntry moves a given AddressBookEntry to the trash, by its ID.
+	//	Entries in the trash are left out of everything else, until restored or purged.
 	DeleteAddressBookEntry(id int64) error
 
+	// ListDeletedAddressBookEntries returns the AddressBookEntries in the trash, most recently deleted first.
+	//	Merged entries are left out, they can not be restored.
+	ListDeletedAddressBookEntries() ([]*AddressBookEntry, error)
+
+	// RestoreAddressBookEntry takes a given AddressBookEntry back out of the trash,
+	//	or returns sql.ErrNoRows if it is not there, or an *EntryMergedError if it was merged.
+	RestoreAddressBookEntry(id int64) error
+
+	// PurgeDeletedAddressBookEntries permanently removes the AddressBookEntries in the trash
+	//	for longer than olderThan, returning how many there were.
+	PurgeDeletedAddressBookEntries(olderThan time.Duration) (int64, error)
+
 	// UpdateAddressBookEntry updates the entry for a given AddressBookEntry.
 	UpdateAddressBookEntry(abe *AddressBookEntry) error
 
+	// BulkUpsertAddressBookEntries saves the given AddressBookEntries in a single transaction,
+	//	reconciling them with the existing entries according to mode.
+	BulkUpsertAddressBookEntries(abes []*AddressBookEntry, mode ImportMode) (*ImportResult, error)
+
+	// MergeAddressBookEntries combines the victims into the survivor, in a single transaction:
+	//	merge sets the survivor's fields from them all, then the victims are deleted and
+	//	redirected to the survivor, for good: neither a restore nor an import by ID brings one
+	//	back.  A missing entry is an *EntryNotFoundError.
+	MergeAddressBookEntries(survivorID int64, victimIDs []int64,
+		merge func(survivor *AddressBookEntry, victims []*AddressBookEntry)) (*AddressBookEntry, error)
+
+	// GetAddressBookRedirect returns the ID of the entry a merged AddressBookEntry became,
+	//	or sql.ErrNoRows if it was never merged.
+	GetAddressBookRedirect(id int64) (int64, error)
+
+	// WithActor returns the same database, with its writes recorded in the history as made by actor.
+	WithActor(actor string) AddressBookDatabase
+
+	// ListRevisions returns the history of an AddressBookEntry, oldest first.
+	ListRevisions(id int64) ([]*Revision, error)
+
+	// RevertAddressBookEntry sets an AddressBookEntry's fields back to those of one of its
+	//	revisions, as a new revision.  A missing entry is an *EntryNotFoundError, a missing
+	//	revision sql.ErrNoRows.
+	RevertAddressBookEntry(id int64, rev int) (*AddressBookEntry, error)
+
+	// The AddressBooks the entries are in
+	BookDatabase
+
+	// ImportJobs are kept alongside the entries they import
+	ImportJobDatabase
+
+	// The audit log is kept alongside the entries it audits
+	AuditDatabase
+
+	// APIKeys say who may call the API
+	APIKeyDatabase
+
+	// CheckHealth pings the database, and checks its schema is at least the version this
+	//	code expects, see health.go.
+	CheckHealth(ctx context.Context) error
+
+	// Available is false while the database is known to be down, so requests can be turned
+	//	away at once rather than wait on it, see health.go.
+	Available() bool
+
 	// Close closes the database, freeing up any available resources.
 	Close()
 
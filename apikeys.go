@@ -0,0 +1,173 @@
+// 2026.10.19 rjj: API key authentication
+// An API key is sent as "Authorization: Bearer <key>", see auth.go.  Only a hash of each key
+//	is stored: the key itself is shown once, when it is created, and can not be recovered,
+//	only revoked and replaced.
+// Admin keys can also manage keys, and read the audit log.  The first one is made from the
+//	command line, see app/apikey.go.
+
+package addressbook
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// APIKey is the stored part of a key.
+type APIKey struct {
+	ID int64 `json:"id"`
+	// Name identifies the caller, it is the actor in the history and audit log
+	Name string `json:"name"`
+	// Prefix is the start of the key, enough to tell keys apart without giving them away
+	Prefix string `json:"prefix"`
+	// Hash is the SHA-256 of the whole key
+	Hash        string    `json:"-"`
+	Admin       bool      `json:"admin"`
+	CreatedDate time.Time `json:"createdDate"`
+	// ExpiresAt is nil for a key that does not expire
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// APIKeyDatabase stores APIKeys.
+type APIKeyDatabase interface {
+	// AddAPIKey saves a new key, assigning it an ID.
+	AddAPIKey(key *APIKey) (int64, error)
+
+	// GetAPIKeyByHash finds a key by the hash of the key, sql.ErrNoRows if there is none.
+	GetAPIKeyByHash(hash string) (*APIKey, error)
+
+	// ListAPIKeys returns every key, revoked and expired ones included, oldest first.
+	ListAPIKeys() ([]*APIKey, error)
+
+	// RevokeAPIKey stops a key from working, for good.  sql.ErrNoRows if there is no such key.
+	RevokeAPIKey(id int64) error
+}
+
+// apiKeyPrefix starts every key, so a leaked one is easy to search for
+const apiKeyPrefix = "yab_"
+
+// apiKeyShownPrefix is how much of a key is kept in the clear, apiKeyPrefix included
+const apiKeyShownPrefix = 12
+
+// hashAPIKey is how a key is stored.  Keys are random, not passwords, so a fast hash is enough.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAPIKey creates and saves a key for name.  A ttl of 0 never expires.
+//	The returned string is the key itself, it can not be had again.
+func NewAPIKey(db APIKeyDatabase, name string, admin bool, ttl time.Duration) (string, *APIKey, error) {
+	if "" == strings.TrimSpace(name) {
+		return "", nil, fmt.Errorf("An API key needs a name")
+	}
+	if 0 > ttl {
+		return "", nil, fmt.Errorf("Bad API key lifetime (%v)", ttl)
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); nil != err {
+		return "", nil, err
+	}
+	secret := apiKeyPrefix + hex.EncodeToString(b)
+
+	key := &APIKey{
+		Name:        name,
+		Prefix:      secret[:apiKeyShownPrefix],
+		Hash:        hashAPIKey(secret),
+		Admin:       admin,
+		CreatedDate: time.Now().UTC().Truncate(time.Second),
+	}
+	if 0 < ttl {
+		expires := key.CreatedDate.Add(ttl).Truncate(time.Second)
+		key.ExpiresAt = &expires
+	}
+	id, err := db.AddAPIKey(key)
+	if nil != err {
+		return "", nil, err
+	}
+	key.ID = id
+	return secret, key, nil
+}
+
+// **************** API Key Handlers ****************
+
+// apiKeyRequest is the body of POST /admin/apikeys, e.g.
+//	{"name": "crm-sync", "admin": false, "expiresIn": "720h"}
+type apiKeyRequest struct {
+	Name  string `json:"name"`
+	Admin bool   `json:"admin"`
+	// ExpiresIn is a Go duration, empty for a key that does not expire
+	ExpiresIn string `json:"expiresIn"`
+}
+
+// The response is the only time the key is seen, as "key".
+func (a *Application) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if "" == strings.TrimSpace(req.Name) {
+		respondWithError(w, http.StatusBadRequest, "An API key needs a name")
+		return
+	}
+	var ttl time.Duration
+	if "" != req.ExpiresIn {
+		var err error
+		if ttl, err = time.ParseDuration(req.ExpiresIn); nil != err || 0 >= ttl {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Bad expiresIn value (%v)", req.ExpiresIn))
+			return
+		}
+	}
+
+	secret, key, err := NewAPIKey(a.traced(r.Context()), req.Name, req.Admin, ttl)
+	if nil != err {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	auditDetail(r, "key %d (%s) for %s", key.ID, key.Prefix, key.Name)
+	w.Header().Set("Location", fmt.Sprintf("/admin/apikeys/%d", key.ID))
+	respondWithJSON(w, http.StatusCreated, struct {
+		*APIKey
+		Key string `json:"key"`
+	}{key, secret})
+}
+
+func (a *Application) getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := a.traced(r.Context()).ListAPIKeys()
+	if nil != err {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, keys)
+}
+
+func (a *Application) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"],10,64)
+	if nil != err {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Bad API key ID (%v)", vars["id"]))
+		return
+	}
+	auditDetail(r, "key %d", id)
+
+	if err := a.traced(r.Context()).RevokeAPIKey(id); nil != err {
+		if sql.ErrNoRows == err {
+			respondWithError(w, http.StatusNotFound, fmt.Sprintf("API key with ID (%d) not found.", id))
+		} else {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
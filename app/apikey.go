@@ -0,0 +1,104 @@
+// 2026.10.19 rjj: API key admin from the command line
+// The API itself needs an admin key to make keys, so the first one is made here:
+//	app apikey create -name ops -admin
+//	app apikey list
+//	app apikey revoke 3
+// It uses the same YUM_ADDRESSBOOK_DB_* environment variables as the server.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rjj-work/yum-address-book"
+)
+
+const apiKeyUsage = `usage:
+  apikey create -name NAME [-admin] [-expires DURATION]
+  apikey list
+  apikey revoke ID`
+
+// apiKeyCommand runs "apikey ...", returning the exit code
+func apiKeyCommand(args []string) int {
+	if 0 == len(args) {
+		fmt.Fprintln(os.Stderr, apiKeyUsage)
+		return 2
+	}
+
+	db, err := addressbook.OpenDatabase(
+		os.Getenv( "YUM_ADDRESSBOOK_DB_USERNAME" ),
+		os.Getenv( "YUM_ADDRESSBOOK_DB_PASSWORD" ),
+		os.Getenv( "YUM_ADDRESSBOOK_DB_NAME" ),
+		dbPool(),
+	)
+	if nil != err {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		name := fs.String("name", "", "who the key is for, shown as the actor in the history and audit log")
+		admin := fs.Bool("admin", false, "allow the key to manage keys and read the audit log")
+		expires := fs.Duration("expires", 0, "how long the key works for, e.g. 720h; 0 for ever")
+		if err := fs.Parse(args[1:]); nil != err {
+			return 2
+		}
+		secret, key, err := addressbook.NewAPIKey(db, *name, *admin, *expires)
+		if nil != err {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Created key %d for %s, it will not be shown again:\n", key.ID, key.Name)
+		fmt.Println(secret)
+
+	case "list":
+		keys, err := db.ListAPIKeys()
+		if nil != err {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tPREFIX\tADMIN\tCREATED\tEXPIRES\tREVOKED")
+		for _, key := range keys {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%t\t%s\t%s\t%s\n", key.ID, key.Name, key.Prefix, key.Admin,
+				key.CreatedDate.Format(time.RFC3339), optionalDate(key.ExpiresAt), optionalDate(key.RevokedAt))
+		}
+		tw.Flush()
+
+	case "revoke":
+		if 2 != len(args) {
+			fmt.Fprintln(os.Stderr, apiKeyUsage)
+			return 2
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "Bad API key ID (%v)\n", args[1])
+			return 2
+		}
+		if err := db.RevokeAPIKey(id); nil != err {
+			fmt.Fprintf(os.Stderr, "Could not revoke key %d: %v\n", id, err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Revoked key %d\n", id)
+
+	default:
+		fmt.Fprintln(os.Stderr, apiKeyUsage)
+		return 2
+	}
+	return 0
+}
+
+func optionalDate(t *time.Time) string {
+	if nil == t {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -4,15 +4,18 @@
 package main
 
 import(
-	//_ "encoding/json"
+	"encoding/json"
 	//_ "errors"
 	//"fmt"
 	//_ "io"
-	//"log"
+	"log"
+	"log/slog"
 	//"net/http"
 	"os"
 	//_ "path"
-	//"strconv"
+	"strconv"
+	"strings"
+	"time"
 
 	//_ "golang.org/x/net/context"
 
@@ -25,8 +28,88 @@ import(
 
 
 func main() {
+	if 1 < len(os.Args) && "apikey" == os.Args[1] {
+		os.Exit( apiKeyCommand( os.Args[2:] ) )
+	}
 
 	a := addressbook.Application{}
+	// JSON on stderr, from debug, info (the default), warn or error up
+	var level slog.Level
+	if l := os.Getenv( "YUM_ADDRESSBOOK_LOG_LEVEL" ); "" != l {
+		if err := level.UnmarshalText( []byte(l) ); nil != err {
+			log.Fatalf( "Bad YUM_ADDRESSBOOK_LOG_LEVEL: %v", err )
+		}
+	}
+	a.Logger = addressbook.NewLogger( os.Stderr, level )
+	a.ImportDir = os.Getenv( "YUM_ADDRESSBOOK_IMPORT_DIR" )
+	a.ImportWorkers, _ = strconv.Atoi( os.Getenv( "YUM_ADDRESSBOOK_IMPORT_WORKERS" ) )
+	// A Go duration, e.g. 720h
+	a.TrashRetention, _ = time.ParseDuration( os.Getenv( "YUM_ADDRESSBOOK_TRASH_RETENTION" ) )
+	// Local development only
+	a.AuthDisabled, _ = strconv.ParseBool( os.Getenv( "YUM_ADDRESSBOOK_AUTH_DISABLED" ) )
+	// Tokens from the identity provider, as well as API keys
+	if jwks := os.Getenv( "YUM_ADDRESSBOOK_OIDC_JWKS" ); "" != jwks {
+		a.OIDC = &addressbook.OIDCConfig{
+			Issuer:      os.Getenv( "YUM_ADDRESSBOOK_OIDC_ISSUER" ),
+			Audience:    os.Getenv( "YUM_ADDRESSBOOK_OIDC_AUDIENCE" ),
+			JWKS:        jwks,
+			RolesClaim:  os.Getenv( "YUM_ADDRESSBOOK_OIDC_ROLES_CLAIM" ),
+			GroupsClaim: os.Getenv( "YUM_ADDRESSBOOK_OIDC_GROUPS_CLAIM" ),
+		}
+		// JSON, e.g. {"contacts-editor": ["contacts:read", "contacts:write"]}
+		if roles := os.Getenv( "YUM_ADDRESSBOOK_OIDC_ROLE_SCOPES" ); "" != roles {
+			if err := json.Unmarshal( []byte(roles), &a.OIDC.RoleScopes ); nil != err {
+				log.Fatalf( "Bad YUM_ADDRESSBOOK_OIDC_ROLE_SCOPES: %v", err )
+			}
+		}
+	}
+	// HTTPS, and client certificates
+	if cert := os.Getenv( "YUM_ADDRESSBOOK_TLS_CERT" ); "" != cert {
+		a.TLS = &addressbook.TLSConfig{
+			CertFile:     cert,
+			KeyFile:      os.Getenv( "YUM_ADDRESSBOOK_TLS_KEY" ),
+			ClientCAFile: os.Getenv( "YUM_ADDRESSBOOK_TLS_CLIENT_CA" ),
+		}
+		a.TLS.RequireClientCert, _ = strconv.ParseBool( os.Getenv( "YUM_ADDRESSBOOK_TLS_REQUIRE_CLIENT_CERT" ) )
+		// JSON, e.g. {"crm-sync": ["contacts:read", "contacts:write"]}
+		if scopes := os.Getenv( "YUM_ADDRESSBOOK_TLS_CLIENT_SCOPES" ); "" != scopes {
+			if err := json.Unmarshal( []byte(scopes), &a.TLS.ClientScopes ); nil != err {
+				log.Fatalf( "Bad YUM_ADDRESSBOOK_TLS_CLIENT_SCOPES: %v", err )
+			}
+		}
+	}
+	// Browser clients on other origins, comma separated, e.g. https://app.example.com
+	if origins := os.Getenv( "YUM_ADDRESSBOOK_CORS_ORIGINS" ); "" != origins {
+		a.CORS = &addressbook.CORSConfig{
+			AllowedOrigins: commaList( origins ),
+			AllowedMethods: commaList( os.Getenv( "YUM_ADDRESSBOOK_CORS_METHODS" ) ),
+			AllowedHeaders: commaList( os.Getenv( "YUM_ADDRESSBOOK_CORS_HEADERS" ) ),
+		}
+		a.CORS.AllowCredentials, _ = strconv.ParseBool( os.Getenv( "YUM_ADDRESSBOOK_CORS_CREDENTIALS" ) )
+		a.CORS.MaxAge, _ = time.ParseDuration( os.Getenv( "YUM_ADDRESSBOOK_CORS_MAX_AGE" ) )
+	}
+	// Request body limits, in bytes
+	a.MaxBodyBytes, _ = strconv.ParseInt( os.Getenv( "YUM_ADDRESSBOOK_MAX_BODY_BYTES" ), 10, 64 )
+	a.MaxBulkBodyBytes, _ = strconv.ParseInt( os.Getenv( "YUM_ADDRESSBOOK_MAX_BULK_BODY_BYTES" ), 10, 64 )
+	// JSON, per route group, e.g. {"bulk": {"rate": 0.5, "burst": 5}}, a rate of 0 is unlimited
+	if limits := os.Getenv( "YUM_ADDRESSBOOK_RATE_LIMITS" ); "" != limits {
+		if err := json.Unmarshal( []byte(limits), &a.RateLimits ); nil != err {
+			log.Fatalf( "Bad YUM_ADDRESSBOOK_RATE_LIMITS: %v", err )
+		}
+	}
+	// Spans, otlp to a collector or stdout, the collector defaults to the OTEL_EXPORTER_OTLP_* variables
+	if exporter := os.Getenv( "YUM_ADDRESSBOOK_TRACING" ); "" != exporter {
+		a.Tracing = &addressbook.TracingConfig{
+			Exporter: exporter,
+			Endpoint: os.Getenv( "YUM_ADDRESSBOOK_OTLP_ENDPOINT" ),
+		}
+		a.Tracing.Insecure, _ = strconv.ParseBool( os.Getenv( "YUM_ADDRESSBOOK_OTLP_INSECURE" ) )
+		a.Tracing.SampleRatio, _ = strconv.ParseFloat( os.Getenv( "YUM_ADDRESSBOOK_TRACE_SAMPLE_RATIO" ), 64 )
+	}
+	// Graceful shutdown: how long /readyz fails first, then how long requests may finish, e.g. 5s and 30s
+	a.ShutdownDelay, _ = time.ParseDuration( os.Getenv( "YUM_ADDRESSBOOK_SHUTDOWN_DELAY" ) )
+	a.ShutdownTimeout, _ = time.ParseDuration( os.Getenv( "YUM_ADDRESSBOOK_SHUTDOWN_TIMEOUT" ) )
+	a.DBPool = dbPool()
 	a.Initialize(
 		os.Getenv( "YUM_ADDRESSBOOK_DB_USERNAME" ),
 		os.Getenv( "YUM_ADDRESSBOOK_DB_PASSWORD" ),
@@ -36,3 +119,17 @@ func main() {
 	// Run from localhost for
 	a.Run( os.Getenv( "YUM_ADDRESSBOOK_HOST_PORT" ) )
 }
+
+// dbPool sizes the pool of connections to MySQL, e.g. 25, 25 and 5m, negative is no limit
+func dbPool() addressbook.PoolConfig {
+	var pool addressbook.PoolConfig
+	pool.MaxOpenConns, _ = strconv.Atoi( os.Getenv( "YUM_ADDRESSBOOK_DB_MAX_OPEN_CONNS" ) )
+	pool.MaxIdleConns, _ = strconv.Atoi( os.Getenv( "YUM_ADDRESSBOOK_DB_MAX_IDLE_CONNS" ) )
+	pool.ConnMaxLifetime, _ = time.ParseDuration( os.Getenv( "YUM_ADDRESSBOOK_DB_CONN_MAX_LIFETIME" ) )
+	return pool
+}
+
+// commaList splits a comma separated setting, nil for ""
+func commaList(s string) []string {
+	return strings.FieldsFunc( s, func(c rune) bool { return ',' == c || ' ' == c } )
+}
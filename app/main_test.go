@@ -4,23 +4,105 @@ package main_test
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
-	_ "log"
+	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
 	"github.com/rjj-work/yum-address-book"
 )
 
 var a addressbook.Application
 
+// apiKey is an admin key, sent by executeRequest unless the request has its own Authorization
+var apiKey string
+
+// oidcKey signs tokens as a stand-in identity provider would, its JWKS is in a temp file
+var oidcKey *rsa.PrivateKey
+
+// logged is what the application logs, see TestRequestLogging
+var logged lockedBuffer
+
+// traced is the spans, see TestTracing
+var traced lockedBuffer
+
+// lockedBuffer is a bytes.Buffer the import runner and the tests can both use
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+const testIssuer = "https://idp.example.com"
+const testAudience = "yum-address-book"
+
+// standInJWKS writes the public half of oidcKey as a JWKS, returning the file name
+func standInJWKS() string {
+	var err error
+	if oidcKey, err = rsa.GenerateKey(rand.Reader, 2048); nil != err {
+		log.Fatal(err)
+	}
+	jwks, _ := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &oidcKey.PublicKey, KeyID: "test-key", Algorithm: string(jose.RS256), Use: "sig"},
+	}})
+	f, err := os.CreateTemp("", "jwks-*.json")
+	if nil != err {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	f.Write(jwks)
+	return f.Name()
+}
+
 func TestMain(m *testing.M) {
 	a = addressbook.Application{}
+	jwksFile := standInJWKS()
+	a.OIDC = &addressbook.OIDCConfig{
+		Issuer:     testIssuer,
+		Audience:   testAudience,
+		JWKS:       jwksFile,
+		RoleScopes: map[string][]string{"contacts-editor": {addressbook.ScopeRead, addressbook.ScopeWrite}},
+	}
+	a.Logger = addressbook.NewLogger(&logged, slog.LevelInfo)
+	a.CORS = &addressbook.CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, MaxAge: time.Hour}
+	a.Tracing = &addressbook.TracingConfig{Exporter: addressbook.TracingStdout, Output: &traced}
+	a.DBPool = addressbook.PoolConfig{MaxOpenConns: 10, ConnMaxLifetime: time.Minute}
+	// The tests make far more calls than a client should, all with the one key, see TestRateLimit
+	a.RateLimits = map[addressbook.RateLimitGroup]addressbook.RateLimit{
+		addressbook.RateLimitRead:  {},
+		addressbook.RateLimitWrite: {},
+		addressbook.RateLimitBulk:  {},
+		addressbook.RateLimitAuth:  {},
+	}
 	a.Initialize(
 		os.Getenv( "TEST_YUM_ADDRESSBOOK_DB_USERNAME" ),
 		os.Getenv( "TEST_YUM_ADDRESSBOOK_DB_PASSWORD" ),
@@ -29,10 +111,17 @@ func TestMain(m *testing.M) {
 
 	// a.Initialize ensures the db and table exists
 
+	var err error
+	if apiKey, _, err = addressbook.NewAPIKey(a.DB, "test", true, time.Hour); nil != err {
+		fmt.Fprintf(os.Stderr, "Could not create an API key: %v\n", err)
+		os.Exit(1)
+	}
+
 	code := m.Run()
 
 	//resetTable()
 
+	os.Remove(jwksFile)
 	os.Exit( code )
 }
 
@@ -42,6 +131,9 @@ func resetTable() {
 }
 
 func executeRequest(r *http.Request) (*httptest.ResponseRecorder) {
+	if "" == r.Header.Get("Authorization") {
+		r.Header.Set("Authorization", "Bearer "+apiKey)
+	}
 	rr := httptest.NewRecorder()
 	a.Router.ServeHTTP(rr, r)
 
@@ -280,17 +372,54 @@ func TestCSVExport(t *testing.T) {
 	}
 }
 
-func TestCSVImport(t *testing.T) {
+// Count the CSV records in an export response, header included
+func countCSVRecords(t *testing.T, response *httptest.ResponseRecorder) (int) {
+	r := csv.NewReader( bytes.NewReader(response.Body.Bytes()) )
+	var count int
+	for {
+		_, err := r.Read()
+		if io.EOF == err {
+			break
+		}
+		if nil != err {
+			t.Errorf("CSV read error: %v", err)
+		}
+		count++
+	}
+	return count
+}
+
+// An empty table still exports the header
+func TestCSVExportEmptyTable(t *testing.T) {
 	resetTable()
 
-	// Create a request to the import endpoint that has a known number of records
-	//	- generate ABEs
-	//	- encode as CSV
-	//	- create request with these in the body
-	// Then verify those records are now in the db
-	const numABEs = 15
-	abes := generateAddressBookEntries(t, numABEs)
+	req, _ := http.NewRequest("GET", "/csvexport", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if count := countCSVRecords(t, response); 1 != count {
+		t.Errorf("Expected only the header record, got %d", count)
+	}
+}
+
+// More records than are buffered between flushes
+func TestCSVExportStreaming(t *testing.T) {
+	resetTable()
+
+	const numABEs = 2500
+	addAddressBookEntries(t, numABEs)
+
+	req, _ := http.NewRequest("GET", "/csvexport", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if count := countCSVRecords(t, response); 1+numABEs != count {
+		t.Errorf("Expected %d CSV records, got %d", 1+numABEs, count)
+	}
+}
 
+// Encode the ABEs the same way /csvexport does, header first
+func encodeCSV(t *testing.T, abes []*addressbook.AddressBookEntry) (*bytes.Buffer) {
 	b := &bytes.Buffer{}
 	csvWriter := csv.NewWriter( b )
 
@@ -320,7 +449,30 @@ func TestCSVImport(t *testing.T) {
 		}
 	}
 	csvWriter.Flush()
+	return b
+}
+
+func checkABECount(t *testing.T, expected int) {
+	currentABEs, err := a.DB.ListAddressBookEntries()
+	if nil != err {
+		t.Errorf( "failed to read ABEs: %v", err )
+	}
+	if expected != len(currentABEs) {
+		t.Errorf( "Exected %d ABEs, but found %d", expected, len(currentABEs) )
+	}
+}
+
+func TestCSVImport(t *testing.T) {
+	resetTable()
 
+	// Create a request to the import endpoint that has a known number of records
+	//	- generate ABEs
+	//	- encode as CSV
+	//	- create request with these in the body
+	// Then verify those records are now in the db
+	const numABEs = 15
+	abes := generateAddressBookEntries(t, numABEs)
+	b := encodeCSV(t, abes)
 
 	req, _ := http.NewRequest("POST", "/csvimport", b)
 	req.Header.Set("Content-Type", "text/csv")
@@ -328,11 +480,1662 @@ func TestCSVImport(t *testing.T) {
 	checkResponseCode(t, http.StatusOK, response.Code)
 
 	// Query DB for the count of records, should be numABEs
-	currentABEs, err := a.DB.ListAddressBookEntries()
+	checkABECount(t, numABEs)
+}
+
+// Importing the same file twice by ID must not duplicate anything
+func TestCSVImportUpsertByID(t *testing.T) {
+	resetTable()
+
+	const numABEs = 15
+	abes := generateAddressBookEntries(t, numABEs)
+	for _, abe := range abes {
+		// ID 0 would always be a new entry
+		abe.ID++
+	}
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "/csvimport?mode=upsert-id", encodeCSV(t, abes))
+		req.Header.Set("Content-Type", "text/csv")
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+	}
+	checkABECount(t, numABEs)
+
+	abe, err := a.DB.GetAddressBookEntry(numABEs)
+	if nil != err {
+		t.Fatalf("Failed to read ABE %d: %v", numABEs, err)
+	}
+	checkIt(t, "lastname", abes[numABEs-1].Lastname, abe.Lastname)
+}
+
+func TestCSVImportUpsertByEmail(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 5)
+
+	// Same emails, new names, and no IDs to match on
+	abes := generateAddressBookEntries(t, 5)
+	for _, abe := range abes {
+		abe.ID = 0
+		abe.Lastname += "_edited"
+	}
+
+	req, _ := http.NewRequest("POST", "/csvimport?mode=upsert-email", encodeCSV(t, abes))
+	req.Header.Set("Content-Type", "text/csv")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkABECount(t, 5)
+
+	abe, err := a.DB.GetAddressBookEntry(1)
+	if nil != err {
+		t.Fatalf("Failed to read ABE 1: %v", err)
+	}
+	checkIt(t, "lastname", "Ln_0_edited", abe.Lastname)
+}
+
+func TestCSVImportReplace(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 10)
+
+	const numABEs = 3
+	req, _ := http.NewRequest("POST", "/csvimport?mode=replace",
+		encodeCSV(t, generateAddressBookEntries(t, numABEs)))
+	req.Header.Set("Content-Type", "text/csv")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkABECount(t, numABEs)
+}
+
+// A bad record means nothing is replaced
+func TestCSVImportReplaceRejectsBadInput(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 10)
+
+	b := bytes.NewBufferString("ID,Firstname,Lastname,Email,Phone\nnot-an-id,Fn,Ln,fn.ln@example.com,\n")
+	req, _ := http.NewRequest("POST", "/csvimport?mode=replace", b)
+	req.Header.Set("Content-Type", "text/csv")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+	checkABECount(t, 10)
+}
+
+func TestCSVImportUnknownMode(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/csvimport?mode=merge", bytes.NewBufferString(""))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestVCardExport(t *testing.T) {
+	resetTable()
+
+	const numABEs = 10
+	addAddressBookEntries(t, numABEs)
+
+	req, _ := http.NewRequest("GET", "/vcardexport", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	body := response.Body.String()
+	if count := strings.Count(body, "BEGIN:VCARD\r\n"); numABEs != count {
+		t.Errorf("Expected %d vCards, got %d", numABEs, count)
+	}
+	if !strings.Contains(body, "N:Ln_3;Fn_3;;;\r\n") {
+		t.Errorf("Expected a vCard for Fn_3 Ln_3, got %s", body)
+	}
+}
+
+// GET /addressbookentry/1.vcf
+func TestGetAddressBookEntryAsVCard(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 1)
+
+	req, _ := http.NewRequest("GET", "/addressbookentry/1.vcf?version=3.0", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	expected := "BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Fn_0 Ln_0\r\nN:Ln_0;Fn_0;;;\r\n" +
+		"EMAIL;TYPE=INTERNET:Fn_0.LN_0@example.com\r\nTEL:(000)000-0000\r\nEND:VCARD\r\n"
+	checkIt(t, "vCard", expected, response.Body.String())
+	checkIt(t, "Content-Disposition", "attachment;filename=AddressBookEntry-1.vcf", response.Header().Get("Content-Disposition"))
+
+	// The same entry, negotiated, is not a download
+	req, _ = http.NewRequest("GET", "/addressbookentry/1", nil)
+	req.Header.Set("Accept", "text/vcard")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkIt(t, "Content-Disposition", "", response.Header().Get("Content-Disposition"))
+
+	req, _ = http.NewRequest("GET", "/addressbookentry/2.vcf", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+// Folded lines, vCard 2.1 quoted-printable with a charset, and properties we do not keep
+func TestVCardImport(t *testing.T) {
+	resetTable()
+
+	payload := "BEGIN:VCARD\r\n" +
+		"VERSION:2.1\r\n" +
+		"N;CHARSET=ISO-8859-1;ENCODING=QUOTED-PRINTABLE:M=FCller;J=\r\n" +
+		"=FCrgen\r\n" +
+		"TEL;CELL:(123)456-7890\r\n" +
+		"ADR;HOME:;;1 Main St;Springfield;;;\r\n" +
+		"END:VCARD\r\n" +
+		"BEGIN:VCARD\r\n" +
+		"VERSION:4.0\r\n" +
+		"FN:Ann Lee\r\n" +
+		"EMAIL:ann.lee@exa\r\n" +
+		" mple.com\r\n" +
+		"END:VCARD\r\n"
+
+	req, _ := http.NewRequest("POST", "/vcardimport", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "text/vcard")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if !strings.Contains(response.Body.String(), "unsupported property ADR ignored") {
+		t.Errorf("Expected ADR to be reported, got %s", response.Body.String())
+	}
+
+	// Listed by lastname
+	abes, err := a.DB.ListAddressBookEntries()
 	if nil != err {
-		t.Errorf( "TestCSVImport:: failed to read ABEs: %v", err )
+		t.Fatalf("Failed to read ABEs: %v", err)
+	}
+	if 2 != len(abes) {
+		t.Fatalf("Expected 2 ABEs, but found %d", len(abes))
+	}
+	checkIt(t, "firstname", "Ann", abes[0].Firstname)
+	checkIt(t, "email", "ann.lee@example.com", abes[0].Email)
+	checkIt(t, "firstname", "Jürgen", abes[1].Firstname)
+	checkIt(t, "lastname", "Müller", abes[1].Lastname)
+	checkIt(t, "phone", "(123)456-7890", abes[1].Phone)
+}
+
+// One bad card means nothing is imported
+func TestVCardImportRejectsCardWithoutName(t *testing.T) {
+	resetTable()
+
+	payload := "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:Ann Lee\r\nEND:VCARD\r\n" +
+		"BEGIN:VCARD\r\nVERSION:4.0\r\nEMAIL:nobody@example.com\r\nEND:VCARD\r\n"
+
+	req, _ := http.NewRequest("POST", "/vcardimport", bytes.NewBufferString(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+	checkABECount(t, 0)
+}
+
+// A bad record in an atomic insert means nothing is imported
+func TestCSVImportAtomicInsert(t *testing.T) {
+	resetTable()
+
+	b := encodeCSV(t, generateAddressBookEntries(t, 5))
+	b.WriteString("1,too,few\n")
+
+	req, _ := http.NewRequest("POST", "/csvimport?atomic=true", b)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+	checkABECount(t, 0)
+}
+
+func TestCSVImportReplaceCannotBeNonAtomic(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/csvimport?mode=replace&atomic=false", bytes.NewBufferString(""))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestNDJSONExport(t *testing.T) {
+	resetTable()
+
+	const numABEs = 10
+	addAddressBookEntries(t, numABEs)
+
+	req, _ := http.NewRequest("GET", "/ndjsonexport", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkIt(t, "Content-Type", "application/x-ndjson", response.Header().Get("Content-Type"))
+
+	lines := strings.Split(strings.TrimSuffix(response.Body.String(), "\n"), "\n")
+	if numABEs != len(lines) {
+		t.Fatalf("Expected %d lines, got %d", numABEs, len(lines))
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &m); nil != err {
+		t.Fatalf("Line 1 is not JSON: %v", err)
+	}
+	checkIt(t, "lastname", "Ln_0", m["lastname"])
+}
+
+func ndjsonPayload() (*bytes.Buffer) {
+	return bytes.NewBufferString(
+		`{"firstname":"Fn1","lastname":"Ln1","email":"Fn1.Ln1@example.com","phone":"(123)456-7890"}` + "\n" +
+		`{"firstname":"Fn2","lastname":` + "\n" +
+		"\n" +
+		`{"firstname":"Fn3","lastname":"Ln3","email":"","phone":""}` + "\n")
+}
+
+// Bad lines are reported, the good ones still go in
+func TestNDJSONImport(t *testing.T) {
+	resetTable()
+
+	req, _ := http.NewRequest("POST", "/ndjsonimport", ndjsonPayload())
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusPartialContent, response.Code)
+	checkABECount(t, 2)
+
+	var msgs []string
+	json.Unmarshal(response.Body.Bytes(), &msgs)
+	if 2 != len(msgs) || !strings.Contains(msgs[0], "rcd# 2") {
+		t.Errorf("Expected line 2 to be reported, got %v", msgs)
+	}
+}
+
+func TestNDJSONImportAtomic(t *testing.T) {
+	resetTable()
+
+	req, _ := http.NewRequest("POST", "/ndjsonimport?atomic=true", ndjsonPayload())
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+	checkABECount(t, 0)
+}
+
+// GET /addressbookentries, Accept: text/csv
+func TestListAddressBookEntriesAcceptCSV(t *testing.T) {
+	resetTable()
+
+	const numABEs = 3
+	addAddressBookEntries(t, numABEs)
+
+	req, _ := http.NewRequest("GET", "/addressbookentries", nil)
+	req.Header.Set("Accept", "text/csv, */*;q=0.1")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkIt(t, "Content-Type", "text/csv", response.Header().Get("Content-Type"))
+
+	if count := countCSVRecords(t, response); 1+numABEs != count {
+		t.Errorf("Expected %d CSV records, got %d", 1+numABEs, count)
+	}
+}
+
+// GET /addressbookentry/1, Accept: application/xml
+func TestGetAddressBookEntryAcceptXML(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 1)
+
+	req, _ := http.NewRequest("GET", "/addressbookentry/1", nil)
+	req.Header.Set("Accept", "application/xml")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkIt(t, "Content-Type", "application/xml", response.Header().Get("Content-Type"))
+
+	var abe addressbook.AddressBookEntry
+	if err := xml.Unmarshal(response.Body.Bytes(), &abe); nil != err {
+		t.Fatalf("Response is not XML: %v", err)
+	}
+	checkIt(t, "lastname", "Ln_0", abe.Lastname)
+}
+
+func TestNotAcceptable(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/addressbookentries", nil)
+	req.Header.Set("Accept", "image/png")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotAcceptable, response.Code)
+}
+
+// waitForImportJob polls GET /imports/{id} until the job is over
+func waitForImportJob(t *testing.T, id int64) addressbook.ImportJob {
+	var job addressbook.ImportJob
+	for i := 0; i < 100; i++ {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/imports/%d", id), nil)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		if err := json.Unmarshal(response.Body.Bytes(), &job); nil != err {
+			t.Fatalf("Bad ImportJob JSON: %v", err)
+		}
+		switch job.Status {
+		case addressbook.ImportJobDone, addressbook.ImportJobFailed, addressbook.ImportJobCancelled:
+			return job
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("ImportJob %d still %s", id, job.Status)
+	return job
+}
+
+func TestImportJob(t *testing.T) {
+	resetTable()
+
+	const numABEs = 15
+	req, _ := http.NewRequest("POST", "/imports", encodeCSV(t, generateAddressBookEntries(t, numABEs)))
+	req.Header.Set("Content-Type", "text/csv")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusAccepted, response.Code)
+
+	var job addressbook.ImportJob
+	if err := json.Unmarshal(response.Body.Bytes(), &job); nil != err {
+		t.Fatalf("Bad ImportJob JSON: %v", err)
+	}
+	checkIt(t, "Location", fmt.Sprintf("/imports/%d", job.ID), response.Header().Get("Location"))
+
+	job = waitForImportJob(t, job.ID)
+	checkIt(t, "status", string(addressbook.ImportJobDone), string(job.Status))
+	if numABEs != job.Processed || numABEs != job.Inserted || 0 != job.Failed {
+		t.Errorf("Expected %d processed and inserted, got %+v", numABEs, job)
+	}
+	checkABECount(t, numABEs)
+}
+
+// Bad lines are reported in the job, the good ones still go in
+func TestImportJobNDJSON(t *testing.T) {
+	resetTable()
+
+	req, _ := http.NewRequest("POST", "/imports", ndjsonPayload())
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusAccepted, response.Code)
+
+	var job addressbook.ImportJob
+	json.Unmarshal(response.Body.Bytes(), &job)
+	job = waitForImportJob(t, job.ID)
+	checkIt(t, "status", string(addressbook.ImportJobDone), string(job.Status))
+	if 1 != job.Failed || 2 != job.Inserted {
+		t.Errorf("Expected 2 inserted and 1 failed, got %+v", job)
 	}
-	if numABEs != len(currentABEs) {
-		t.Errorf( "Exected %d ABEs, but found %d", numABEs, len(currentABEs) )
+	checkABECount(t, 2)
+}
+
+func TestImportJobUnsupportedFormat(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/imports", bytes.NewBufferString("BEGIN:VCARD"))
+	req.Header.Set("Content-Type", "image/png")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnsupportedMediaType, response.Code)
+}
+
+func TestImportJobNotFound(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/imports/999999", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+// It is too late to cancel a job that is over
+func TestCancelFinishedImportJob(t *testing.T) {
+	resetTable()
+
+	req, _ := http.NewRequest("POST", "/imports", encodeCSV(t, generateAddressBookEntries(t, 1)))
+	req.Header.Set("Content-Type", "text/csv")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusAccepted, response.Code)
+
+	var job addressbook.ImportJob
+	json.Unmarshal(response.Body.Bytes(), &job)
+	waitForImportJob(t, job.ID)
+
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/imports/%d", job.ID), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+}
+
+// GET /duplicates
+func TestDuplicates(t *testing.T) {
+	resetTable()
+
+	for _, abe := range []addressbook.AddressBookEntry{
+		{Firstname: "Jonathan", Lastname: "Smith", Email: "JSmith+news@Example.com", Phone: "(123)456-7890"},
+		{Firstname: "Jonathon", Lastname: "Smith", Email: "jsmith@example.com"},
+		{Firstname: "J", Lastname: "Smyth", Phone: "+1 123 456 7890"},
+		{Firstname: "José", Lastname: "Núñez"},
+		{Firstname: "Jose", Lastname: "Nunez"},
+		{Firstname: "Alice", Lastname: "Wong", Email: "alice@example.org"},
+		{Firstname: "Bob", Lastname: "Wong", Email: "bob@example.org"},
+	} {
+		abe := abe
+		if _, err := a.DB.AddAddressBookEntry(&abe); nil != err {
+			t.Fatalf("Failed to add AddressBookEntry: %v", err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/duplicates", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var clusters []addressbook.DuplicateCluster
+	if err := json.Unmarshal(response.Body.Bytes(), &clusters); nil != err {
+		t.Fatalf("Bad duplicates JSON: %v", err)
+	}
+	if 2 != len(clusters) {
+		t.Fatalf("Expected 2 clusters, got %d: %s", len(clusters), response.Body.String())
+	}
+	// Email, phone and name all play a part in the Smith cluster
+	checkIt(t, "Smith cluster size", 3, len(clusters[0].Entries))
+	checkIt(t, "Smith cluster reasons", "email,phone,name", strings.Join(clusters[0].Reasons, ","))
+	checkIt(t, "Núñez cluster size", 2, len(clusters[1].Entries))
+	if clusters[0].Confidence <= clusters[1].Confidence {
+		t.Errorf("Expected the most confident cluster first, got %v then %v", clusters[0].Confidence, clusters[1].Confidence)
+	}
+}
+
+func TestDuplicatesBadConfidence(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/duplicates?confidence=2", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+// POST /addressbookentries/merge
+func TestMergeAddressBookEntries(t *testing.T) {
+	resetTable()
+
+	for _, abe := range []addressbook.AddressBookEntry{
+		{Firstname: "Jon", Lastname: "Smith", Phone: "(123)456-7890"},
+		{Firstname: "Jonathan", Lastname: "Smith", Email: "old@example.com"},
+		{Firstname: "Jonathan", Lastname: "Smith", Email: "new@example.com", Phone: "555-0100"},
+	} {
+		abe := abe
+		if _, err := a.DB.AddAddressBookEntry(&abe); nil != err {
+			t.Fatalf("Failed to add AddressBookEntry: %v", err)
+		}
+	}
+
+	payload := `{"survivor":1,"victims":[2,3],"rules":{"firstname":"longest","email":"newest","phone":"survivor"}}`
+	req, _ := http.NewRequest("POST", "/addressbookentries/merge", bytes.NewBufferString(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var abe addressbook.AddressBookEntry
+	json.Unmarshal(response.Body.Bytes(), &abe)
+	checkIt(t, "firstname", "Jonathan", abe.Firstname)
+	checkIt(t, "email", "new@example.com", abe.Email)
+	checkIt(t, "phone", "(123)456-7890", abe.Phone)
+	checkABECount(t, 1)
+
+	// The victims now point at the survivor
+	req, _ = http.NewRequest("GET", "/addressbookentry/3", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusMovedPermanently, response.Code)
+	checkIt(t, "Location", "/addressbookentry/1", response.Header().Get("Location"))
+}
+
+// A merge's victims stay merged: not in the trash, and neither a restore nor an import by ID
+//	brings one back beside its survivor
+func TestMergeAddressBookEntriesNotRestored(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 2)
+
+	req, _ := http.NewRequest("POST", "/addressbookentries/merge", bytes.NewBufferString(`{"survivor":1,"victims":[2]}`))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("GET", "/trash", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkIt(t, "trash", "[]", strings.TrimSpace(response.Body.String()))
+
+	req, _ = http.NewRequest("POST", "/addressbookentry/2/restore", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+	checkABECount(t, 1)
+
+	// ID 2, the victim's
+	abes := generateAddressBookEntries(t, 3)
+	req, _ = http.NewRequest("POST", "/csvimport?mode=upsert-id", encodeCSV(t, abes[2:]))
+	req.Header.Set("Content-Type", "text/csv")
+	executeRequest(req)
+	checkABECount(t, 1)
+
+	req, _ = http.NewRequest("GET", "/addressbookentry/2", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusMovedPermanently, response.Code)
+	checkIt(t, "Location", "/addressbookentry/1", response.Header().Get("Location"))
+}
+
+// Nothing is merged if any of the entries is missing
+func TestMergeAddressBookEntriesMissingVictim(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 2)
+
+	payload := `{"survivor":1,"victims":[2,99]}`
+	req, _ := http.NewRequest("POST", "/addressbookentries/merge", bytes.NewBufferString(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+	checkABECount(t, 2)
+}
+
+// Merges of the same entries, each the other way round, wait on each other rather than deadlock:
+//	one of each pair merges, the other finds its survivor gone
+func TestMergeAddressBookEntriesConcurrently(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 3)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 20)
+	for i := 0; 10 > i; i++ {
+		for _, payload := range []string{`{"survivor":1,"victims":[2,3]}`, `{"survivor":3,"victims":[2,1]}`} {
+			wg.Add(1)
+			go func(payload string) {
+				defer wg.Done()
+				req, _ := http.NewRequest("POST", "/addressbookentries/merge", bytes.NewBufferString(payload))
+				codes <- executeRequest(req).Code
+			}(payload)
+		}
+	}
+	wg.Wait()
+	close(codes)
+	merged := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			merged++
+		case http.StatusNotFound:
+		default:
+			t.Errorf("Expected 200 or 404, got %d", code)
+		}
+	}
+	checkIt(t, "merged", "1", strconv.Itoa(merged))
+	checkABECount(t, 1)
+}
+
+func TestMergeAddressBookEntriesBadRule(t *testing.T) {
+	payload := `{"survivor":1,"victims":[2],"rules":{"email":"best"}}`
+	req, _ := http.NewRequest("POST", "/addressbookentries/merge", bytes.NewBufferString(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+// A deleted entry is in the trash, and only there, until restored
+func TestTrashAndRestore(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 2)
+
+	req, _ := http.NewRequest("DELETE", "/addressbookentry/1", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkABECount(t, 1)
+
+	req, _ = http.NewRequest("GET", "/trash", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var trash []addressbook.AddressBookEntry
+	if err := json.Unmarshal(response.Body.Bytes(), &trash); nil != err {
+		t.Fatalf("Bad trash JSON: %v", err)
+	}
+	if 1 != len(trash) || 1 != trash[0].ID || nil == trash[0].DeletedAt {
+		t.Fatalf("Expected entry 1 in the trash, got %s", response.Body.String())
+	}
+
+	// Exports leave it out too
+	req, _ = http.NewRequest("GET", "/csvexport", nil)
+	response = executeRequest(req)
+	if count := countCSVRecords(t, response); 2 != count {
+		t.Errorf("Expected 2 CSV records, got %d", count)
+	}
+
+	req, _ = http.NewRequest("POST", "/addressbookentry/1/restore", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkABECount(t, 2)
+
+	req, _ = http.NewRequest("GET", "/addressbookentry/1", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+func TestRestoreEntryNotInTrash(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 1)
+
+	req, _ := http.NewRequest("POST", "/addressbookentry/1/restore", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+// Only what has been in the trash longer than the retention is purged
+func TestPurgeTrash(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 1)
+	if err := a.DB.DeleteAddressBookEntry(1); nil != err {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	if n, err := a.DB.PurgeDeletedAddressBookEntries(time.Hour); nil != err || 0 != n {
+		t.Errorf("Expected nothing purged, got %d, err %v", n, err)
+	}
+	if n, err := a.DB.PurgeDeletedAddressBookEntries(-time.Hour); nil != err || 1 != n {
+		t.Errorf("Expected 1 purged, got %d, err %v", n, err)
+	}
+}
+
+// Each write is in the history, and reverting adds to it rather than rewriting it
+func TestHistoryAndRevert(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 1)
+
+	payload := []byte(`{"firstname":"Changed","lastname":"Name","email":"changed@example.com","phone":"555-0100"}`)
+	req, _ := http.NewRequest("PUT", "/addressbookentry/1", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/addressbookentry/1/history", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var revs []addressbook.Revision
+	if err := json.Unmarshal(response.Body.Bytes(), &revs); nil != err {
+		t.Fatalf("Bad history JSON: %v", err)
+	}
+	if 2 != len(revs) {
+		t.Fatalf("Expected 2 revisions, got %s", response.Body.String())
+	}
+	if addressbook.RevisionCreate != revs[0].Action || addressbook.RevisionUpdate != revs[1].Action {
+		t.Errorf("Expected create then update, got %s then %s", revs[0].Action, revs[1].Action)
+	}
+	if "Changed" != revs[1].Diff["firstname"].To || "" == revs[1].Actor {
+		t.Errorf("Expected the update's diff and actor, got %+v", revs[1])
+	}
+
+	req, _ = http.NewRequest("POST", "/addressbookentry/1/revert/1", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	abe, err := a.DB.GetAddressBookEntry(1)
+	if nil != err {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if revs[0].Entry.Firstname != abe.Firstname || revs[0].Entry.Email != abe.Email {
+		t.Errorf("Expected revision 1 (%+v), got %+v", revs[0].Entry, abe)
+	}
+
+	all, err := a.DB.ListRevisions(1)
+	if nil != err || 3 != len(all) || addressbook.RevisionRevert != all[2].Action {
+		t.Errorf("Expected a third, revert, revision, got %d, err %v", len(all), err)
+	}
+}
+
+func TestRevertUnknownRevision(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 1)
+
+	req, _ := http.NewRequest("POST", "/addressbookentry/1/revert/9", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestHistoryNotFound(t *testing.T) {
+	resetTable()
+
+	req, _ := http.NewRequest("GET", "/addressbookentry/1/history", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+// Writes and exports are audited, chained, with who asked and what it was about
+func TestAuditLog(t *testing.T) {
+	resetTable()
+	// The audit log is never truncated, only look at what this test adds
+	head, _, err := a.DB.AuditChainHead()
+	if nil != err {
+		t.Fatalf("AuditChainHead failed: %v", err)
+	}
+
+	payload := []byte(`{"firstname":"Audit","lastname":"Me","email":"audit@example.com","phone":"555-0100"}`)
+	req, _ := http.NewRequest("POST", "/addressbookentry", bytes.NewBuffer(payload))
+	req.Header.Set("X-Request-ID", "test-audit-1")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	checkIt(t, "X-Request-ID", "test-audit-1", response.Header().Get("X-Request-ID"))
+
+	req, _ = http.NewRequest("GET", "/csvexport", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/admin/audit?after=%d", head), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var recs []addressbook.AuditRecord
+	if err := json.Unmarshal(response.Body.Bytes(), &recs); nil != err {
+		t.Fatalf("Bad audit JSON: %v", err)
+	}
+	if 3 != len(recs) {
+		t.Fatalf("Expected 3 audit records, got %s", response.Body.String())
+	}
+	create, started, export := recs[0], recs[1], recs[2]
+	if addressbook.AuditCreate != create.Action || "test-audit-1" != create.RequestID ||
+		1 != len(create.EntityIDs) || 1 != create.EntityIDs[0] || addressbook.AuditSuccess != create.Outcome {
+		t.Errorf("Unexpected create record %+v", create)
+	}
+	// An export is recorded before it runs, and again with how it went
+	if addressbook.AuditExport != started.Action || addressbook.AuditStarted != started.Outcome ||
+		"/csvexport" != started.Path || create.Hash != started.PrevHash {
+		t.Errorf("Unexpected started record %+v", started)
+	}
+	if addressbook.AuditExport != export.Action || "/csvexport" != export.Path ||
+		addressbook.AuditSuccess != export.Outcome || started.RequestID != export.RequestID ||
+		started.Hash != export.PrevHash {
+		t.Errorf("Unexpected export record %+v", export)
+	}
+
+	req, _ = http.NewRequest("GET", "/admin/audit/verify", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var v addressbook.AuditVerification
+	if err := json.Unmarshal(response.Body.Bytes(), &v); nil != err || !v.Valid {
+		t.Errorf("Expected a valid chain, got %s", response.Body.String())
+	}
+}
+
+func TestAuditLogFailedCall(t *testing.T) {
+	resetTable()
+	head, _, _ := a.DB.AuditChainHead()
+
+	req, _ := http.NewRequest("POST", "/addressbookentry/9/revert/1", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/admin/audit?after=%d&entity=9", head), nil)
+	response = executeRequest(req)
+	var recs []addressbook.AuditRecord
+	json.Unmarshal(response.Body.Bytes(), &recs)
+	if 1 != len(recs) || addressbook.AuditFailure != recs[0].Outcome || http.StatusNotFound != recs[0].Status {
+		t.Errorf("Expected one failed revert, got %s", response.Body.String())
+	}
+}
+
+func TestAuditLogExport(t *testing.T) {
+	resetTable()
+	head, _, _ := a.DB.AuditChainHead()
+	addAddressBookEntries(t, 1)
+
+	req, _ := http.NewRequest("GET", "/ndjsonexport", nil)
+	executeRequest(req)
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/admin/audit/export?after=%d", head), nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkIt(t, "Content-Type", "application/jsonl", response.Header().Get("Content-Type"))
+
+	// The export, started and done, then this download of the log, started
+	lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+	if 3 != len(lines) {
+		t.Fatalf("Expected 3 JSON lines, got %d: %s", len(lines), response.Body.String())
+	}
+	for i, want := range []addressbook.AuditAction{addressbook.AuditExport, addressbook.AuditExport, addressbook.AuditLogExport} {
+		var rec addressbook.AuditRecord
+		if err := json.Unmarshal([]byte(lines[i]), &rec); nil != err || rec.Hash != rec.ComputeHash() || want != rec.Action {
+			t.Errorf("Bad audit line (%v): %s", err, lines[i])
+		}
+	}
+}
+
+// The entry list is the whole book, in whatever format is asked for, so it is audited as an export
+func TestAuditLogListExport(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 2)
+	head, _, _ := a.DB.AuditChainHead()
+
+	req, _ := http.NewRequest("GET", "/addressbookentries", nil)
+	req.Header.Set("Accept", "text/csv")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	req, _ = http.NewRequest("GET", "/duplicates", nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	req, _ = http.NewRequest("GET", "/trash", nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	// One entry, negotiated, is as much an export as its .vcf
+	req, _ = http.NewRequest("GET", "/addressbookentry/1", nil)
+	req.Header.Set("Accept", "text/vcard")
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/admin/audit?after=%d&action=export", head), nil)
+	response = executeRequest(req)
+	var recs []addressbook.AuditRecord
+	json.Unmarshal(response.Body.Bytes(), &recs)
+	// Each recorded as started, then done
+	if 8 != len(recs) {
+		t.Fatalf("Expected 8 export records, got %s", response.Body.String())
+	}
+	for i, path := range []string{"/addressbookentries", "/duplicates", "/trash", "/addressbookentry/1"} {
+		started, done := recs[2*i], recs[2*i+1]
+		if path != started.Path || addressbook.AuditStarted != started.Outcome {
+			t.Errorf("Expected the export of %s to start, got %+v", path, started)
+		}
+		if path != done.Path || addressbook.AuditSuccess != done.Outcome || started.RequestID != done.RequestID {
+			t.Errorf("Expected the export of %s, got %+v", path, done)
+		}
+	}
+	if 1 != len(recs[7].EntityIDs) || 1 != recs[7].EntityIDs[0] {
+		t.Errorf("Expected the export of entry 1, got %+v", recs[7])
+	}
+}
+
+func TestAuditLogBadFilter(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/audit?since=yesterday", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+// unauditedDB can not append to the audit log
+type unauditedDB struct {
+	addressbook.AddressBookDatabase
+}
+
+func (db unauditedDB) AppendAuditRecord(rec *addressbook.AuditRecord) error {
+	return fmt.Errorf("auditlog is read only")
+}
+
+// Without an audit log, exports and imports are refused before they run, other calls go ahead,
+//	and every record that could not be written is counted
+func TestAuditLogUnavailable(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 1)
+	failures := func() float64 {
+		response := executeRequest(httptest.NewRequest("GET", "/metrics", nil))
+		n := 0.0
+		for _, line := range strings.Split(response.Body.String(), "\n") {
+			if strings.HasPrefix(line, "addressbook_audit_append_failures_total{") {
+				v, _ := strconv.ParseFloat(line[strings.LastIndex(line, " ")+1:], 64)
+				n += v
+			}
+		}
+		return n
+	}
+	before := failures()
+
+	a.DB = unauditedDB{a.DB}
+	defer func() { a.DB = a.DB.(unauditedDB).AddressBookDatabase }()
+	response := executeRequest(httptest.NewRequest("GET", "/csvexport", nil))
+	checkResponseCode(t, http.StatusServiceUnavailable, response.Code)
+	checkIt(t, "Content-Type", "application/problem+json", response.Header().Get("Content-Type"))
+	if strings.Contains(response.Body.String(), "555-") {
+		t.Errorf("Expected no contacts in the refusal, got %s", response.Body.String())
+	}
+	response = executeRequest(httptest.NewRequest("POST", "/csvimport", encodeCSV(t, generateAddressBookEntries(t, 2))))
+	checkResponseCode(t, http.StatusServiceUnavailable, response.Code)
+	checkABECount(t, 1)
+
+	// A change is made, its record is only missed
+	payload := []byte(`{"firstname":"No","lastname":"Audit","email":"noaudit@example.com","phone":"555-0100"}`)
+	response = executeRequest(httptest.NewRequest("POST", "/addressbookentry", bytes.NewBuffer(payload)))
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	checkABECount(t, 2)
+
+	if got := failures() - before; 3 != got {
+		t.Errorf("Expected 3 failed appends counted, got %v", got)
+	}
+}
+
+// Without a live key, nothing gets through
+func TestAPIKeyRequired(t *testing.T) {
+	req, _ := http.NewRequest("DELETE", "/addressbookentry/1", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusUnauthorized, rr.Code)
+	if "" == rr.Header().Get("WWW-Authenticate") {
+		t.Errorf("Expected a WWW-Authenticate challenge")
+	}
+
+	req, _ = http.NewRequest("GET", "/addressbookentries", nil)
+	req.Header.Set("Authorization", "Bearer yab_not-a-key")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+// A key made through the API works until it is revoked, and is who the audit log says called
+func TestAPIKeyLifecycle(t *testing.T) {
+	resetTable()
+
+	payload := []byte(`{"name":"crm-sync","expiresIn":"1h"}`)
+	req, _ := http.NewRequest("POST", "/admin/apikeys", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var created struct {
+		ID  int64  `json:"id"`
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &created); nil != err || "" == created.Key {
+		t.Fatalf("Expected the new key, got %s", response.Body.String())
+	}
+
+	head, _, _ := a.DB.AuditChainHead()
+	payload = []byte(`{"firstname":"Key","lastname":"User","email":"key@example.com","phone":"555-0100"}`)
+	req, _ = http.NewRequest("POST", "/addressbookentry", bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", "Bearer "+created.Key)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var recs []addressbook.AuditRecord
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/admin/audit?after=%d", head), nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &recs)
+	if 1 != len(recs) || "key:crm-sync" != recs[0].Actor {
+		t.Errorf("Expected the create by crm-sync, got %s", response.Body.String())
+	}
+
+	// Not an admin key
+	req, _ = http.NewRequest("GET", "/admin/apikeys", nil)
+	req.Header.Set("Authorization", "Bearer "+created.Key)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/admin/apikeys/%d", created.ID), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/addressbookentries", nil)
+	req.Header.Set("Authorization", "Bearer "+created.Key)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+func TestExpiredAPIKey(t *testing.T) {
+	secret, key, err := addressbook.NewAPIKey(a.DB, "short-lived", false, time.Second)
+	if nil != err {
+		t.Fatalf("NewAPIKey failed: %v", err)
+	}
+	time.Sleep(time.Until(*key.ExpiresAt) + 10*time.Millisecond)
+
+	req, _ := http.NewRequest("GET", "/addressbookentries", nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+// signToken makes a token as the stand-in identity provider, for alice, valid for an hour
+func signToken(t *testing.T, key *rsa.PrivateKey, issuer string, extra map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test-key"))
+	if nil != err {
+		t.Fatalf("NewSigner failed: %v", err)
+	}
+	claims := jwt.Claims{
+		Issuer:   issuer,
+		Audience: jwt.Audience{testAudience},
+		Subject:  "alice",
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Claims(extra).Serialize()
+	if nil != err {
+		t.Fatalf("Could not sign token: %v", err)
+	}
+	return token
+}
+
+// Each route needs its scope, from the token's scope claim or its roles
+func TestOIDCTokenScopes(t *testing.T) {
+	resetTable()
+	reader := signToken(t, oidcKey, testIssuer, map[string]interface{}{"scope": "openid contacts:read"})
+	editor := signToken(t, oidcKey, testIssuer, map[string]interface{}{"roles": []string{"contacts-editor"}})
+	payload := `{"firstname":"Token","lastname":"User","email":"token@example.com","phone":"555-0100"}`
+
+	req, _ := http.NewRequest("GET", "/addressbookentries", nil)
+	req.Header.Set("Authorization", "Bearer "+reader)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("POST", "/addressbookentry", strings.NewReader(payload))
+	req.Header.Set("Authorization", "Bearer "+reader)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("POST", "/addressbookentry", strings.NewReader(payload))
+	req.Header.Set("Authorization", "Bearer "+editor)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("POST", "/csvimport", strings.NewReader("ID,Firstname,Lastname,Email,Phone\n"))
+	req.Header.Set("Authorization", "Bearer "+editor)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+}
+
+func TestOIDCTokenRejected(t *testing.T) {
+	stranger, _ := rsa.GenerateKey(rand.Reader, 2048)
+	scope := map[string]interface{}{"scope": "contacts:read"}
+	for name, token := range map[string]string{
+		"wrong issuer": signToken(t, oidcKey, "https://elsewhere.example.com", scope),
+		"unknown key":  signToken(t, stranger, testIssuer, scope),
+		"not a JWT":    "not.a.jwt",
+	} {
+		req, _ := http.NewRequest("GET", "/addressbookentries", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		response := executeRequest(req)
+		if http.StatusUnauthorized != response.Code {
+			t.Errorf("%s: expected 401, got %d", name, response.Code)
+		}
+	}
+}
+
+// A team's book is only seen by the team, and its entries are not in the default book
+func TestAddressBooks(t *testing.T) {
+	resetTable()
+	alice := signToken(t, oidcKey, testIssuer,
+		map[string]interface{}{"scope": "contacts:read contacts:write", "groups": []string{"sales"}})
+	bob := signToken(t, oidcKey, testIssuer, map[string]interface{}{"sub": "bob", "scope": "contacts:read"})
+
+	req, _ := http.NewRequest("POST", "/books", strings.NewReader(`{"name":"sales","owner":"team:sales"}`))
+	req.Header.Set("Authorization", "Bearer "+alice)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	checkIt(t, "Location", "/books/sales", response.Header().Get("Location"))
+
+	payload := `{"firstname":"Team","lastname":"Contact","email":"team@example.com","phone":"555-0100"}`
+	req, _ = http.NewRequest("POST", "/books/sales/entries", strings.NewReader(payload))
+	req.Header.Set("Authorization", "Bearer "+alice)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var abe addressbook.AddressBookEntry
+	json.Unmarshal(response.Body.Bytes(), &abe)
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/books/sales/entries/%d", abe.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+alice)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	// Not in the default book
+	checkABECount(t, 0)
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/addressbookentry/%d", abe.ID), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	// Not bob's team, so as far as he can tell there is no such book
+	req, _ = http.NewRequest("GET", "/books/sales/entries", nil)
+	req.Header.Set("Authorization", "Bearer "+bob)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("GET", "/books", nil)
+	req.Header.Set("Authorization", "Bearer "+bob)
+	response = executeRequest(req)
+	var books []addressbook.AddressBook
+	json.Unmarshal(response.Body.Bytes(), &books)
+	if 1 != len(books) || "default" != books[0].Name {
+		t.Errorf("Expected only the default book, got %s", response.Body.String())
+	}
+}
+
+func TestAddressBookCreateRefused(t *testing.T) {
+	resetTable()
+	alice := signToken(t, oidcKey, testIssuer, map[string]interface{}{"scope": "contacts:read contacts:write"})
+
+	for _, c := range []struct {
+		payload  string
+		expected int
+	}{
+		{`{"name":"Not A Name"}`, http.StatusBadRequest},
+		{`{"name":"ops","owner":"ops"}`, http.StatusBadRequest},
+		{`{"name":"ops","owner":"team:ops"}`, http.StatusForbidden},
+		{`{"name":"default"}`, http.StatusConflict},
+	} {
+		req, _ := http.NewRequest("POST", "/books", strings.NewReader(c.payload))
+		req.Header.Set("Authorization", "Bearer "+alice)
+		response := executeRequest(req)
+		if c.expected != response.Code {
+			t.Errorf("%s: expected %d, got %d", c.payload, c.expected, response.Code)
+		}
+	}
+}
+
+// A viewer can read a shared book but not write to it, an editor can do both, only an owner shares it
+func TestBookGrants(t *testing.T) {
+	resetTable()
+	alice := signToken(t, oidcKey, testIssuer, map[string]interface{}{"scope": "contacts:read contacts:write"})
+	bob := signToken(t, oidcKey, testIssuer, map[string]interface{}{"sub": "bob", "scope": "contacts:read contacts:write"})
+
+	req, _ := http.NewRequest("POST", "/books", strings.NewReader(`{"name":"alices"}`))
+	req.Header.Set("Authorization", "Bearer "+alice)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("PUT", "/books/alices/grants/user:oidc:bob", strings.NewReader(`{"role":"viewer"}`))
+	req.Header.Set("Authorization", "Bearer "+alice)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/books/alices/entries", nil)
+	req.Header.Set("Authorization", "Bearer "+bob)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	payload := `{"firstname":"Shared","lastname":"Contact","email":"shared@example.com","phone":"555-0100"}`
+	req, _ = http.NewRequest("POST", "/books/alices/entries", strings.NewReader(payload))
+	req.Header.Set("Authorization", "Bearer "+bob)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+	checkIt(t, "Content-Type", "application/problem+json", response.Header().Get("Content-Type"))
+	var p struct {
+		Status int    `json:"status"`
+		Detail string `json:"detail"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &p)
+	checkIt(t, "status", "403", fmt.Sprintf("%d", p.Status))
+
+	// Nor can a viewer share it
+	req, _ = http.NewRequest("PUT", "/books/alices/grants/user:oidc:bob", strings.NewReader(`{"role":"owner"}`))
+	req.Header.Set("Authorization", "Bearer "+bob)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("PUT", "/books/alices/grants/user:oidc:bob", strings.NewReader(`{"role":"editor"}`))
+	req.Header.Set("Authorization", "Bearer "+alice)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("POST", "/books/alices/entries", strings.NewReader(payload))
+	req.Header.Set("Authorization", "Bearer "+bob)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("DELETE", "/books/alices/grants/user:oidc:bob", nil)
+	req.Header.Set("Authorization", "Bearer "+alice)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/books/alices/entries", nil)
+	req.Header.Set("Authorization", "Bearer "+bob)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestBookGrantBadRole(t *testing.T) {
+	resetTable()
+	req, _ := http.NewRequest("PUT", "/books/default/grants/user:oidc:bob", strings.NewReader(`{"role":"superuser"}`))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+// A grant to a token's subject is not a grant to an API key of the same name, and a grantee must
+//	say which it is
+func TestBookGrantSubjectSources(t *testing.T) {
+	resetTable()
+	alice := signToken(t, oidcKey, testIssuer, map[string]interface{}{"scope": "contacts:read contacts:write"})
+	bob := signToken(t, oidcKey, testIssuer, map[string]interface{}{"sub": "bob", "scope": "contacts:read contacts:write"})
+
+	req, _ := http.NewRequest("POST", "/books", strings.NewReader(`{"name":"alices"}`))
+	req.Header.Set("Authorization", "Bearer "+alice)
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+	req, _ = http.NewRequest("PUT", "/books/alices/grants/user:bob", strings.NewReader(`{"role":"viewer"}`))
+	req.Header.Set("Authorization", "Bearer "+alice)
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+	req, _ = http.NewRequest("PUT", "/books/alices/grants/user:oidc:bob", strings.NewReader(`{"role":"viewer"}`))
+	req.Header.Set("Authorization", "Bearer "+alice)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("POST", "/admin/apikeys", strings.NewReader(`{"name":"bob"}`))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var created struct {
+		Key string `json:"key"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &created)
+
+	for who, expected := range map[string]int{bob: http.StatusOK, created.Key: http.StatusNotFound} {
+		req, _ = http.NewRequest("GET", "/books/alices/entries", nil)
+		req.Header.Set("Authorization", "Bearer "+who)
+		checkResponseCode(t, expected, executeRequest(req).Code)
+	}
+}
+
+// A second server, on the same database, with a budget small enough to spend
+func TestRateLimit(t *testing.T) {
+	resetTable()
+	limited := addressbook.Application{RateLimits: map[addressbook.RateLimitGroup]addressbook.RateLimit{
+		addressbook.RateLimitBulk: {Rate: 0.01, Burst: 2},
+	}}
+	limited.Initialize(
+		os.Getenv( "TEST_YUM_ADDRESSBOOK_DB_USERNAME" ),
+		os.Getenv( "TEST_YUM_ADDRESSBOOK_DB_PASSWORD" ),
+		os.Getenv( "TEST_YUM_ADDRESSBOOK_DB_NAME" ),
+	)
+	export := func(key string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/csvexport", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		rr := httptest.NewRecorder()
+		limited.Router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := 1; 2 >= i; i++ {
+		response := export(apiKey)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		checkIt(t, "RateLimit-Limit", "2", response.Header().Get("RateLimit-Limit"))
+		checkIt(t, "RateLimit-Remaining", fmt.Sprintf("%d", 2-i), response.Header().Get("RateLimit-Remaining"))
+	}
+
+	response := export(apiKey)
+	checkResponseCode(t, http.StatusTooManyRequests, response.Code)
+	checkIt(t, "Content-Type", "application/problem+json", response.Header().Get("Content-Type"))
+	checkIt(t, "RateLimit-Remaining", "0", response.Header().Get("RateLimit-Remaining"))
+	if wait, err := strconv.Atoi(response.Header().Get("Retry-After")); nil != err || 1 > wait || 100 < wait {
+		t.Errorf("Expected Retry-After within 100 seconds, got %q", response.Header().Get("Retry-After"))
+	}
+
+	// Reads have their own budget
+	req, _ := http.NewRequest("GET", "/addressbookentries", nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	rr := httptest.NewRecorder()
+	limited.Router.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+
+	// And so does every other key
+	other, _, err := addressbook.NewAPIKey(a.DB, "rate-limited", false, time.Hour)
+	if nil != err {
+		t.Fatalf("NewAPIKey failed: %v", err)
+	}
+	response = export(other)
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+// A JSON body is one object, of fields we know, and not too big
+func TestStrictJSONBody(t *testing.T) {
+	resetTable()
+
+	for payload, why := range map[string]string{
+		`{"firstname":"Fn1","lastname":"Ln1","email":"x@example.com","phone":"1","nickname":"F"}`: "unknown field",
+		`{"firstname":"Fn1","lastname":"Ln1","email":"x@example.com","phone":"1"}{"firstname":"Fn2"}`: "more than one",
+		`{"firstname":"Fn1","lastname":"Ln1","email":"x@example.com","phone":"1"} trailing`: "invalid character",
+	} {
+		req, _ := http.NewRequest("POST", "/addressbookentry", strings.NewReader(payload))
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+		if !strings.Contains(response.Body.String(), why) {
+			t.Errorf("Expected a message about %s, got %s", why, response.Body.String())
+		}
+	}
+	checkABECount(t, 0)
+
+	big := `{"firstname":"` + strings.Repeat("F", 2<<20) + `"}`
+	req, _ := http.NewRequest("POST", "/addressbookentry", strings.NewReader(big))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusRequestEntityTooLarge, response.Code)
+	checkIt(t, "Content-Type", "application/problem+json", response.Header().Get("Content-Type"))
+
+	req, _ = http.NewRequest("PUT", "/addressbookentry/1", strings.NewReader(big))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusRequestEntityTooLarge, response.Code)
+	checkABECount(t, 0)
+}
+
+// An import over the bulk limit is refused before anything is saved when its length is known,
+//	and otherwise, not being atomic, says what it saved before the limit
+func TestImportTooLarge(t *testing.T) {
+	resetTable()
+	a.MaxBulkBodyBytes = 8192
+	defer func() { a.MaxBulkBodyBytes = 0 }()
+	body := encodeCSV(t, generateAddressBookEntries(t, 500)).Bytes()
+
+	req, _ := http.NewRequest("POST", "/csvimport", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "text/csv")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusRequestEntityTooLarge, response.Code)
+	checkABECount(t, 0)
+
+	// Chunked, the length is only found out part way
+	req, _ = http.NewRequest("POST", "/csvimport", io.MultiReader(bytes.NewReader(body)))
+	req.Header.Set("Content-Type", "text/csv")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusRequestEntityTooLarge, response.Code)
+	var p struct {
+		Detail   string   `json:"detail"`
+		Messages []string `json:"messages"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &p)
+	saved, err := a.DB.ListAddressBookEntries()
+	if nil != err || 0 == len(saved) || !strings.Contains(p.Detail, fmt.Sprintf("%d inserted", len(saved))) {
+		t.Errorf("Expected the %d entries saved to be reported, got %s", len(saved), response.Body.String())
+	}
+}
+
+// Failed authentications spend their address's budget, then even a good key from there waits
+func TestRateLimitFailedAuth(t *testing.T) {
+	limited := addressbook.Application{RateLimits: map[addressbook.RateLimitGroup]addressbook.RateLimit{
+		addressbook.RateLimitAuth: {Rate: 0.01, Burst: 2},
+	}}
+	limited.Initialize(
+		os.Getenv( "TEST_YUM_ADDRESSBOOK_DB_USERNAME" ),
+		os.Getenv( "TEST_YUM_ADDRESSBOOK_DB_PASSWORD" ),
+		os.Getenv( "TEST_YUM_ADDRESSBOOK_DB_NAME" ),
+	)
+	list := func(from, key string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/addressbookentries", nil)
+		req.RemoteAddr = from + ":4321"
+		req.Header.Set("Authorization", "Bearer "+key)
+		rr := httptest.NewRecorder()
+		limited.Router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Good keys cost nothing
+	for i := 0; 3 > i; i++ {
+		checkResponseCode(t, http.StatusOK, list("192.0.2.1", apiKey).Code)
+	}
+	for i := 0; 2 > i; i++ {
+		checkResponseCode(t, http.StatusUnauthorized, list("192.0.2.1", "yab_guessed").Code)
+	}
+	response := list("192.0.2.1", apiKey)
+	checkResponseCode(t, http.StatusTooManyRequests, response.Code)
+	if "" == response.Header().Get("Retry-After") {
+		t.Errorf("Expected a Retry-After")
+	}
+
+	// Another address has its own budget
+	checkResponseCode(t, http.StatusOK, list("192.0.2.2", apiKey).Code)
+}
+
+// A verified client certificate authenticates a request without a bearer, as its common name
+func TestClientCertificate(t *testing.T) {
+	resetTable()
+	a.TLS = &addressbook.TLSConfig{ClientScopes: map[string][]string{"crm-sync": {addressbook.ScopeRead}}}
+	defer func() { a.TLS = nil }()
+
+	// As the TLS layer leaves it, once the certificate is verified against the client CAs
+	withCert := func(method, url, cn string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(`{"firstname":"Cert"}`))
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{
+			{{Subject: pkix.Name{CommonName: cn}}},
+		}}
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	response := withCert("GET", "/addressbookentries", "crm-sync")
+	checkResponseCode(t, http.StatusOK, response.Code)
+	response = withCert("POST", "/addressbookentry", "crm-sync")
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+	response = withCert("GET", "/addressbookentries", "stranger")
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+	checkABECount(t, 0)
+}
+
+// A browser asks first, without credentials, and is told what the route takes
+func TestCORSPreflight(t *testing.T) {
+	req, _ := http.NewRequest("OPTIONS", "/books/default/entries/1", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusNoContent, rr.Code)
+	checkIt(t, "Access-Control-Allow-Origin", "https://app.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	checkIt(t, "Access-Control-Allow-Methods", "GET, PUT, DELETE", rr.Header().Get("Access-Control-Allow-Methods"))
+	checkIt(t, "Access-Control-Max-Age", "3600", rr.Header().Get("Access-Control-Max-Age"))
+
+	// No route, no methods to promise
+	req, _ = http.NewRequest("OPTIONS", "/nonexistent", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusNotFound, rr.Code)
+	checkIt(t, "Access-Control-Allow-Methods", "", rr.Header().Get("Access-Control-Allow-Methods"))
+
+	req, _ = http.NewRequest("OPTIONS", "/addressbookentries", nil)
+	req.Header.Set("Origin", "https://elsewhere.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusForbidden, rr.Code)
+	checkIt(t, "Access-Control-Allow-Origin", "", rr.Header().Get("Access-Control-Allow-Origin"))
+
+	// The call itself
+	req, _ = http.NewRequest("GET", "/addressbookentries", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkIt(t, "Access-Control-Allow-Origin", "https://app.example.com", response.Header().Get("Access-Control-Allow-Origin"))
+}
+
+// Credentials are only allowed for an origin listed by name, never for any origin by "*"
+func TestCORSAnyOriginCredentials(t *testing.T) {
+	cors := *a.CORS
+	cors.AllowedOrigins = []string{"*", "https://app.example.com"}
+	cors.AllowCredentials = true
+	defer func(saved *addressbook.CORSConfig) { a.CORS = saved }(a.CORS)
+	a.CORS = &cors
+
+	for origin, credentials := range map[string]string{"https://app.example.com": "true", "https://elsewhere.example.com": ""} {
+		req, _ := http.NewRequest("GET", "/addressbookentries", nil)
+		req.Header.Set("Origin", origin)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		checkIt(t, "Access-Control-Allow-Origin", origin, response.Header().Get("Access-Control-Allow-Origin"))
+		checkIt(t, "Access-Control-Allow-Credentials", credentials, response.Header().Get("Access-Control-Allow-Credentials"))
+	}
+}
+
+// Each request is logged, with its ID, which is also in any error response
+func TestRequestLogging(t *testing.T) {
+	resetTable()
+	req, _ := http.NewRequest("GET", "/addressbookentry/42", nil)
+	req.Header.Set("X-Request-ID", "test-log-1")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+	checkIt(t, "X-Request-ID", "test-log-1", response.Header().Get("X-Request-ID"))
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	checkIt(t, "requestId", "test-log-1", m["requestId"])
+
+	var line map[string]interface{}
+	for _, l := range strings.Split(logged.String(), "\n") {
+		if strings.Contains(l, `"request_id":"test-log-1"`) {
+			json.Unmarshal([]byte(l), &line)
+		}
+	}
+	if nil == line {
+		t.Fatalf("Expected a log line for request test-log-1")
+	}
+	checkIt(t, "msg", "request", line["msg"])
+	checkIt(t, "route", "/addressbookentry/{id:[0-9]+}", line["route"])
+	checkIt(t, "status", float64(http.StatusNotFound), line["status"])
+}
+
+func TestMetrics(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 3)
+	checkResponseCode(t, http.StatusOK, executeRequest(httptest.NewRequest("GET", "/addressbookentry/1", nil)).Code)
+	req, _ := http.NewRequest("POST", "/csvimport", encodeCSV(t, generateAddressBookEntries(t, 2)))
+	req.Header.Set("Content-Type", "text/csv")
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	response := executeRequest(httptest.NewRequest("GET", "/metrics", nil))
+	checkResponseCode(t, http.StatusOK, response.Code)
+	metrics := response.Body.String()
+	for _, want := range []string{
+		`addressbook_http_requests_total{method="GET",route="/addressbookentry/{id:[0-9]+}",status="200"}`,
+		`addressbook_http_request_duration_seconds_bucket{method="GET",route="/addressbookentry/{id:[0-9]+}",status="200"`,
+		`addressbook_db_statement_duration_seconds_count{statement="get"}`,
+		`go_sql_open_connections{db_name=`,
+		`addressbook_entries{state="live"} 5`,
+		`addressbook_entries{state="trash"} 0`,
+		`addressbook_import_rows_processed_total`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Expected the metrics to have %s", want)
+		}
+	}
+
+	// Only admins may scrape
+	req, _ = http.NewRequest("POST", "/admin/apikeys", bytes.NewBufferString(`{"name":"not-prometheus"}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var created struct {
+		Key string `json:"key"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &created)
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+created.Key)
+	checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
+}
+
+// internalErrors is addressbook_internal_errors_total for kind, as scraped
+func internalErrors(t *testing.T, kind string) float64 {
+	response := executeRequest(httptest.NewRequest("GET", "/metrics", nil))
+	checkResponseCode(t, http.StatusOK, response.Code)
+	prefix := `addressbook_internal_errors_total{kind="` + kind + `"} `
+	for _, line := range strings.Split(response.Body.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			n, _ := strconv.ParseFloat(strings.TrimPrefix(line, prefix), 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// unencodableDB gets entries json.Marshal fails on, their DeletedAt is past the year 9999
+type unencodableDB struct {
+	addressbook.AddressBookDatabase
+}
+
+func (db unencodableDB) WithBook(id int64) addressbook.AddressBookDatabase {
+	return unencodableDB{db.AddressBookDatabase.WithBook(id)}
+}
+
+func (db unencodableDB) WithActor(actor string) addressbook.AddressBookDatabase {
+	return unencodableDB{db.AddressBookDatabase.WithActor(actor)}
+}
+
+func (db unencodableDB) GetAddressBookEntry(id int64) (*addressbook.AddressBookEntry, error) {
+	abe, err := db.AddressBookDatabase.GetAddressBookEntry(id)
+	if nil == err {
+		never := time.Date(10000, time.January, 1, 0, 0, 0, 0, time.UTC)
+		abe.DeletedAt = &never
+	}
+	return abe, err
+}
+
+// A panicking handler is a 500 problem, or an aborted response once it has started, a response
+//	that can not be encoded is a 500, each is counted, and the server carries on
+func TestRecoverPanics(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 1)
+	a.Router.HandleFunc("/test/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("test panic")
+	}).Methods("GET")
+	a.Router.HandleFunc("/test/panic-midway", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[{\"id\":1},"))
+		w.(http.Flusher).Flush()
+		panic("test panic midway")
+	}).Methods("GET")
+	panics, encodings := internalErrors(t, "panic"), internalErrors(t, "encoding")
+
+	response := executeRequest(httptest.NewRequest("GET", "/test/panic", nil))
+	checkResponseCode(t, http.StatusInternalServerError, response.Code)
+	checkIt(t, "Content-Type", "application/problem+json", response.Header().Get("Content-Type"))
+	var p struct {
+		Status    int    `json:"status"`
+		RequestID string `json:"requestId"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &p)
+	checkIt(t, "status", "500", strconv.Itoa(p.Status))
+	if "" == p.RequestID || response.Header().Get("X-Request-ID") != p.RequestID {
+		t.Errorf("Expected the problem to have the request ID %q, got %q", response.Header().Get("X-Request-ID"), p.RequestID)
+	}
+	checkResponseCode(t, http.StatusOK, executeRequest(httptest.NewRequest("GET", "/addressbookentry/1", nil)).Code)
+
+	// Once the response has started, the client must see it cut short, not take it for whole
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL+"/test/panic-midway", nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if nil == err {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if nil == err {
+		t.Errorf("Expected the response to be aborted")
+	}
+	req, _ = http.NewRequest("GET", server.URL+"/addressbookentry/1", nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	if resp, err = http.DefaultClient.Do(req); nil != err {
+		t.Fatalf("Expected the server to carry on, got %v", err)
+	}
+	resp.Body.Close()
+	checkResponseCode(t, http.StatusOK, resp.StatusCode)
+
+	// json.Marshal failing is a 500, not the end of the server
+	defer func(saved addressbook.AddressBookDatabase) { a.DB = saved }(a.DB)
+	a.DB = unencodableDB{a.DB}
+	response = executeRequest(httptest.NewRequest("GET", "/addressbookentry/1", nil))
+	checkResponseCode(t, http.StatusInternalServerError, response.Code)
+	checkIt(t, "Content-Type", "application/problem+json", response.Header().Get("Content-Type"))
+	a.DB = a.DB.(unencodableDB).AddressBookDatabase
+	checkResponseCode(t, http.StatusOK, executeRequest(httptest.NewRequest("GET", "/addressbookentry/1", nil)).Code)
+
+	if internalErrors(t, "panic") < panics+2 {
+		t.Errorf("Expected addressbook_internal_errors_total{kind=\"panic\"} to count both panics")
+	}
+	if internalErrors(t, "encoding") < encodings+1 {
+		t.Errorf("Expected addressbook_internal_errors_total{kind=\"encoding\"} to count the failed encoding")
+	}
+}
+
+// A request is a span, in the caller's trace, and its database calls are spans within it
+func TestTracing(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 1)
+	const traceID, callerSpanID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req, _ := http.NewRequest("GET", "/addressbookentry/1", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+callerSpanID+"-01")
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	// As the stdout exporter writes them
+	type spanContext struct {
+		TraceID string
+		SpanID  string
+	}
+	type exportedSpan struct {
+		Name        string
+		SpanContext spanContext
+		Parent      spanContext
+	}
+	var request, get *exportedSpan
+	for _, l := range strings.Split(traced.String(), "\n") {
+		var span exportedSpan
+		if nil != json.Unmarshal([]byte(l), &span) || traceID != span.SpanContext.TraceID {
+			continue
+		}
+		switch span.Name {
+		case "GET /addressbookentry/{id:[0-9]+}":
+			request = &span
+		case "AddressBookDatabase.GetAddressBookEntry":
+			get = &span
+		}
+	}
+	if nil == request || nil == get {
+		t.Fatalf("Expected the request's span and its GetAddressBookEntry span in trace %s", traceID)
+	}
+	checkIt(t, "request parent", callerSpanID, request.Parent.SpanID)
+	checkIt(t, "GetAddressBookEntry parent", request.SpanContext.SpanID, get.Parent.SpanID)
+
+	if !strings.Contains(logged.String(), `"trace_id":"`+traceID+`"`) {
+		t.Errorf("Expected the request's log line to have its trace_id")
+	}
+}
+
+// The orchestrator's probes need no credentials
+func TestHealthProbes(t *testing.T) {
+	for path, status := range map[string]string{"/healthz": "ok", "/readyz": "ready"} {
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		checkResponseCode(t, http.StatusOK, rr.Code)
+		var m map[string]string
+		json.Unmarshal(rr.Body.Bytes(), &m)
+		checkIt(t, path, status, m["status"])
+	}
+}
+
+// The pool is sized as a.DBPool says, and the circuit breaker is closed while MySQL is up
+func TestDatabasePool(t *testing.T) {
+	resetTable()
+	addAddressBookEntries(t, 1)
+
+	response := executeRequest(httptest.NewRequest("GET", "/metrics", nil))
+	checkResponseCode(t, http.StatusOK, response.Code)
+	metrics := response.Body.String()
+	for _, want := range []string{
+		fmt.Sprintf(`go_sql_max_open_connections{db_name="%s"} 10`, os.Getenv( "TEST_YUM_ADDRESSBOOK_DB_NAME" )),
+		"addressbook_db_circuit_open 0",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Expected the metrics to have %s", want)
+		}
 	}
+	checkIt(t, "available", true, a.DB.Available())
 }
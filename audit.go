@@ -0,0 +1,446 @@
+// 2026.10.19 rjj: Audit log
+// Every API call that changes the address book, or takes it out in bulk, is recorded in an
+//	append-only log.  Each AuditRecord carries the hash of the one before it, so removing or
+//	editing a record breaks the chain from there on, see VerifyAuditChain.
+// Contacts going out, or coming in, must never go unrecorded: an export or import is recorded
+//	as started before its handler runs, and refused if that can not be done.  Its outcome is a
+//	second record, with the same request ID.
+
+package addressbook
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AuditAction is the kind of call an AuditRecord records.
+type AuditAction string
+
+const (
+	AuditCreate       AuditAction = "create"
+	AuditUpdate       AuditAction = "update"
+	AuditDelete       AuditAction = "delete"
+	AuditRestore      AuditAction = "restore"
+	AuditRevert       AuditAction = "revert"
+	AuditMerge        AuditAction = "merge"
+	AuditImport       AuditAction = "import"
+	AuditImportCancel AuditAction = "import-cancel"
+	AuditExport       AuditAction = "export"
+	// AuditPurge is the trash being emptied of old entries, by the system rather than a caller
+	AuditPurge AuditAction = "purge"
+	// AuditLogExport is a download of the audit log itself
+	AuditLogExport    AuditAction = "audit-export"
+	AuditAPIKeyCreate AuditAction = "apikey-create"
+	AuditAPIKeyRevoke AuditAction = "apikey-revoke"
+	AuditBookCreate   AuditAction = "book-create"
+	AuditGrant        AuditAction = "grant"
+	AuditGrantRevoke  AuditAction = "grant-revoke"
+)
+
+// AuditOutcome is how the call ended.
+type AuditOutcome string
+
+const (
+	AuditSuccess AuditOutcome = "success"
+	AuditFailure AuditOutcome = "failure"
+	// AuditAborted is a response cut off part way through, e.g. an export that lost its database
+	AuditAborted AuditOutcome = "aborted"
+	// AuditStarted is an export or import about to run, its outcome is recorded after
+	AuditStarted AuditOutcome = "started"
+)
+
+// recordedFirst are the actions recorded as started before the call, see above
+var recordedFirst = map[AuditAction]bool{AuditExport: true, AuditImport: true, AuditLogExport: true}
+
+// AuditRecord is one entry in the audit log.
+type AuditRecord struct {
+	// Seq counts up from 1, without gaps
+	Seq       int64        `json:"seq"`
+	Date      time.Time    `json:"date"`
+	Actor     string       `json:"actor"`
+	SourceIP  string       `json:"sourceIp"`
+	RequestID string       `json:"requestId"`
+	Action    AuditAction  `json:"action"`
+	Method    string       `json:"method"`
+	Path      string       `json:"path"`
+	// EntityIDs are the AddressBookEntries the call was about, if known
+	EntityIDs []int64      `json:"entityIds"`
+	Status    int          `json:"status"`
+	Outcome   AuditOutcome `json:"outcome"`
+	Detail    string       `json:"detail"`
+	// PrevHash is the Hash of record Seq-1, "" for the first record
+	PrevHash  string       `json:"prevHash"`
+	Hash      string       `json:"hash"`
+}
+
+// auditTimeFormat is fixed width, so dates compare as strings
+const auditTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// ComputeHash returns the hash of everything in the record but Hash itself.
+func (rec *AuditRecord) ComputeHash() string {
+	ids := rec.EntityIDs
+	if nil == ids {
+		ids = []int64{}
+	}
+	// Field order is fixed by the struct, so the encoding is too
+	b, _ := json.Marshal(struct {
+		Seq       int64        `json:"seq"`
+		Date      string       `json:"date"`
+		Actor     string       `json:"actor"`
+		SourceIP  string       `json:"sourceIp"`
+		RequestID string       `json:"requestId"`
+		Action    AuditAction  `json:"action"`
+		Method    string       `json:"method"`
+		Path      string       `json:"path"`
+		EntityIDs []int64      `json:"entityIds"`
+		Status    int          `json:"status"`
+		Outcome   AuditOutcome `json:"outcome"`
+		Detail    string       `json:"detail"`
+		PrevHash  string       `json:"prevHash"`
+	}{rec.Seq, rec.Date.UTC().Format(auditTimeFormat), rec.Actor, rec.SourceIP, rec.RequestID,
+		rec.Action, rec.Method, rec.Path, ids, rec.Status, rec.Outcome, rec.Detail, rec.PrevHash})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditFilter selects AuditRecords, the zero value selects them all.
+type AuditFilter struct {
+	// AfterSeq skips records up to and including this one, for paging
+	AfterSeq int64
+	Actor    string
+	Action   AuditAction
+	EntityID int64
+	Since    time.Time
+	Until    time.Time
+	// Limit is the most records returned, 0 for no limit
+	Limit int
+}
+
+// AuditDatabase stores the audit log.  There is deliberately no way to change or remove a record.
+type AuditDatabase interface {
+	// AppendAuditRecord assigns rec the next Seq, chains it to the last record and saves it.
+	AppendAuditRecord(rec *AuditRecord) error
+
+	// IterateAuditRecords calls fn for each record the filter selects, in Seq order.
+	IterateAuditRecords(ctx context.Context, filter AuditFilter, fn func(*AuditRecord) error) error
+
+	// AuditChainHead returns the Seq and Hash of the last record appended, 0 and "" if none.
+	AuditChainHead() (int64, string, error)
+}
+
+// AuditVerification is the result of VerifyAuditChain.
+type AuditVerification struct {
+	Valid   bool  `json:"valid"`
+	Records int64 `json:"records"`
+	// BrokenAt is the Seq of the first record that does not fit the chain
+	BrokenAt int64  `json:"brokenAt,omitempty"`
+	Problem  string `json:"problem,omitempty"`
+}
+
+// VerifyAuditChain walks the whole audit log checking every link, and that it ends at the head.
+func VerifyAuditChain(ctx context.Context, db AuditDatabase) (*AuditVerification, error) {
+	// Read the head first, records appended while walking are past it and not checked
+	headSeq, headHash, err := db.AuditChainHead()
+	if nil != err {
+		return nil, err
+	}
+
+	v := &AuditVerification{Valid: true}
+	var prevSeq int64
+	var prevHash string
+	broken := func(seq int64, format string, args ...interface{}) error {
+		v.Valid = false
+		v.BrokenAt = seq
+		v.Problem = fmt.Sprintf(format, args...)
+		return errAuditWalkStopped
+	}
+	err = db.IterateAuditRecords(ctx, AuditFilter{}, func(rec *AuditRecord) error {
+		if rec.Seq > headSeq {
+			return errAuditWalkStopped
+		}
+		v.Records++
+		switch {
+		case prevSeq+1 != rec.Seq:
+			return broken(prevSeq+1, "record %d is missing", prevSeq+1)
+		case prevHash != rec.PrevHash:
+			return broken(rec.Seq, "record %d does not follow record %d", rec.Seq, prevSeq)
+		case rec.ComputeHash() != rec.Hash:
+			return broken(rec.Seq, "record %d has been altered", rec.Seq)
+		}
+		prevSeq, prevHash = rec.Seq, rec.Hash
+		return nil
+	})
+	if nil != err && errAuditWalkStopped != err {
+		return nil, err
+	}
+	if v.Valid && (prevSeq != headSeq || prevHash != headHash) {
+		broken(prevSeq+1, "the log ends at record %d, but %d were appended", prevSeq, headSeq)
+	}
+	return v, nil
+}
+
+// errAuditWalkStopped ends VerifyAuditChain's walk early
+var errAuditWalkStopped = fmt.Errorf("audit walk stopped")
+
+// **************** Request Auditing ****************
+
+// requestIDHeader carries the caller's request ID, one is made up if they do not send it
+const requestIDHeader = "X-Request-ID"
+
+// requestID returns the ID of r, and echoes it back on w.
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	// logRequests has usually been here first
+	if id := requestIDFromContext(r.Context()); "" != id {
+		return id
+	}
+	id := r.Header.Get(requestIDHeader)
+	if "" == id || 128 < len(id) {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
+
+// sourceIP is the address r came from
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if nil != err {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type auditKey struct{}
+
+// auditEntities adds to the entity IDs of the call r is auditing, if any.
+func auditEntities(r *http.Request, ids ...int64) {
+	if rec, ok := r.Context().Value(auditKey{}).(*AuditRecord); ok {
+		rec.EntityIDs = append(rec.EntityIDs, ids...)
+	}
+}
+
+// auditDetail sets the detail of the call r is auditing, if any.
+func auditDetail(r *http.Request, format string, args ...interface{}) {
+	if rec, ok := r.Context().Value(auditKey{}).(*AuditRecord); ok {
+		rec.Detail = fmt.Sprintf(format, args...)
+	}
+}
+
+// auditRecorder keeps the status a handler responds with.
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditRecorder) WriteHeader(status int) {
+	if 0 == w.status {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditRecorder) Write(b []byte) (int, error) {
+	if 0 == w.status {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps streamed exports streaming
+func (w *auditRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *auditRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// audited records every call to h in the audit log, as action.  Handlers add what only
+//	they know with auditEntities and auditDetail.
+func (a *Application) audited(action AuditAction, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &AuditRecord{
+			Actor:     requestActor(r),
+			SourceIP:  sourceIP(r),
+			RequestID: requestID(w, r),
+			Action:    action,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			EntityIDs: []int64{},
+		}
+		aw := &auditRecorder{ResponseWriter: w}
+
+		if recordedFirst[action] {
+			started := *rec
+			started.Outcome = AuditStarted
+			if err := a.recordAudit(r.Context(), &started); nil != err {
+				w.Header().Set("Retry-After", seconds(databaseRetryAfter))
+				respondWithProblem(w, r, http.StatusServiceUnavailable,
+					"The audit log is unavailable, so this can not be done now")
+				return
+			}
+		}
+
+		// A handler may panic to abort its response, that is recorded too
+		defer func() {
+			p := recover()
+			rec.Status = aw.status
+			switch {
+			case nil != p && 0 != aw.status:
+				rec.Outcome = AuditAborted
+			case nil != p:
+				rec.Status = http.StatusInternalServerError
+				rec.Outcome = AuditFailure
+			case 0 == aw.status:
+				rec.Status = http.StatusOK
+				rec.Outcome = AuditSuccess
+			case 400 <= aw.status:
+				rec.Outcome = AuditFailure
+			default:
+				rec.Outcome = AuditSuccess
+			}
+			a.recordAudit(r.Context(), rec)
+			if nil != p {
+				panic(p)
+			}
+		}()
+		h(aw, r.WithContext(context.WithValue(r.Context(), auditKey{}, rec)))
+	}
+}
+
+// recordAudit appends rec to the audit log.  Once the call it records has happened, a failure
+//	can only be logged, and counted, see metrics.go.
+func (a *Application) recordAudit(ctx context.Context, rec *AuditRecord) error {
+	rec.Date = time.Now().UTC().Truncate(time.Microsecond)
+	err := a.traced(ctx).AppendAuditRecord(rec)
+	if nil != err {
+		slog.Error("recordAudit:: could not record", "action", rec.Action, "outcome", rec.Outcome,
+			"path", rec.Path, "actor", rec.Actor, "request_id", rec.RequestID, "err", err)
+		auditAppendFailures.WithLabelValues(string(rec.Action)).Inc()
+	}
+	return err
+}
+
+// **************** Audit Handlers ****************
+
+// defaultAuditLimit and maxAuditLimit bound a page of GET /admin/audit
+const defaultAuditLimit = 100
+const maxAuditLimit = 1000
+
+// auditFilterFromRequest reads the query parameters: after, actor, action, entity, since, until
+//	(RFC 3339) and limit.
+func auditFilterFromRequest(r *http.Request) (AuditFilter, error) {
+	q := r.URL.Query()
+	f := AuditFilter{
+		Actor:  q.Get("actor"),
+		Action: AuditAction(q.Get("action")),
+	}
+	var err error
+	if s := q.Get("after"); "" != s {
+		if f.AfterSeq, err = strconv.ParseInt(s, 10, 64); nil != err {
+			return f, fmt.Errorf("Bad after value (%v)", s)
+		}
+	}
+	if s := q.Get("entity"); "" != s {
+		if f.EntityID, err = strconv.ParseInt(s, 10, 64); nil != err {
+			return f, fmt.Errorf("Bad entity value (%v)", s)
+		}
+	}
+	if s := q.Get("since"); "" != s {
+		if f.Since, err = time.Parse(time.RFC3339, s); nil != err {
+			return f, fmt.Errorf("Bad since value (%v), use RFC 3339", s)
+		}
+	}
+	if s := q.Get("until"); "" != s {
+		if f.Until, err = time.Parse(time.RFC3339, s); nil != err {
+			return f, fmt.Errorf("Bad until value (%v), use RFC 3339", s)
+		}
+	}
+	return f, nil
+}
+
+// A page of the audit log, continue with after set to the Seq of the last record.
+func (a *Application) getAuditLog(w http.ResponseWriter, r *http.Request) {
+	f, err := auditFilterFromRequest(r)
+	if nil != err {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f.Limit = defaultAuditLimit
+	if s := r.URL.Query().Get("limit"); "" != s {
+		if f.Limit, err = strconv.Atoi(s); nil != err || 0 >= f.Limit || maxAuditLimit < f.Limit {
+			respondWithError(w, http.StatusBadRequest,
+				fmt.Sprintf("Bad limit value (%v), use 1 to %d", s, maxAuditLimit))
+			return
+		}
+	}
+
+	recs := []*AuditRecord{}
+	err = a.traced(r.Context()).IterateAuditRecords(r.Context(), f, func(rec *AuditRecord) error {
+		recs = append(recs, rec)
+		return nil
+	})
+	if nil != err {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, recs)
+}
+
+// The audit log as JSON Lines, one record per line, with the same filters as getAuditLog but no limit.
+//	Exporting the whole log lets it be verified, or archived, elsewhere.
+func (a *Application) getAuditLogAsJSONLines(w http.ResponseWriter, r *http.Request) {
+	f, err := auditFilterFromRequest(r)
+	if nil != err {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var started bool
+	var cnt int
+	enc := json.NewEncoder(w)
+	err = a.traced(r.Context()).IterateAuditRecords(r.Context(), f, func(rec *AuditRecord) error {
+		if !started {
+			started = true
+			w.Header().Set("Content-Type", "application/jsonl")
+			w.WriteHeader(http.StatusOK)
+		}
+		cnt++
+		return enc.Encode(rec)
+	})
+	auditDetail(r, "%d records", cnt)
+	if nil != err {
+		if !started {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		slog.ErrorContext(r.Context(), "getAuditLogAsJSONLines:: export aborted", "records", cnt, "err", err)
+		panic(http.ErrAbortHandler)
+	}
+	if !started {
+		w.Header().Set("Content-Type", "application/jsonl")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (a *Application) verifyAuditLog(w http.ResponseWriter, r *http.Request) {
+	v, err := VerifyAuditChain(r.Context(), a.traced(r.Context()))
+	if nil != err {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, v)
+}
@@ -0,0 +1,176 @@
+// 2026.10.19 rjj: Authentication and scopes
+// Every route but /favicon.ico, the probes (health.go) and CORS preflights, needs an
+//	"Authorization: Bearer <token>" header.  The token is either one of our API keys
+//	(apikeys.go), or a JWT from the organisation's OIDC provider (oidc.go).  Over HTTPS a
+//	client certificate can do instead (tls.go).  Either way the caller ends up as an Identity
+//	with scopes, and each route declares the scope it needs in initializeRoutes.
+
+package addressbook
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The scopes a route can require
+const (
+	// ScopeRead reads entries, including bulk exports
+	ScopeRead = "contacts:read"
+	// ScopeWrite creates, changes and deletes entries
+	ScopeWrite = "contacts:write"
+	// ScopeImport loads entries in bulk
+	ScopeImport = "contacts:import"
+	// ScopeAdmin manages API keys, reads the audit log, and can use every address book
+	ScopeAdmin = "contacts:admin"
+)
+
+// apiKeyScopes are the scopes of every API key, admin keys also have ScopeAdmin
+var apiKeyScopes = []string{ScopeRead, ScopeWrite, ScopeImport}
+
+// Subject prefixes, the way the caller authenticated.  Each names callers of its own, so an API
+//	key can not be made with the name of someone's token subject, or a certificate's common name.
+const (
+	subjectKey  = "key:"
+	subjectOIDC = "oidc:"
+	subjectCert = "cert:"
+)
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	// Subject names the caller: key:<the API key's name>, oidc:<the token's subject>, or
+	//	cert:<the client certificate's common name>
+	Subject string
+	// KeyID is the APIKey they used, 0 for a token
+	KeyID  int64
+	Scopes []string
+	// Groups are the teams the caller is in, from their token, see books.go
+	Groups []string
+}
+
+// HasScope reports whether the caller was granted scope.
+func (id *Identity) HasScope(scope string) bool {
+	for _, s := range id.Scopes {
+		if scope == s {
+			return true
+		}
+	}
+	return false
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the caller the request was authenticated as, if any.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
+
+// **************** Middleware ****************
+
+// respondUnauthorized is a 401, with the challenge RFC 6750 asks for
+func respondUnauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="addressbook", error="invalid_token"`)
+	respondWithError(w, http.StatusUnauthorized, message)
+}
+
+// authenticate lets a request through only with a live API key or a valid token, and attaches
+//	the caller's Identity.
+func (a *Application) authenticate(next http.Handler) http.Handler {
+	failures := a.limiter(RateLimitAuth)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A CORS preflight is an OPTIONS, which no other route takes, and never has credentials.
+		//	Nor do the orchestrator's probes, see health.go.
+		if a.AuthDisabled || "/favicon.ico" == r.URL.Path || http.MethodOptions == r.Method || isProbe(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Guessing keys or tokens from one address is refused before they are looked at, see ratelimit.go
+		//	Only the refusals here are counted, the caller's handler has the response as it was.
+		pass := w
+		if nil != failures {
+			ip := "ip:" + sourceIP(r)
+			if wait := failures.waiting(ip, time.Now()); 0 < wait {
+				respondRateLimited(w, r, RateLimitAuth, wait)
+				return
+			}
+			refused := &auditRecorder{ResponseWriter: w}
+			defer func() {
+				if http.StatusUnauthorized == refused.status {
+					failures.take(ip, time.Now())
+				}
+			}()
+			w = refused
+		}
+
+		auth := r.Header.Get("Authorization")
+		if "" == auth {
+			// A client certificate is enough without a bearer, see tls.go
+			id, err := a.clientCertIdentity(r)
+			if nil != err {
+				respondWithError(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			if nil != id {
+				next.ServeHTTP(pass, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+				return
+			}
+		}
+		if !strings.HasPrefix(strings.ToLower(auth), "bearer ") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="addressbook"`)
+			respondWithError(w, http.StatusUnauthorized, "An API key or token is required, as Authorization: Bearer <token>")
+			return
+		}
+		token := strings.TrimSpace(auth[len("bearer "):])
+
+		var id *Identity
+		if strings.HasPrefix(token, apiKeyPrefix) || nil == a.oidc {
+			key, err := a.traced(r.Context()).GetAPIKeyByHash(hashAPIKey(token))
+			switch {
+			case sql.ErrNoRows == err:
+				respondUnauthorized(w, "Unknown API key")
+				return
+			case nil != err:
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			case nil != key.RevokedAt:
+				respondUnauthorized(w, "API key has been revoked")
+				return
+			case nil != key.ExpiresAt && time.Now().After(*key.ExpiresAt):
+				respondUnauthorized(w, "API key has expired")
+				return
+			}
+			id = &Identity{Subject: subjectKey + key.Name, KeyID: key.ID, Scopes: apiKeyScopes}
+			if key.Admin {
+				id.Scopes = append(append([]string{}, apiKeyScopes...), ScopeAdmin)
+			}
+		} else {
+			var err error
+			if id, err = a.oidc.verify(token); nil != err {
+				respondUnauthorized(w, fmt.Sprintf("Invalid token (%v)", err))
+				return
+			}
+		}
+
+		next.ServeHTTP(pass, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+// scoped refuses callers without scope.
+func (a *Application) scoped(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.AuthDisabled {
+			if id, ok := IdentityFromContext(r.Context()); !ok || !id.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate",
+					fmt.Sprintf(`Bearer realm="addressbook", error="insufficient_scope", scope="%s"`, scope))
+				respondWithProblem(w, r, http.StatusForbidden, fmt.Sprintf("This needs the %s scope", scope))
+				return
+			}
+		}
+		h(w, r)
+	}
+}
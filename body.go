@@ -0,0 +1,94 @@
+// 2026.10.19 rjj: Request bodies
+// Every route that reads a body caps it, with http.MaxBytesReader: a JSON one at MaxBodyBytes,
+//	an import at the much larger MaxBulkBodyBytes.  Going over is a 413, before the whole body
+//	has been read, and before any of it when the Content-Length says so.  A non-atomic import
+//	without one may have saved the records before the limit, its 413 says which.
+// A JSON body must be exactly one object, with no fields we do not know, so a typo in a field
+//	name is a 400 instead of being quietly dropped.
+
+package addressbook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Default body limits
+const (
+	defaultMaxBodyBytes     = 1 << 20
+	defaultMaxBulkBodyBytes = 256 << 20
+)
+
+// limitBody caps the body of each request to h at limit() bytes
+func limitBody(limit func() int64, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := limit()
+		if n < r.ContentLength {
+			respondBodyTooLarge(w, r, &http.MaxBytesError{Limit: n})
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		h(w, r)
+	}
+}
+
+// jsonBody caps the body at a.MaxBodyBytes, for routes that take a JSON object
+func (a *Application) jsonBody(h http.HandlerFunc) http.HandlerFunc {
+	return limitBody(func() int64 {
+		if 0 < a.MaxBodyBytes {
+			return a.MaxBodyBytes
+		}
+		return defaultMaxBodyBytes
+	}, h)
+}
+
+// bulkBody caps the body at a.MaxBulkBodyBytes, for imports
+func (a *Application) bulkBody(h http.HandlerFunc) http.HandlerFunc {
+	return limitBody(func() int64 {
+		if 0 < a.MaxBulkBodyBytes {
+			return a.MaxBulkBodyBytes
+		}
+		return defaultMaxBulkBodyBytes
+	}, h)
+}
+
+// bodyTooLarge reports whether err is, or wraps, the body going over its limit.
+func bodyTooLarge(err error) (*http.MaxBytesError, bool) {
+	var tooBig *http.MaxBytesError
+	return tooBig, errors.As(err, &tooBig)
+}
+
+// respondBodyTooLarge is a 413 about err, from bodyTooLarge
+func respondBodyTooLarge(w http.ResponseWriter, r *http.Request, err *http.MaxBytesError) {
+	respondWithProblem(w, r, http.StatusRequestEntityTooLarge,
+		fmt.Sprintf("The request body is larger than the %d bytes allowed", err.Limit))
+}
+
+// decodeJSONBody reads the body of r, one JSON object, into v.  If it can not, it has responded
+//	with a 413 or 400 and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	defer r.Body.Close()
+
+	jd := json.NewDecoder(r.Body)
+	jd.DisallowUnknownFields()
+	err := jd.Decode(v)
+	if nil == err {
+		// Nothing may follow the object, but white space
+		if _, err = jd.Token(); io.EOF == err {
+			return true
+		}
+		if nil == err {
+			err = errors.New("more than one JSON value")
+		}
+	}
+
+	if tooBig, ok := bodyTooLarge(err); ok {
+		respondBodyTooLarge(w, r, tooBig)
+		return false
+	}
+	respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request payload (%v)", err))
+	return false
+}
@@ -0,0 +1,190 @@
+// 2026.10.19 rjj: Address books
+// Entries belong to a named address book, owned by a user or a team.  The original routes are
+//	the default book, which everyone shares, and the same routes under /books/{book} are the
+//	others.  Requests are checked against the caller's role on the book by allow (policy.go),
+//	then use the database scoped to that book (see WithBook), so no query can reach another
+//	book's entries.
+
+package addressbook
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// AddressBook is a named set of entries.
+type AddressBook struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// Owner is "user:<subject>", e.g. user:oidc:alice, or "team:<group>", "" for a book everyone shares
+	Owner       string    `json:"owner"`
+	CreatedDate time.Time `json:"createdDate"`
+	// Role is the caller's, when the book is sent to them
+	Role BookRole `json:"role,omitempty"`
+}
+
+// BookDatabase stores AddressBooks.
+type BookDatabase interface {
+	// AddAddressBook saves a new book, assigning it an ID.  ErrAddressBookExists if the name is taken.
+	AddAddressBook(book *AddressBook) (int64, error)
+
+	// GetAddressBook finds a book by name, sql.ErrNoRows if there is none.
+	GetAddressBook(name string) (*AddressBook, error)
+
+	// ListAddressBooks returns every book, by name.
+	ListAddressBooks() ([]*AddressBook, error)
+
+	// WithBook returns the same database, with every entry query confined to the book with id.
+	WithBook(id int64) AddressBookDatabase
+
+	// Who else may use each book
+	BookGrantDatabase
+}
+
+// ErrAddressBookExists is adding a book with a name that is already taken
+var ErrAddressBookExists = errors.New("An address book with that name already exists")
+
+// The default book holds the entries from before there were books, and those on the original routes
+const (
+	defaultBookID   = 1
+	defaultBookName = "default"
+)
+
+// bookNamePattern is what a book name can be, it is part of the URL
+const bookNamePattern = `[a-z0-9][a-z0-9-]*`
+
+var bookNameRE = regexp.MustCompile(`^` + bookNamePattern + `$`)
+
+// bookNameMaxLength is the size of the name column
+const bookNameMaxLength = 64
+
+// Owner prefixes
+const (
+	bookOwnerUser = "user:"
+	bookOwnerTeam = "team:"
+)
+
+type bookKey struct{}
+
+// requestBook is the book r works on, nil if it is not a book route.
+func requestBook(r *http.Request) *AddressBook {
+	book, _ := r.Context().Value(bookKey{}).(*AddressBook)
+	return book
+}
+
+// requestBookID is the ID of the book r works on.
+func requestBookID(r *http.Request) int64 {
+	if book := requestBook(r); nil != book {
+		return book.ID
+	}
+	return defaultBookID
+}
+
+// owns reports whether owner names the caller, or one of their teams
+func (id *Identity) owns(owner string) bool {
+	if bookOwnerUser+id.Subject == owner {
+		return true
+	}
+	for _, g := range id.Groups {
+		if bookOwnerTeam+g == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// **************** Address Book Handlers ****************
+
+// addressBookRequest is the body of POST /books, e.g. {"name": "sales", "owner": "team:sales"}
+//	Owner defaults to the caller, and must be them or one of their teams unless they are an admin.
+//	With authentication disabled it defaults to "", a book everyone shares.
+type addressBookRequest struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+}
+
+func (a *Application) createAddressBook(w http.ResponseWriter, r *http.Request) {
+	var req addressBookRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if !bookNameRE.MatchString(req.Name) || bookNameMaxLength < len(req.Name) {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("Bad address book name (%s), use lower case letters, digits and -", req.Name))
+		return
+	}
+
+	id, ok := IdentityFromContext(r.Context())
+	if "" == req.Owner && ok {
+		req.Owner = bookOwnerUser + id.Subject
+	}
+	if "" != req.Owner {
+		if !validGrantee(req.Owner) {
+			respondWithError(w, http.StatusBadRequest,
+				fmt.Sprintf("Bad owner (%s), %s", req.Owner, granteeForms))
+			return
+		}
+		if ok && !id.HasScope(ScopeAdmin) && !id.owns(req.Owner) {
+			respondWithProblem(w, r, http.StatusForbidden,
+				fmt.Sprintf("Only an admin can create a book for %s", req.Owner))
+			return
+		}
+	}
+
+	book := &AddressBook{Name: req.Name, Owner: req.Owner}
+	bookID, err := a.traced(r.Context()).AddAddressBook(book)
+	if nil != err {
+		if ErrAddressBookExists == err {
+			respondWithError(w, http.StatusConflict, fmt.Sprintf("AddressBook (%s) already exists.", req.Name))
+		} else {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	auditDetail(r, "book %d (%s) for %q", bookID, book.Name, book.Owner)
+
+	if book, err = a.traced(r.Context()).GetAddressBook(req.Name); nil != err {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Location", "/books/"+book.Name)
+	respondWithJSON(w, http.StatusCreated, book)
+}
+
+// The books the caller has a role on, with that role
+func (a *Application) getAddressBooks(w http.ResponseWriter, r *http.Request) {
+	books, err := a.traced(r.Context()).ListAddressBooks()
+	if nil != err {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	grants := map[int64]BookRole{}
+	if id, ok := IdentityFromContext(r.Context()); ok {
+		if grants, err = a.traced(r.Context()).BookRoles(id.grantees()); nil != err {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	mine := []*AddressBook{}
+	for _, book := range books {
+		if book.Role, err = a.bookRole(r, book, grants); nil != err {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if "" != book.Role {
+			mine = append(mine, book)
+		}
+	}
+	respondWithJSON(w, http.StatusOK, mine)
+}
+
+func (a *Application) getAddressBook(w http.ResponseWriter, r *http.Request) {
+	book := *requestBook(r)
+	book.Role = requestBookRole(r)
+	respondWithJSON(w, http.StatusOK, &book)
+}
@@ -3,87 +3,299 @@
 package addressbook
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/csv"
 	"encoding/json"
 	"database/sql"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 
 type Application struct {
 	Router	*mux.Router
 	DB		AddressBookDatabase
+	// DBPool sizes the pool of connections to the database, see db_mysql_resilience.go
+	DBPool	PoolConfig
+
+	// ImportDir holds uploads until their import job is over, defaults to a temp directory.
+	//	Being local, import jobs need a single instance, see imports.go
+	ImportDir		string
+	// ImportWorkers is how many import jobs run at once, defaults to 2
+	ImportWorkers	int
+	imports			*importRunner
+	// purgerStop stops the trash purger, which closes purgerDone, see trash.go
+	purgerStop		chan struct{}
+	purgerDone		chan struct{}
+	// TrashRetention is how long deleted entries can be restored, defaults to 30 days.
+	//	Negative keeps them forever.
+	TrashRetention	time.Duration
+	// AuthDisabled lets every request through without an API key, for local development only
+	AuthDisabled	bool
+	// OIDC, if set, also accepts tokens from an identity provider
+	OIDC			*OIDCConfig
+	oidc			*oidcVerifier
+	// TLS, if set, has Run serve HTTPS, and can accept client certificates
+	TLS				*TLSConfig
+	tlsFiles		*tlsFiles
+	// CORS, if set, lets browser clients on other origins call the API
+	CORS			*CORSConfig
+	preflightRoute	*mux.Route
+	// Tracing, if set, sends a span for each request and database call, see tracing.go
+	Tracing			*TracingConfig
+	tracerProvider	*sdktrace.TracerProvider
+	// ShutdownDelay is how long /readyz fails before the server stops taking requests,
+	//	defaults to 5s, negative is none.  ShutdownTimeout is how long it then waits for those
+	//	still running, defaults to 30s.  See health.go.
+	ShutdownDelay	time.Duration
+	ShutdownTimeout	time.Duration
+	// starting is set while waiting for the database, stopping once shutting down
+	starting		atomic.Bool
+	stopping		atomic.Bool
+	// Logger is where everything is logged, defaults to JSON on stderr from info up
+	Logger			*slog.Logger
+	// RateLimits are each client's budget per route group, see ratelimit.go.  A group left
+	//	out has its default, one with a Rate of 0 is unlimited.
+	RateLimits		map[RateLimitGroup]RateLimit
+	limiters		map[RateLimitGroup]*rateLimiter
+	// MaxBodyBytes caps a JSON request body, defaults to 1 MiB, see body.go
+	MaxBodyBytes		int64
+	// MaxBulkBodyBytes caps an import's body, defaults to 256 MiB
+	MaxBulkBodyBytes	int64
 }
 
 func (a *Application) Initialize(user, passwd, dbname string) {
 	var err error
 
-	// [START sql]
-	sqlConfig := SQLConfig{
-		Username: user,
-		Password: passwd,
-		Instance: dbname,
-		Port: 3306,
+	// Everything logs through slog, see logging.go
+	if nil == a.Logger {
+		a.Logger = NewLogger(os.Stderr, slog.LevelInfo)
 	}
+	slog.SetDefault(a.Logger)
 
-	// Uncomment if you need to verify env vars are as you expect
-	//log.Printf( "sqlConfig: %+v\n", sqlConfig )
-
-	a.DB, err = configureSQL( sqlConfig )
-	// [END sql]
-	if nil != err {
-		log.Fatal( err )
+	if nil != a.Tracing {
+		if a.tracerProvider, err = newTracerProvider(*a.Tracing); nil != err {
+			log.Fatal( err )
+		}
 	}
 
+	if a.AuthDisabled {
+		slog.Warn("API key authentication is disabled, anyone can call the API")
+	}
+	if nil != a.OIDC {
+		if a.oidc, err = newOIDCVerifier(*a.OIDC); nil != err {
+			log.Fatal( err )
+		}
+	}
+	if nil != a.TLS {
+		if a.tlsFiles, err = newTLSFiles(*a.TLS); nil != err {
+			log.Fatal( err )
+		}
+	}
+	if nil != a.CORS {
+		if err = a.CORS.validate(); nil != err {
+			log.Fatal( err )
+		}
+	}
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
+
+	// The database may not be up yet, the server waits for it, see health.go
+	a.openDatabase(func() (AddressBookDatabase, error) {
+		return OpenDatabase(user, passwd, dbname, a.DBPool)
+	})
 }
 
 func (a *Application) Run(hostPort string) {
-	log.Fatal(http.ListenAndServe( hostPort , a.Router))
+	server := &http.Server{
+		Addr:    hostPort,
+		Handler: a.Router,
+	}
+	// SIGTERM stops the server gracefully, see health.go
+	done := make(chan struct{})
+	go a.shutdownOnSignal(server, done)
+
+	var err error
+	if nil == a.tlsFiles {
+		err = server.ListenAndServe()
+	} else {
+		// Each connection gets the certificate as it is then, see tls.go
+		server.TLSConfig = &tls.Config{GetConfigForClient: a.tlsFiles.configForClient}
+		err = server.ListenAndServeTLS("", "")
+	}
+	if http.ErrServerClosed != err {
+		log.Fatal( err )
+	}
+	<-done
 }
 
 // **************** ROUTES ****************
 func (a *Application) initializeRoutes() {
 	a.Router.Handle("/favicon.ico", http.NotFoundHandler()).Methods("GET")
-	a.Router.HandleFunc( "/addressbookentries", a.getAddressBookEntries).Methods("GET")
-	a.Router.HandleFunc( "/addressbookentry", a.addAddressBookEntry).Methods("POST")
-	a.Router.HandleFunc( "/addressbookentry/{id:[0-9]+}", a.getAddressBookEntry).Methods("GET")
-	a.Router.HandleFunc( "/addressbookentry/{id:[0-9]+}", a.updateAddressBookEntry).Methods("PUT")
-	a.Router.HandleFunc( "/addressbookentry/{id:[0-9]+}", a.deleteAddressBookEntry).Methods("DELETE")
 
-	a.Router.HandleFunc( "/csvexport", a.getAddressBookEntriesAsCSV).Methods("GET")
-	a.Router.HandleFunc( "/csvimport", a.addAddressBookEntriesFromCSV).Methods("POST")
+	// Probes, for the orchestrator, see health.go
+	a.Router.HandleFunc( "/healthz", a.healthz).Methods("GET")
+	a.Router.HandleFunc( "/readyz", a.readyz).Methods("GET")
+
+	// The original routes are the default address book, see books.go
+	a.bookRoutes(a.Router, "/addressbookentries", "/addressbookentry")
+
+	a.Router.HandleFunc( "/books", a.limited(RateLimitRead, a.scoped(ScopeRead, a.getAddressBooks))).Methods("GET")
+	a.Router.HandleFunc( "/books", a.limited(RateLimitWrite, a.scoped(ScopeWrite, a.audited(AuditBookCreate, a.jsonBody(a.createAddressBook))))).Methods("POST")
+	a.Router.HandleFunc( "/books/{book:" + bookNamePattern + "}", a.limited(RateLimitRead, a.scoped(ScopeRead, a.allow(RoleViewer, a.getAddressBook)))).Methods("GET")
+	books := a.Router.PathPrefix("/books/{book:" + bookNamePattern + "}").Subrouter()
+	books.HandleFunc( "/grants", a.limited(RateLimitRead, a.scoped(ScopeRead, a.allow(RoleOwner, a.getBookGrants)))).Methods("GET")
+	books.HandleFunc( "/grants/{grantee}", a.limited(RateLimitWrite, a.scoped(ScopeWrite, a.audited(AuditGrant, a.allow(RoleOwner, a.jsonBody(a.setBookGrant)))))).Methods("PUT")
+	books.HandleFunc( "/grants/{grantee}", a.limited(RateLimitWrite, a.scoped(ScopeWrite, a.audited(AuditGrantRevoke, a.allow(RoleOwner, a.deleteBookGrant))))).Methods("DELETE")
+	a.bookRoutes(books, "/entries", "/entries")
+
+	a.Router.HandleFunc( "/admin/audit", a.limited(RateLimitRead, a.scoped(ScopeAdmin, a.getAuditLog))).Methods("GET")
+	a.Router.HandleFunc( "/admin/audit/export", a.limited(RateLimitBulk, a.scoped(ScopeAdmin, a.audited(AuditLogExport, a.getAuditLogAsJSONLines)))).Methods("GET")
+	a.Router.HandleFunc( "/admin/audit/verify", a.limited(RateLimitBulk, a.scoped(ScopeAdmin, a.verifyAuditLog))).Methods("GET")
+
+	a.Router.HandleFunc( "/admin/apikeys", a.limited(RateLimitWrite, a.scoped(ScopeAdmin, a.audited(AuditAPIKeyCreate, a.jsonBody(a.createAPIKey))))).Methods("POST")
+	a.Router.HandleFunc( "/admin/apikeys", a.limited(RateLimitRead, a.scoped(ScopeAdmin, a.getAPIKeys))).Methods("GET")
+	a.Router.HandleFunc( "/admin/apikeys/{id:[0-9]+}", a.limited(RateLimitWrite, a.scoped(ScopeAdmin, a.audited(AuditAPIKeyRevoke, a.revokeAPIKey)))).Methods("DELETE")
+
+	// Prometheus scrapes with an admin key, see metrics.go
+	a.Router.HandleFunc( "/metrics", a.limited(RateLimitRead, a.scoped(ScopeAdmin, promhttp.Handler().ServeHTTP))).Methods("GET")
+
+	// A span for each request, outside the rest so they are part of it, see tracing.go
+	if nil != a.tracerProvider {
+		a.Router.Use(a.traceRequests())
+	}
+	// Every request has an ID, and is logged, even those no route matches, see logging.go
+	a.Router.Use(a.logRequests)
+	// A panicking handler is a 500, not a dead server, see recover.go
+	a.Router.Use(a.recoverPanics)
+	a.Router.NotFoundHandler = a.logRequests(http.NotFoundHandler())
+	a.Router.MethodNotAllowedHandler = a.logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+
+	// Browsers on other origins, see cors.go
+	if nil != a.CORS {
+		a.preflightRoute = a.Router.Methods("OPTIONS").HandlerFunc(a.preflight)
+		a.Router.Use(a.cors)
+	}
+
+	// Nothing but the probes until the database is there, see health.go
+	a.Router.Use(a.whenStarted)
+
+	// Every route needs an API key or token, with the scope it is registered with above, see auth.go
+	a.Router.Use(a.authenticate)
+}
+
+// bookRoutes adds the routes on a book's entries to r: entries is the path of the list, entry
+//	the path of one by ID.  Each needs a scope, and a role on the book, see policy.go.
+func (a *Application) bookRoutes(r *mux.Router, entries, entry string) {
+	viewer := func(h http.HandlerFunc) http.HandlerFunc { return a.allow(RoleViewer, h) }
+	editor := func(h http.HandlerFunc) http.HandlerFunc { return a.allow(RoleEditor, h) }
+	read := func(h http.HandlerFunc) http.HandlerFunc { return a.limited(RateLimitRead, h) }
+	write := func(h http.HandlerFunc) http.HandlerFunc { return a.limited(RateLimitWrite, h) }
+	bulk := func(h http.HandlerFunc) http.HandlerFunc { return a.limited(RateLimitBulk, h) }
+
+	// Every contact in the book, as CSV, vCard or JSON Lines as readily as JSON, so audited as an export
+	r.HandleFunc( entries, read(a.scoped(ScopeRead, a.audited(AuditExport, viewer(a.getAddressBookEntries))))).Methods("GET")
+	r.HandleFunc( entry, write(a.scoped(ScopeWrite, a.audited(AuditCreate, editor(a.jsonBody(a.addAddressBookEntry)))))).Methods("POST")
+	r.HandleFunc( entries + "/merge", write(a.scoped(ScopeWrite, a.audited(AuditMerge, editor(a.jsonBody(a.mergeAddressBookEntries)))))).Methods("POST")
+	// One contact, in any format, the same as its .vcf download below
+	r.HandleFunc( entry + "/{id:[0-9]+}", read(a.scoped(ScopeRead, a.audited(AuditExport, viewer(a.getAddressBookEntry))))).Methods("GET")
+	r.HandleFunc( entry + "/{id:[0-9]+}", write(a.scoped(ScopeWrite, a.audited(AuditUpdate, editor(a.jsonBody(a.updateAddressBookEntry)))))).Methods("PUT")
+	r.HandleFunc( entry + "/{id:[0-9]+}", write(a.scoped(ScopeWrite, a.audited(AuditDelete, editor(a.deleteAddressBookEntry))))).Methods("DELETE")
+	r.HandleFunc( entry + "/{id:[0-9]+}/restore", write(a.scoped(ScopeWrite, a.audited(AuditRestore, editor(a.restoreAddressBookEntry))))).Methods("POST")
+	r.HandleFunc( entry + "/{id:[0-9]+}/history", read(a.scoped(ScopeRead, viewer(a.getAddressBookEntryHistory)))).Methods("GET")
+	r.HandleFunc( entry + "/{id:[0-9]+}/revert/{rev:[0-9]+}", write(a.scoped(ScopeWrite, a.audited(AuditRevert, editor(a.revertAddressBookEntry))))).Methods("POST")
+	r.HandleFunc( "/trash", read(a.scoped(ScopeRead, a.audited(AuditExport, viewer(a.getTrash))))).Methods("GET")
+
+	// Bulk exports take out every contact, so they are audited as much as the writes
+	r.HandleFunc( "/csvexport", bulk(a.scoped(ScopeRead, a.audited(AuditExport, viewer(a.getAddressBookEntriesAsCSV))))).Methods("GET")
+	r.HandleFunc( "/csvimport", bulk(a.scoped(ScopeImport, a.audited(AuditImport, editor(a.bulkBody(a.addAddressBookEntriesFromCSV)))))).Methods("POST")
+
+	r.HandleFunc( "/ndjsonexport", bulk(a.scoped(ScopeRead, a.audited(AuditExport, viewer(a.getAddressBookEntriesAsNDJSON))))).Methods("GET")
+	r.HandleFunc( "/ndjsonimport", bulk(a.scoped(ScopeImport, a.audited(AuditImport, editor(a.bulkBody(a.addAddressBookEntriesFromNDJSON)))))).Methods("POST")
+
+	r.HandleFunc( "/vcardexport", bulk(a.scoped(ScopeRead, a.audited(AuditExport, viewer(a.getAddressBookEntriesAsVCard))))).Methods("GET")
+	r.HandleFunc( entry + "/{id:[0-9]+}.vcf", read(a.scoped(ScopeRead, a.audited(AuditExport, viewer(a.getAddressBookEntryAsVCard))))).Methods("GET")
+	r.HandleFunc( "/vcardimport", bulk(a.scoped(ScopeImport, a.audited(AuditImport, editor(a.bulkBody(a.addAddressBookEntriesFromVCard)))))).Methods("POST")
+
+	r.HandleFunc( "/duplicates", bulk(a.scoped(ScopeRead, a.audited(AuditExport, viewer(a.getDuplicates))))).Methods("GET")
+
+	r.HandleFunc( "/imports", bulk(a.scoped(ScopeImport, a.audited(AuditImport, editor(a.bulkBody(a.createImportJob)))))).Methods("POST")
+	r.HandleFunc( "/imports/{id:[0-9]+}", read(a.scoped(ScopeImport, editor(a.getImportJob)))).Methods("GET")
+	r.HandleFunc( "/imports/{id:[0-9]+}", write(a.scoped(ScopeImport, a.audited(AuditImportCancel, editor(a.cancelImportJob))))).Methods("DELETE")
 }
 
 
 // **************** HANDLERS ****************
-// We package up error responses as JSON also
+// We package up error responses as JSON also, with the request's ID if it has one, see logging.go
 func respondWithError(w http.ResponseWriter, statusCode int, responseMessage string) {
-	respondWithJSON(w, statusCode, map[string]string{"error": responseMessage})
+	body := map[string]string{"error": responseMessage}
+	if id := w.Header().Get(requestIDHeader); "" != id {
+		body["requestId"] = id
+	}
+	respondWithJSON(w, statusCode, body)
 }
 
 func respondWithJSON(w http.ResponseWriter, statusCode int, payload interface{}) {
 	response, err := json.Marshal(payload)
 
-	// It is an interesting problem if the json.Marshal fails
+	// It is an interesting problem if the json.Marshal fails, it is our bug not the client's
 	if nil != err {
-		// Try to send back an error
-		log.Fatal("FAILED: json.Marshal(%v)", err)
+		respondWithEncodingFailure(w, err)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	w.Write(response)
 }
 
+// problem is an RFC 7807 problem details response
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail"`
+	Instance string `json:"instance,omitempty"`
+	// RequestID is an extension member, see logging.go
+	RequestID string `json:"requestId,omitempty"`
+	// Messages is an extension member, an import's report when it stopped part way
+	Messages []string `json:"messages,omitempty"`
+}
+
+// respondWithProblem responds with an RFC 7807 application/problem+json, about the request r.
+//	Refusals, a 403 for a missing scope or role, are problems so a client can tell them apart.
+func respondWithProblem(w http.ResponseWriter, r *http.Request, statusCode int, detail string) {
+	writeProblem(w, &problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(statusCode),
+		Status:   statusCode,
+		Detail:   detail,
+		Instance: r.URL.Path,
+		RequestID: requestIDFromContext(r.Context()),
+	})
+}
+
+// writeProblem sends p, a problem of only strings and an int can always be marshalled
+func writeProblem(w http.ResponseWriter, p *problem) {
+	response, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	w.Write(response)
+}
+
 
 /*
 	CRUD:
@@ -93,35 +305,23 @@ func respondWithJSON(w http.ResponseWriter, statusCode int, payload interface{})
 	D: Delete
  */
 // Not quite the R in cRud, since this may return multiple entries.
+// The format follows the Accept header, see serializers.go
 func (a *Application) getAddressBookEntries(w http.ResponseWriter, r *http.Request) {
-	// []*AddressBookEntry
-	abes, err := a.DB.ListAddressBookEntries()
-	//log.Printf("getAddressBookEntries:: abes(%v) err(%v)", abes, err)
-	if nil != err {
-		// NO data is OK
-		if sql.ErrNoRows != err {
-			// Something bad happened
-			respondWithError(w, http.StatusInternalServerError, err.Error())
-			return
-		}
+	s := negotiateSerializer(w, r)
+	if nil == s {
+		return
 	}
-	respondWithJSON(w, http.StatusOK, abes)
+	a.streamAddressBookEntries(w, r, s, false)
 }
 
 // The C in Crud
 func (a *Application) addAddressBookEntry(w http.ResponseWriter, r *http.Request) {
 	var abe AddressBookEntry
-
-	jd := json.NewDecoder(r.Body)
-	if err := jd.Decode(&abe); nil != err {
-		respondWithError(w, http.StatusBadRequest,
-			fmt.Sprintf("Invalid request payload (%v)", r.Body))
+	if !decodeJSONBody(w, r, &abe) {
 		return
 	}
-	defer r.Body.Close()
 
-	id, err := a.DB.AddAddressBookEntry(&abe)
-	//log.Printf("addAddressBookEntry:: id(%v), err(%v)\n", id, err)
+	id, err := a.db(r).AddAddressBookEntry(&abe)
 
 	if nil != err {
 		respondWithError(w, http.StatusInternalServerError,
@@ -130,23 +330,37 @@ func (a *Application) addAddressBookEntry(w http.ResponseWriter, r *http.Request
 	}
 	// Add new ID to data
 	abe.ID = id
+	auditEntities(r, id)
 	respondWithJSON(w, http.StatusCreated, abe)
 }
 
 // The R in cRud
+// The format follows the Accept header, see serializers.go
 func (a *Application) getAddressBookEntry(w http.ResponseWriter, r *http.Request) {
+	s := negotiateSerializer(w, r)
+	if nil == s {
+		return
+	}
+	a.respondWithAddressBookEntry(w, r, s, false)
+}
+
+// respondWithAddressBookEntry writes the entry the request is for using s, as a file to save if download
+func (a *Application) respondWithAddressBookEntry(w http.ResponseWriter, r *http.Request, s *serializer, download bool) {
 	vars := mux.Vars(r)
 	id, err := strconv.ParseInt(vars["id"],10,64)
-	//log.Printf("getAddressBookEntry:: vars(%+v), err(%v)\n", vars, err)
 	if nil != err {
 		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Bad AddressBookEntry ID (%v)", vars["id"]))
 		return
 	}
 
-	abe, err := a.DB.GetAddressBookEntry(id)
+	abe, err := a.db(r).GetAddressBookEntry(id)
 	if nil != err {
 		// Differentiate between NO data found vs. another issue
 		if sql.ErrNoRows == err {
+			// It may live on under another ID, after a merge
+			if a.redirectMergedAddressBookEntry(w, r, id) {
+				return
+			}
 			// We executed correctly, but the user asked for what is not there
 			respondWithError(w, http.StatusNotFound, fmt.Sprintf("AddressBookEntry with ID (%d) not found.", id))
 		} else {
@@ -155,30 +369,27 @@ func (a *Application) getAddressBookEntry(w http.ResponseWriter, r *http.Request
 		}
 		return
 	}
-	respondWithJSON(w, http.StatusOK, abe)
+	auditEntities(r, id)
+	respondWithEntry(w, r, http.StatusOK, s, abe, download)
 }
 
 // The U in crUd
 func (a *Application) updateAddressBookEntry(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.ParseInt(vars["id"],10,64)
-	//log.Printf("updateAddressBookEntry:: vars(%+v), err(%v)\n", vars, err)
 	if nil != err {
 		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Bad AddressBookEntry ID (%v)", vars["id"]))
 		return
 	}
 
 	var abe AddressBookEntry
-	jd := json.NewDecoder(r.Body)
-	if err := jd.Decode(&abe); nil != err {
-		respondWithError(w, http.StatusBadRequest,
-			fmt.Sprintf("Invalid request payload (%v)", r.Body))
+	if !decodeJSONBody(w, r, &abe) {
 		return
 	}
-	defer r.Body.Close()
 
 	abe.ID = id
-	err = a.DB.UpdateAddressBookEntry(&abe)
+	auditEntities(r, id)
+	err = a.db(r).UpdateAddressBookEntry(&abe)
 
 	if nil != err {
 		respondWithError(w, http.StatusInternalServerError,
@@ -193,13 +404,13 @@ func (a *Application) updateAddressBookEntry(w http.ResponseWriter, r *http.Requ
 func (a *Application) deleteAddressBookEntry(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.ParseInt(vars["id"],10,64)
-	//log.Printf("updateAddressBookEntry:: vars(%+v), err(%v)\n", vars, err)
 	if nil != err {
 		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Bad AddressBookEntry ID (%v)", vars["id"]))
 		return
 	}
 
-	err = a.DB.DeleteAddressBookEntry(id)
+	auditEntities(r, id)
+	err = a.db(r).DeleteAddressBookEntry(id)
 
 	if nil != err {
 		respondWithError(w, http.StatusInternalServerError,
@@ -211,142 +422,484 @@ func (a *Application) deleteAddressBookEntry(w http.ResponseWriter, r *http.Requ
 
 // **************** CSV Handlers ****************
 
-// Write the records out.
+// csvHeaders are the column names of the CSV export, in the order abeToCSVRecord writes them.
+var csvHeaders = []string{
+	"ID", "Firstname", "Lastname", "Email", "Phone",
+}
+
+func abeToCSVRecord(abe *AddressBookEntry) []string {
+	return []string{
+		fmt.Sprintf("%d", abe.ID),
+		abe.Firstname,
+		abe.Lastname,
+		abe.Email,
+		abe.Phone,
+	}
+}
+
+// csvEntryEncoder writes an export as CSV, header first.
+type csvEntryEncoder struct {
+	w *csv.Writer
+}
+
+func (e *csvEntryEncoder) Begin() error {
+	return e.w.Write(csvHeaders)
+}
+
+func (e *csvEntryEncoder) Encode(abe *AddressBookEntry) error {
+	return e.w.Write(abeToCSVRecord(abe))
+}
+
+// CSV has no trailer
+func (e *csvEntryEncoder) End() error {
+	return nil
+}
+
+func (e *csvEntryEncoder) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
 // We include a header, so there will always be atleast one record returned
-func respondWithCSV(w http.ResponseWriter, statusCode int, abes []*AddressBookEntry) {
+func (a *Application) getAddressBookEntriesAsCSV(w http.ResponseWriter, r *http.Request) {
+	a.streamAddressBookEntries(w, r, serializers.get("text/csv"), true)
+}
+
+// csvEntryDecoder reads an import as CSV, skipping the header record if there is one.
+type csvEntryDecoder struct {
+	r   *csv.Reader
+	rcd int
+	// IDs have no meaning for the insert mode, so are not even checked
+	ignoreID bool
+}
+
+func (d *csvEntryDecoder) Decode() (*AddressBookEntry, error) {
+	for {
+		d.rcd++
+		record, err := d.r.Read()
+		if io.EOF == err {
+			return nil, io.EOF
+		}
+		if _, ok := err.(*csv.ParseError); ok {
+			return nil, &badRecordError{d.rcd, fmt.Errorf("CSV read error: %v", err)}
+		}
+		if nil != err {
+			return nil, err
+		}
+		// 1 == rcd, check for header record
+		if 1 == d.rcd && isABFCSVHeader(record) {
+			// skip this one
+			continue
+		}
 
-	b := &bytes.Buffer{}
-	csvWriter := csv.NewWriter( b )
+		if d.ignoreID && 0 < len(record) {
+			record[0] = ""
+		}
+		abe, err := abeFromCSVRecord(record)
+		if nil != err {
+			return nil, &badRecordError{d.rcd, err}
+		}
+		return abe, nil
+	}
+}
 
-	var abeStrings []string
+func (d *csvEntryDecoder) Record() int {
+	return d.rcd
+}
 
-	// TODO: Extract list of names from addressbook package
-	abeHeaders := []string{
-		"ID", "Firstname", "Lastname", "Email", "Phone",
+// The request body should be our new addresses, see importAddressBookEntries for the options.
+// Questions to consider:
+// - Will we always received a header record ?
+// - Do we assume the ID field will be present ?		Assume YES
+func (a *Application) addAddressBookEntriesFromCSV(w http.ResponseWriter, r *http.Request) {
+	mode, err := importModeFromRequest(r)
+	if nil != err {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	err := csvWriter.Write(abeHeaders)
+	atomic, err := importAtomicFromRequest(r, mode)
 	if nil != err {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	for _, abe := range abes {
-		abeStrings = []string{
-			fmt.Sprintf("%d", abe.ID),
-			abe.Firstname,
-			abe.Lastname,
-			abe.Email,
-			abe.Phone,
-		}
-		//log.Printf("respondWithCSV:: abe(%v)", abe)
-		//log.Printf("respondWithCSV:: abeStrings(%v)", abeStrings)
-		err = csvWriter.Write(abeStrings)
 
-		// It is an interesting problem if the CSV write fails
-		if nil != err {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
-			return
+	a.importAddressBookEntries(w, r, newEntryDecoder("text/csv", r.Body, mode), mode, atomic)
+}
+
+// abeFromCSVRecord maps the columns written by abeToCSVRecord back onto an AddressBookEntry.
+//	An empty ID is allowed, and means a new entry.
+func abeFromCSVRecord(record []string) (*AddressBookEntry, error) {
+	if 5 > len(record) {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(record))
+	}
+
+	var id int64
+	if "" != record[0] {
+		var err error
+		if id, err = strconv.ParseInt(record[0], 10, 64); nil != err {
+			return nil, fmt.Errorf("bad ID (%v)", record[0])
 		}
 	}
-	csvWriter.Flush()
+	return &AddressBookEntry{
+		ID:        id,
+		Firstname: record[1],
+		Lastname:  record[2],
+		Email:     record[3],
+		Phone:     record[4],
+	}, nil
+}
 
-	w.Header().Set("Content-Type", "text/csv")
-	t := time.Now()
-	w.Header().Set("Content-Disposition",
-		fmt.Sprintf("attachment;filename=AddressBoookExport-%04d%s%02dT%02d%02d%02d.csv",
-			t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second()) )
-	w.WriteHeader(statusCode)
-	w.Write(b.Bytes())
+// TODO: verify all expected header fields are present in the expected order
+func isABFCSVHeader(rcd []string) (bool) {
+	return (5 <= len(rcd)) && ("ID" == rcd[0])
 }
 
-func (a *Application) getAddressBookEntriesAsCSV(w http.ResponseWriter, r *http.Request) {
-	// []*AddressBookEntry
-	abes, err := a.DB.ListAddressBookEntries()
-	//log.Printf("getAddressBookEntries:: abes(%v) err(%v)", abes, err)
+
+// **************** Export Streaming ****************
+
+// entryEncoder writes AddressBookEntries to an export, one at a time.
+type entryEncoder interface {
+	// Begin writes anything that comes before the first entry, e.g. a header record.
+	Begin() error
+	Encode(abe *AddressBookEntry) error
+	// End writes anything that comes after the last entry, e.g. closing a JSON array.
+	End() error
+	// Flush pushes any buffered output on to the underlying writer.
+	Flush() error
+}
+
+// exportFlushInterval is the number of entries buffered before they are pushed on to the client.
+const exportFlushInterval = 1000
+
+// Write the entries out as they are read from the DB, so memory use does not grow with the table.
+//	download adds a Content-Disposition, so browsers save the export as a file.
+//
+// The status line is only sent with the first entry, so a DB error before then is still a 500.
+//	After that, the only honest thing left is to abort the connection so the client
+//	does not mistake a truncated export for a complete one.
+func (a *Application) streamAddressBookEntries(w http.ResponseWriter, r *http.Request, s *serializer, download bool) {
+	enc, err := s.NewEncoder(w, r, false)
 	if nil != err {
-		// NO data is OK
-		if sql.ErrNoRows != err {
-			// Something bad happened
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+
+	var started bool
+	var cnt int
+	start := func() error {
+		if started {
+			return nil
+		}
+		started = true
+
+		w.Header().Set("Content-Type", s.MediaType)
+		if download {
+			t := time.Now()
+			w.Header().Set("Content-Disposition",
+				fmt.Sprintf("attachment;filename=AddressBoookExport-%04d%s%02dT%02d%02d%02d.%s",
+					t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), s.FileExt) )
+		}
+		w.WriteHeader(http.StatusOK)
+		return enc.Begin()
+	}
+	flush := func() error {
+		if err := enc.Flush(); nil != err {
+			return err
+		}
+		if nil != flusher {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	err = a.db(r).IterateAddressBookEntries(r.Context(), func(abe *AddressBookEntry) error {
+		if err := start(); nil != err {
+			return err
+		}
+		// It is an interesting problem if the write fails, typically the client went away
+		if err := enc.Encode(abe); nil != err {
+			return err
+		}
+		cnt++
+		if 0 == cnt%exportFlushInterval {
+			return flush()
+		}
+		return nil
+	})
+	if nil == err {
+		// An empty table still gets its header and trailer, if any
+		if err = start(); nil == err {
+			if err = enc.End(); nil == err {
+				err = flush()
+			}
+		}
+	}
+	auditDetail(r, "%d entries as %s", cnt, s.MediaType)
+	if nil != err {
+		if !started {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		slog.ErrorContext(r.Context(), "streamAddressBookEntries:: export aborted", "format", s.MediaType, "entries", cnt, "err", err)
+		panic(http.ErrAbortHandler)
 	}
-	respondWithCSV(w, http.StatusOK, abes)
 }
 
-// The request body should be our new addresses.
-// Questions to consider:
-// - Should current contents of the DB be dropped ?
-//		I.e. delete existing records before import.		NO for this iteration
-// - Will we always received a header record ?
-// - Do we assume the ID field will be present ?		Assume YES
-// - What do we do with the ID field ?	Ignore it
-// - Should the entire import be atomic ?
-//		Yes it should, but this implementation is not.
-//		I.e. errors will be noted, but not terminate the input.
-//		A better approach would be to allow specifying this behavior - but not today.
-func (a *Application) addAddressBookEntriesFromCSV(w http.ResponseWriter, r *http.Request) {
-	// []*AddressBookEntry
-	csvReader := csv.NewReader( r.Body )
 
-	var cnt, errCnt int
-	msgs := []string{}
+// **************** Import ****************
+
+// entryDecoder reads AddressBookEntries from an import, one at a time.
+type entryDecoder interface {
+	// Decode returns the next entry.  A *badRecordError only affects that one record,
+	//	io.EOF means there are no more, and any other error means the rest can not be read.
+	Decode() (*AddressBookEntry, error)
+	// Record is the number of the record (line) last read by Decode, for messages.
+	Record() int
+}
+
+// badRecordError is a problem with a single import record, the records after it can still be read.
+type badRecordError struct {
+	Rcd int
+	Err error
+}
+
+func (e *badRecordError) Error() string {
+	return fmt.Sprintf("Bad ABE, rcd# %d: %v", e.Rcd, e.Err)
+}
+
+// The *mode* query parameter selects how imported entries are reconciled with the existing ones:
+//	insert			(default) always add, the ID field is ignored
+//	upsert-id		update the entry with the same ID, add it if there is none
+//	upsert-email	update the entry with the same Email, add it if there is none
+//	replace			delete all existing entries, then load these
+func importModeFromRequest(r *http.Request) (ImportMode, error) {
+	mode := ImportInsert
+	if m := r.URL.Query().Get("mode"); "" != m {
+		mode = ImportMode(m)
+	}
+
+	switch mode {
+	case ImportInsert, ImportUpsertByID, ImportUpsertByEmail, ImportReplace:
+		return mode, nil
+	}
+	return mode, fmt.Errorf("Unknown import mode (%v)", mode)
+}
+
+// The *atomic* query parameter selects if the entire import succeeds or fails as one:
+//	true	nothing is saved unless every record is good, all in one transaction
+//	false	each record is saved on its own, bad ones are noted but do not terminate the input
+// The default is false for insert, which is how the import always behaved, and true otherwise.
+//	replace can only be atomic, a truncated file must never replace the address book.
+func importAtomicFromRequest(r *http.Request, mode ImportMode) (bool, error) {
+	atomic := ImportInsert != mode
+	if s := r.URL.Query().Get("atomic"); "" != s {
+		var err error
+		if atomic, err = strconv.ParseBool(s); nil != err {
+			return false, fmt.Errorf("Bad atomic value (%v)", s)
+		}
+	}
+	if ImportReplace == mode && !atomic {
+		return false, fmt.Errorf("Import mode (%v) is always atomic", mode)
+	}
+	return atomic, nil
+}
+
+// importReport tallies an import as it goes.
+type importReport struct {
+	Processed int `json:"processed"`
+	Inserted  int `json:"inserted"`
+	Updated   int `json:"updated"`
+	Failed    int `json:"failed"`
+	// Msgs has one message per bad record, and a summary once the import is over
+	Msgs []string `json:"messages"`
+	// Rejected is set when an atomic import found bad records, so saved nothing
+	Rejected bool `json:"rejected"`
+}
+
+// importProgressInterval is how many records a non-atomic import reads between progress calls.
+const importProgressInterval = 100
+
+// runImport saves everything dec reads into rep, which may already hold the counts of an earlier,
+//	interrupted run.  progress, if not nil, is called every importProgressInterval records and
+//	before an atomic import reaches the database; an error from it stops the import.
+// An error means the import could not finish, rep says how far it got.
+func (a *Application) runImport(ctx context.Context, db AddressBookDatabase, dec entryDecoder, mode ImportMode,
+	atomic bool, rep *importReport, progress func() error) error {
+	if nil == progress {
+		progress = func() error { return nil }
+	}
+	// Only what this run adds is counted, a job may be carrying on from an earlier one
+	defer observeImport(*rep, rep)
+	if atomic {
+		return a.runImportAtomic(ctx, db, dec, mode, rep, progress)
+	}
+
 	for {
-		cnt++
-		// Extract a record
-		record, err := csvReader.Read()
+		if err := ctx.Err(); nil != err {
+			return err
+		}
+		abe, err := dec.Decode()
 		if io.EOF == err {
 			break
 		}
-		if nil != err {
-			msgs = append(msgs, fmt.Sprintf("CSV read error, rcd# %d: %v", err))
-			errCnt++
+		if bre, ok := err.(*badRecordError); ok {
+			rep.Processed++
+			rep.Failed++
+			rep.Msgs = append(rep.Msgs, bre.Error())
 			continue
 		}
-		//log.Printf("addCSV:: record: %v", record)
-		// 1 == cnt, check for header record
-		if 1 == cnt && isABFCSVHeader(record) {
-			// skip this one
-			continue
+		if nil != err {
+			// The rest of the body was refused, there is no point going on without it
+			if _, ok := bodyTooLarge(err); ok {
+				return err
+			}
+			rep.Failed++
+			rep.Msgs = append(rep.Msgs, fmt.Sprintf("Read error after rcd# %d, import stopped: %v", dec.Record(), err))
+			break
 		}
+		rep.Processed++
 
-		// ! headerFound, insert record
-		_, err = a.DB.AddAddressBookEntry( &AddressBookEntry{
-			Firstname: record[1],
-			Lastname:  record[2],
-			Email:     record[3],
-			Phone:     record[4],
-			} )
+		result, err := db.BulkUpsertAddressBookEntries([]*AddressBookEntry{abe}, mode)
 		if nil != err {
 			// TODO: Limit number of Add ABE failed msgs
-			msgs = append(msgs, fmt.Sprintf("Add ABE failed, rcd# %d: %v", err))
-			errCnt++
+			rep.Msgs = append(rep.Msgs, fmt.Sprintf("Add ABE failed, rcd# %d: %v", dec.Record(), err))
+			rep.Failed++
+		} else {
+			rep.Inserted += result.Inserted
+			rep.Updated += result.Updated
+		}
+
+		if 0 == rep.Processed%importProgressInterval {
+			if err := progress(); nil != err {
+				return err
+			}
 		}
 	}
 
-	// Respond with message of number successful and number failed imports
-	msgs = append(msgs, fmt.Sprintf("Processed %d input records.  Errors: %d", cnt, errCnt))
+	// Message of number successful and number failed imports
+	rep.Msgs = append(rep.Msgs, fmt.Sprintf("Processed %d input records.  Errors: %d", rep.Processed, rep.Failed))
+	return nil
+}
+
+// The whole input is read and checked first, then handed to the DB as one transaction.
+func (a *Application) runImportAtomic(ctx context.Context, db AddressBookDatabase, dec entryDecoder,
+	mode ImportMode, rep *importReport, progress func() error) error {
+	abes := []*AddressBookEntry{}
+	for {
+		if err := ctx.Err(); nil != err {
+			return err
+		}
+		abe, err := dec.Decode()
+		if io.EOF == err {
+			break
+		}
+		if bre, ok := err.(*badRecordError); ok {
+			rep.Failed++
+			rep.Msgs = append(rep.Msgs, bre.Error())
+			continue
+		}
+		if nil != err {
+			if _, ok := bodyTooLarge(err); ok {
+				return err
+			}
+			rep.Failed++
+			rep.Msgs = append(rep.Msgs, fmt.Sprintf("Read error after rcd# %d: %v", dec.Record(), err))
+			break
+		}
+		abes = append(abes, abe)
+	}
+	rep.Processed = len(abes) + rep.Failed
+
+	if 0 < rep.Failed {
+		rep.Rejected = true
+		rep.Msgs = append(rep.Msgs, fmt.Sprintf("Rejected %d input records, nothing imported.  Errors: %d",
+			rep.Processed, rep.Failed))
+		return nil
+	}
 
-	if cnt == errCnt {
-		respondWithJSON(w, http.StatusBadRequest, msgs)
+	// Last chance to stop, once the transaction starts it runs to the end
+	if err := progress(); nil != err {
+		return err
+	}
+	result, err := db.BulkUpsertAddressBookEntries(abes, mode)
+	if nil != err {
+		return fmt.Errorf("Import (%s) failed, nothing imported: %v", mode, err)
+	}
+	rep.Inserted, rep.Updated = result.Inserted, result.Updated
+	rep.Msgs = append(rep.Msgs, fmt.Sprintf("Processed %d input records.  Inserted: %d  Updated: %d",
+		len(abes), result.Inserted, result.Updated))
+	return nil
+}
+
+// importAddressBookEntries saves everything dec reads, and responds with a list of messages:
+//	one per bad record, then a summary.
+func (a *Application) importAddressBookEntries(w http.ResponseWriter, r *http.Request, dec entryDecoder,
+	mode ImportMode, atomic bool) {
+	rep := &importReport{Msgs: []string{}}
+	err := a.runImport(r.Context(), a.db(r), dec, mode, atomic, rep, nil)
+	auditDetail(r, "%s, processed %d, inserted %d, updated %d, failed %d",
+		mode, rep.Processed, rep.Inserted, rep.Updated, rep.Failed)
+	if tooBig, ok := bodyTooLarge(err); ok {
+		if 0 == rep.Inserted+rep.Updated {
+			respondBodyTooLarge(w, r, tooBig)
+			return
+		}
+		// Not atomic, so what came before the limit is saved, the client must not think otherwise
+		writeProblem(w, &problem{
+			Type:      "about:blank",
+			Title:     http.StatusText(http.StatusRequestEntityTooLarge),
+			Status:    http.StatusRequestEntityTooLarge,
+			Detail:    fmt.Sprintf("The request body is larger than the %d bytes allowed, the import stopped there: %d records were processed, %d inserted and %d updated",
+				tooBig.Limit, rep.Processed, rep.Inserted, rep.Updated),
+			Instance:  r.URL.Path,
+			RequestID: requestIDFromContext(r.Context()),
+			Messages:  rep.Msgs,
+		})
 		return
 	}
-	if 0 < errCnt {	// We know errCnt < cnt, unless something really odd happened
-		respondWithJSON(w, http.StatusPartialContent, msgs)
+	if nil != err {
+		respondWithJSON(w, http.StatusInternalServerError, append(rep.Msgs, err.Error()))
 		return
 	}
-	respondWithJSON(w, http.StatusOK, msgs)
-}
 
-// TODO: verify all expected header fields are present in the expected order
-func isABFCSVHeader(rcd []string) (bool) {
-	return (5 <= len(rcd)) && ("ID" == rcd[0])
+	switch {
+	case rep.Rejected:
+		respondWithJSON(w, http.StatusBadRequest, rep.Msgs)
+	case 0 < rep.Failed && rep.Processed <= rep.Failed:
+		respondWithJSON(w, http.StatusBadRequest, rep.Msgs)
+	case 0 < rep.Failed:
+		respondWithJSON(w, http.StatusPartialContent, rep.Msgs)
+	default:
+		respondWithJSON(w, http.StatusOK, rep.Msgs)
+	}
 }
 
 
 // **************** DATABASE SETUP ****************
+
+// OpenDatabase connects to the address book, bringing its schema up to date, with a pool
+//	sized as pool says.  Initialize uses it, so do the command line tools.
+func OpenDatabase(user, passwd, dbname string, pool PoolConfig) (AddressBookDatabase, error) {
+	// [START sql]
+	sqlConfig := SQLConfig{
+		Username: user,
+		Password: passwd,
+		Instance: dbname,
+		Port: 3306,
+		Pool: pool,
+	}
+
+	slog.Debug("OpenDatabase:: connecting", "user", user, "schema", dbname)
+
+	return configureSQL( sqlConfig )
+	// [END sql]
+}
+
 type SQLConfig struct {
 	Username, Password, Instance string
 	Port int
+	Pool PoolConfig
 }
 
 func configureSQL(config SQLConfig) (AddressBookDatabase, error) {
@@ -359,5 +912,6 @@ func configureSQL(config SQLConfig) (AddressBookDatabase, error) {
 		// 3306 conflicts with local MySQL instance, so use different port for proxy
 		// Port:     3306,
 		Port:     config.Port,
+		Pool:     config.Pool,
 	})
 }
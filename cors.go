@@ -0,0 +1,138 @@
+// 2026.10.19 rjj: CORS, for browser clients on other origins
+// With a CORSConfig every response to an allowed Origin says so, and an OPTIONS preflight on
+//	any path is answered with the methods the routes registered for that path take, as mux
+//	matches them, so a preflight can never promise a method the route would refuse.
+// Preflights carry no credentials, so they are not authenticated, see auth.go.
+// Credentials are only ever allowed for an origin listed by name: "*" with AllowCredentials
+//	would let any site call the API as whoever is signed in to it in the browser.
+
+package addressbook
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// CORSConfig says which browser clients may call the API, and how.
+type CORSConfig struct {
+	// AllowedOrigins may call the API, e.g. "https://app.example.com", "*" is any origin
+	AllowedOrigins []string
+	// AllowedMethods defaults to GET, POST, PUT and DELETE
+	AllowedMethods []string
+	// AllowedHeaders are the request headers a client may send, defaults to Accept,
+	//	Authorization, Content-Type and X-Request-ID
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers a client may read, besides the simple ones,
+	//	defaults to Content-Disposition, Location, Retry-After, X-Request-ID and the RateLimit-*
+	ExposedHeaders []string
+	// AllowCredentials lets a client send cookies and client certificates, not with "*"
+	AllowCredentials bool
+	// MaxAge is how long a browser may keep a preflight's answer, 0 leaves it to the browser
+	MaxAge time.Duration
+}
+
+var (
+	defaultCORSMethods = []string{"GET", "POST", "PUT", "DELETE"}
+	defaultCORSHeaders = []string{"Accept", "Authorization", "Content-Type", "X-Request-ID"}
+	defaultCORSExposed = []string{"Content-Disposition", "Location", "Retry-After", "X-Request-ID",
+		"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"}
+)
+
+// orDefault is list, or def if it is empty
+func orDefault(list, def []string) []string {
+	if 0 == len(list) {
+		return def
+	}
+	return list
+}
+
+// validate refuses "*" with AllowCredentials
+func (c *CORSConfig) validate() error {
+	if !c.AllowCredentials {
+		return nil
+	}
+	for _, o := range c.AllowedOrigins {
+		if "*" == o {
+			return fmt.Errorf("CORS can not allow credentials from any origin (*), list the origins")
+		}
+	}
+	return nil
+}
+
+// originAllowed reports whether origin is one of the AllowedOrigins
+func (c *CORSConfig) originAllowed(origin string) bool {
+	return c.originListed(origin) || slices.Contains(c.AllowedOrigins, "*")
+}
+
+// originListed reports whether origin is one of the AllowedOrigins by name, not by "*"
+func (c *CORSConfig) originListed(origin string) bool {
+	return slices.ContainsFunc(c.AllowedOrigins, func(o string) bool { return strings.EqualFold(o, origin) })
+}
+
+// cors adds the CORS headers to the responses to an allowed Origin.  The origin is echoed, not
+//	"*", since "*" can not be used with credentials.
+func (a *Application) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); "" != origin && a.CORS.originAllowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if a.CORS.AllowCredentials && a.CORS.originListed(origin) {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if http.MethodOptions != r.Method {
+				w.Header().Set("Access-Control-Expose-Headers",
+					strings.Join(orDefault(a.CORS.ExposedHeaders, defaultCORSExposed), ", "))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routeMethods are the AllowedMethods a route is registered for at r's path.  With a
+//	NotFoundHandler and MethodNotAllowedHandler, mux "matches" every method on every path,
+//	with a MatchErr, so only a match without one counts, and never the preflight route itself.
+func (a *Application) routeMethods(r *http.Request) []string {
+	methods := []string{}
+	for _, m := range orDefault(a.CORS.AllowedMethods, defaultCORSMethods) {
+		probe := r.Clone(r.Context())
+		probe.Method = m
+		var match mux.RouteMatch
+		if a.Router.Match(probe, &match) && nil == match.MatchErr && a.preflightRoute != match.Route {
+			methods = append(methods, m)
+		}
+	}
+	return methods
+}
+
+// preflight answers OPTIONS, on every path
+func (a *Application) preflight(w http.ResponseWriter, r *http.Request) {
+	methods := a.routeMethods(r)
+	if 0 == len(methods) {
+		respondWithError(w, http.StatusNotFound, fmt.Sprintf("No route for (%s)", r.URL.Path))
+		return
+	}
+	w.Header().Set("Allow", strings.Join(append(methods, http.MethodOptions), ", "))
+
+	origin := r.Header.Get("Origin")
+	if "" != origin && "" != r.Header.Get("Access-Control-Request-Method") {
+		if !a.CORS.originAllowed(origin) {
+			respondWithProblem(w, r, http.StatusForbidden, fmt.Sprintf("Origin (%s) is not allowed", origin))
+			return
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers",
+			strings.Join(orDefault(a.CORS.AllowedHeaders, defaultCORSHeaders), ", "))
+		if 0 < a.CORS.MaxAge {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(a.CORS.MaxAge.Seconds())))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -6,11 +6,15 @@
 package addressbook
 
 import (
+	"context"
 	"database/sql"
 	"database/sql/driver"
 	"errors"
 	"fmt"
+	"log/slog"
 	_ "log"
+	"slices"
+	"time"
 	"github.com/go-sql-driver/mysql"
 )
 
@@ -34,14 +38,42 @@ type mysqlDB struct {
 	conn *sql.DB
 	Config   MySQLConfig
 
-	list     *sql.Stmt
-	insert   *sql.Stmt
-	get      *sql.Stmt
-	update   *sql.Stmt
-	delete   *sql.Stmt
+	list     *timedStmt
+	insert   *timedStmt
+	get      *timedStmt
+	update   *timedStmt
+	delete   *timedStmt
+	upsertByID  *timedStmt
+	findByEmail *timedStmt
+	getRedirect *timedStmt
+	getForUpdate    *timedStmt
+	getAnyForUpdate *timedStmt
+	nextRev         *timedStmt
+	addRevision     *timedStmt
+	listRevisions   *timedStmt
+	listDeleted *timedStmt
+	restore     *timedStmt
+	purge       *timedStmt
+
+	addImportJob        *timedStmt
+	getImportJob        *timedStmt
+	listImportJobs      *timedStmt
+	transitionImportJob *timedStmt
+	saveImportJob       *timedStmt
+
+	addAPIKey       *timedStmt
+	getAPIKeyByHash *timedStmt
 	// drop is for testing only
-	drop     *sql.Stmt
-	truncate *sql.Stmt
+	drop     *timedStmt
+	truncate *timedStmt
+
+	// breaker fails connections fast while the database is down, see db_mysql_resilience.go
+	breaker *circuitBreaker
+
+	// actor is who the writes are made by, see WithActor
+	actor string
+	// book is the AddressBook the entries are in, see WithBook
+	book int64
 }
 
 // Ensure mysqlDB conforms to the AddressBookDatabase interface.
@@ -65,6 +97,9 @@ type MySQLConfig struct {
 	// UnixSocket is the filepath to a unix socket.
 	// If set, Host and Port should be unset.
 	UnixSocket string
+
+	// Pool sizes the pool of connections, see db_mysql_resilience.go
+	Pool PoolConfig
 }
 
 func (c MySQLConfig) createDatabaseStatement() string {
@@ -121,43 +156,95 @@ func newMySQLDB(config MySQLConfig) (AddressBookDatabase, error) {
 		return nil, err
 	}
 
-	conn, err := sql.Open("mysql", config.dataStoreName())
+	breaker := &circuitBreaker{}
+	connector, err := config.connector(breaker)
 	if err != nil {
 		return nil, fmt.Errorf("mysql: could not get a connection: %v", err)
 	}
+	conn := sql.OpenDB(connector)
+	config.Pool.apply(conn)
 	if err := conn.Ping(); err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("mysql: could not establish a good connection: %v", err)
 	}
+	// Bring the tables up to date, before preparing statements that use them
+	if err := migrateSchema(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
 
 	db := &mysqlDB{
 		conn: conn,
+		breaker: breaker,
 	}
 
 
 	// Prepared statements. The actual SQL queries are in the code near the
 	// relevant method (e.g. AddAddressBookEntry).
-	if db.list, err = conn.Prepare(listStatement); err != nil {
+	if db.list, err = db.prepare("list", listStatement); err != nil {
 		return nil, fmt.Errorf("mysql: prepare list: %v", err)
 	}
-	if db.get, err = conn.Prepare(getStatement); err != nil {
+	if db.get, err = db.prepare("get", getStatement); err != nil {
 		return nil, fmt.Errorf("mysql: prepare get: %v", err)
 	}
-	if db.insert, err = conn.Prepare(insertStatement); err != nil {
+	if db.insert, err = db.prepare("insert", insertStatement); err != nil {
 		return nil, fmt.Errorf("mysql: prepare insert: %v", err)
 	}
-	if db.update, err = conn.Prepare(updateStatement); err != nil {
+	if db.update, err = db.prepare("update", updateStatement); err != nil {
 		return nil, fmt.Errorf("mysql: prepare update: %v", err)
 	}
-	if db.delete, err = conn.Prepare(deleteStatement); err != nil {
+	if db.delete, err = db.prepare("delete", deleteStatement); err != nil {
 		return nil, fmt.Errorf("mysql: prepare delete: %v", err)
 	}
-	if db.drop, err = conn.Prepare(dropStatement); err != nil {
+	if db.upsertByID, err = db.prepare("upsertByID", upsertByIDStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare upsert by id: %v", err)
+	}
+	if db.findByEmail, err = db.prepare("findByEmail", findByEmailStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare find by email: %v", err)
+	}
+	if db.getForUpdate, err = db.prepare("getForUpdate", getForUpdateStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare get for update: %v", err)
+	}
+	if db.getAnyForUpdate, err = db.prepare("getAnyForUpdate", getAnyForUpdateStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare get any for update: %v", err)
+	}
+	if db.nextRev, err = db.prepare("nextRev", nextRevStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare next rev: %v", err)
+	}
+	if db.addRevision, err = db.prepare("addRevision", addRevisionStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare add revision: %v", err)
+	}
+	if db.listRevisions, err = db.prepare("listRevisions", listRevisionsStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare list revisions: %v", err)
+	}
+	if db.listDeleted, err = db.prepare("listDeleted", listDeletedStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare list deleted: %v", err)
+	}
+	if db.restore, err = db.prepare("restore", restoreStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare restore: %v", err)
+	}
+	if db.purge, err = db.prepare("purge", purgeStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare purge: %v", err)
+	}
+	if db.getRedirect, err = db.prepare("getRedirect", getRedirectStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare get redirect: %v", err)
+	}
+	if err = db.prepareImportJobStatements(); err != nil {
+		return nil, err
+	}
+	if err = db.prepareAPIKeyStatements(); err != nil {
+		return nil, err
+	}
+	if db.drop, err = db.prepare("drop", dropStatement); err != nil {
 		return nil, fmt.Errorf("mysql: prepare drop: %v", err)
 	}
-	if db.truncate, err = conn.Prepare(truncateStatement); err != nil {
+	if db.truncate, err = db.prepare("truncate", truncateStatement); err != nil {
 		return nil, fmt.Errorf("mysql: prepare truncate: %v", err)
 	}
+	// Not being watched is no reason not to serve, see db_mysql_metrics.go
+	if err = registerMySQLCollector(conn, config.Schema); err != nil {
+		slog.Warn("newMySQLDB:: no database metrics", "err", err)
+	}
 
 	return db, nil
 }
@@ -181,8 +268,9 @@ func scanAddressBookEntry(s rowScanner) (*AddressBookEntry, error) {
 		email       sql.NullString
 		phone       sql.NullString
 		createdDate sql.NullString
+		deletedAt   sql.NullString
 	)
-	if err := s.Scan(&id, &firstname, &lastname, &email, &phone, &createdDate); err != nil {
+	if err := s.Scan(&id, &firstname, &lastname, &email, &phone, &createdDate, &deletedAt); err != nil {
 		return nil, err
 	}
 
@@ -193,14 +281,24 @@ func scanAddressBookEntry(s rowScanner) (*AddressBookEntry, error) {
 		Email:       email.String,
 		Phone:       phone.String,
 	}
+	if deletedAt.Valid {
+		if t, err := time.Parse(mysqlDateTime, deletedAt.String); err == nil {
+			abe.DeletedAt = &t
+		}
+	}
 	return abe, nil
 }
 
-const listStatement = `SELECT * FROM addressbookentries ORDER BY lastname, firstname`
+// entryColumns are read by scanAddressBookEntry.  Deleted entries are in the trash, and only
+//	the trash queries see them.  Every query is confined to the book, see db_mysql_books.go.
+const entryColumns = `id, firstname, lastname, email, phone, createdDate, deleted_at`
+
+const listStatement = `SELECT ` + entryColumns + ` FROM addressbookentries
+  WHERE address_book_id = ? AND deleted_at IS NULL ORDER BY lastname, firstname`
 
 // ListAddressBookEntrys returns a list of AddressBookEntries, ordered by name.
 func (db *mysqlDB) ListAddressBookEntries() ([]*AddressBookEntry, error) {
-	rows, err := db.list.Query()
+	rows, err := db.list.Query(db.bookID())
 	if err != nil {
 		return nil, err
 	}
@@ -220,12 +318,32 @@ func (db *mysqlDB) ListAddressBookEntries() ([]*AddressBookEntry, error) {
 	return AddressBookEntries, nil
 }
 
+// IterateAddressBookEntries streams the list query, one row at a time, into fn.
+func (db *mysqlDB) IterateAddressBookEntries(ctx context.Context, fn func(*AddressBookEntry) error) error {
+	rows, err := db.list.QueryContext(ctx, db.bookID())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		abe, err := scanAddressBookEntry(rows)
+		if err != nil {
+			return fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		if err := fn(abe); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
 
-const getStatement = "SELECT * FROM addressbookentries WHERE id = ?"
+const getStatement = `SELECT ` + entryColumns + ` FROM addressbookentries
+  WHERE id = ? AND address_book_id = ? AND deleted_at IS NULL`
 
 // GetAddressBookEntry retrieves a addressbook by its ID.
 func (db *mysqlDB) GetAddressBookEntry(id int64) (*AddressBookEntry, error) {
-	abe, err := scanAddressBookEntry(db.get.QueryRow(id))
+	abe, err := scanAddressBookEntry(db.get.QueryRow(id, db.bookID()))
 	// There is a design trade-off here I need to think about
 	//	Should the error be found and "handled" at this level, or should
 	//	it just be returned as is, and allow the client decide what it means.
@@ -235,7 +353,6 @@ func (db *mysqlDB) GetAddressBookEntry(id int64) (*AddressBookEntry, error) {
 	//	what errors, and how they will be signaled.
 	//	The ultimate flexibility of the cleint response is impacted.
 	if nil != err {
-		//log.Printf("mysql: AddressBookEntry with ID (%d) not found, err(%v)", id, err)
 		return nil, err
 	}
 	/*
@@ -255,12 +372,30 @@ func (db *mysqlDB) GetAddressBookEntry(id int64) (*AddressBookEntry, error) {
 
 const insertStatement = `
   INSERT INTO addressbookentries (
-    firstname, lastname, email, phone
-  ) VALUES (?, ?, ?, ?)`
+    address_book_id, firstname, lastname, email, phone
+  ) VALUES (?, ?, ?, ?, ?)`
 
 // AddAddressBookEntry saves a given addressbook, assigning it a new ID.
 func (db *mysqlDB) AddAddressBookEntry(abe *AddressBookEntry) (id int64, err error) {
-	r, err := execAffectingOneRow(db.insert, abe.Firstname, abe.Lastname, abe.Email, abe.Phone)
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not begin transaction: %v", err)
+	}
+	// Rollback is a no-op once Commit has succeeded
+	defer tx.Rollback()
+
+	if id, err = db.insertAddressBookEntry(tx, abe, RevisionCreate); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("mysql: could not commit transaction: %v", err)
+	}
+	return id, nil
+}
+
+// insertAddressBookEntry adds a new entry within tx, and its first revision.
+func (db *mysqlDB) insertAddressBookEntry(tx *sql.Tx, abe *AddressBookEntry, action RevisionAction) (int64, error) {
+	r, err := execAffectingOneRow(db.insert.in(tx), db.bookID(), abe.Firstname, abe.Lastname, abe.Email, abe.Phone)
 	if err != nil {
 		return 0, err
 	}
@@ -269,33 +404,430 @@ func (db *mysqlDB) AddAddressBookEntry(abe *AddressBookEntry) (id int64, err err
 	if err != nil {
 		return 0, fmt.Errorf("mysql: could not get last insert ID: %v", err)
 	}
-	return lastInsertID, nil
+	after := *abe
+	after.ID = lastInsertID
+	return lastInsertID, db.writeRevision(tx, action, nil, &after)
+}
+
+const getForUpdateStatement = `SELECT ` + entryColumns + ` FROM addressbookentries
+  WHERE id = ? AND address_book_id = ? AND deleted_at IS NULL FOR UPDATE`
+
+// lockAddressBookEntry reads an entry within tx, locking it until tx is over.
+//	sql.ErrNoRows if it does not exist, or is in the trash.
+func (db *mysqlDB) lockAddressBookEntry(tx *sql.Tx, id int64) (*AddressBookEntry, error) {
+	return scanAddressBookEntry(db.getForUpdate.in(tx).QueryRow(id, db.bookID()))
 }
 
-const deleteStatement = `DELETE FROM addressbookentries WHERE id = ?`
+const getAnyForUpdateStatement = `SELECT ` + entryColumns + ` FROM addressbookentries
+  WHERE id = ? AND address_book_id = ? FOR UPDATE`
 
-// DeleteAddressBookEntry removes a given addressbook by its ID.
+// lockAnyAddressBookEntry is lockAddressBookEntry, including the trash
+func (db *mysqlDB) lockAnyAddressBookEntry(tx *sql.Tx, id int64) (*AddressBookEntry, error) {
+	return scanAddressBookEntry(db.getAnyForUpdate.in(tx).QueryRow(id, db.bookID()))
+}
+
+const deleteStatement = `
+  UPDATE addressbookentries SET deleted_at = CURRENT_TIMESTAMP
+  WHERE id = ? AND address_book_id = ? AND deleted_at IS NULL`
+
+// DeleteAddressBookEntry moves a given addressbook to the trash, by its ID.
 func (db *mysqlDB) DeleteAddressBookEntry(id int64) error {
 	if id == 0 {
 		return errors.New("mysql: address book entry with unassigned ID passed into deleteAddressBookEntry")
 	}
-	_, err := execAffectingOneRow(db.delete, id)
-	return err
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("mysql: could not begin transaction: %v", err)
+	}
+	// Rollback is a no-op once Commit has succeeded
+	defer tx.Rollback()
+
+	if err := db.trashAddressBookEntry(tx, id, RevisionDelete); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("mysql: could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+// trashAddressBookEntry moves an entry to the trash within tx, recording it as action.
+func (db *mysqlDB) trashAddressBookEntry(tx *sql.Tx, id int64, action RevisionAction) error {
+	before, err := db.lockAddressBookEntry(tx, id)
+	if err != nil {
+		return fmt.Errorf("mysql: could not find address book entry %d: %v", id, err)
+	}
+	if _, err := execAffectingOneRow(db.delete.in(tx), id, db.bookID()); err != nil {
+		return err
+	}
+	return db.writeRevision(tx, action, before, before)
 }
 
 const updateStatement = `
   UPDATE addressbookentries
   SET firstname=?, lastname=?, email=?, phone=?
-  WHERE id = ?`
+  WHERE id = ? AND address_book_id = ? AND deleted_at IS NULL`
 
 // UpdateAddressBookEntry updates the entry for a given addressbook.
 func (db *mysqlDB) UpdateAddressBookEntry(abe *AddressBookEntry) error {
 	if abe.ID == 0 {
 		return errors.New("mysql: address book entry with unassigned ID passed into UpdateAddressBookEntry")
 	}
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("mysql: could not begin transaction: %v", err)
+	}
+	// Rollback is a no-op once Commit has succeeded
+	defer tx.Rollback()
 
-	_, err := execAffectingOneRow(db.update, abe.Firstname, abe.Lastname, abe.Email, abe.Phone, abe.ID)
-	return err
+	before, err := db.lockAddressBookEntry(tx, abe.ID)
+	if err != nil {
+		return fmt.Errorf("mysql: could not find address book entry %d: %v", abe.ID, err)
+	}
+	// Not execAffectingOneRow, MySQL reports 0 rows affected when nothing changed
+	if _, err := db.update.in(tx).Exec(abe.Firstname, abe.Lastname, abe.Email, abe.Phone, abe.ID, db.bookID()); err != nil {
+		return fmt.Errorf("mysql: could not execute statement: %v", err)
+	}
+	if err := db.writeRevisionIfChanged(tx, RevisionUpdate, before, abe); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("mysql: could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+// Merged entries wait in the trash to be purged, with their history, but are not shown there
+const listDeletedStatement = `SELECT ` + entryColumns + ` FROM addressbookentries
+  WHERE address_book_id = ? AND deleted_at IS NOT NULL
+    AND id NOT IN (SELECT id FROM addressbookredirects)
+  ORDER BY deleted_at DESC, id`
+
+// ListDeletedAddressBookEntries returns the trash, most recently deleted first.
+func (db *mysqlDB) ListDeletedAddressBookEntries() ([]*AddressBookEntry, error) {
+	rows, err := db.listDeleted.Query(db.bookID())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	AddressBookEntries := []*AddressBookEntry{}
+	for rows.Next() {
+		abe, err := scanAddressBookEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		AddressBookEntries = append(AddressBookEntries, abe)
+	}
+	return AddressBookEntries, rows.Err()
+}
+
+const restoreStatement = `
+  UPDATE addressbookentries SET deleted_at = NULL
+  WHERE id = ? AND address_book_id = ? AND deleted_at IS NOT NULL`
+
+// RestoreAddressBookEntry takes a given addressbook back out of the trash.
+func (db *mysqlDB) RestoreAddressBookEntry(id int64) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("mysql: could not begin transaction: %v", err)
+	}
+	// Rollback is a no-op once Commit has succeeded
+	defer tx.Rollback()
+
+	before, err := db.lockAnyAddressBookEntry(tx, id)
+	if err != nil {
+		return err
+	}
+	if nil == before.DeletedAt {
+		// Not in the trash
+		return sql.ErrNoRows
+	}
+	if err := checkNotMerged(tx, id); err != nil {
+		return err
+	}
+	if _, err := execAffectingOneRow(db.restore.in(tx), id, db.bookID()); err != nil {
+		return err
+	}
+	if err := db.writeRevision(tx, RevisionRestore, before, before); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("mysql: could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+// The age is worked out by MySQL, deleted_at is in its time zone, not necessarily ours.
+//	The retention is the same for every book, so this one is not confined to one.
+const purgeStatement = `DELETE FROM addressbookentries WHERE deleted_at < NOW() - INTERVAL ? SECOND`
+
+// Purged entries take their history with them
+const purgeRevisionsStatement = `
+  DELETE FROM addressbookrevisions WHERE entryid NOT IN (SELECT id FROM addressbookentries)`
+
+// PurgeDeletedAddressBookEntries permanently removes the entries in the trash for longer than a given age.
+func (db *mysqlDB) PurgeDeletedAddressBookEntries(olderThan time.Duration) (int64, error) {
+	r, err := db.purge.Exec(int64(olderThan / time.Second))
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not execute statement: %v", err)
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not get rows affected: %v", err)
+	}
+	if 0 < n {
+		if _, err := db.conn.Exec(purgeRevisionsStatement); err != nil {
+			return n, fmt.Errorf("mysql: could not purge revisions: %v", err)
+		}
+	}
+	return n, nil
+}
+
+const upsertByIDStatement = `
+  INSERT INTO addressbookentries (
+    id, address_book_id, firstname, lastname, email, phone
+  ) VALUES (?, ?, ?, ?, ?, ?)
+  ON DUPLICATE KEY UPDATE
+    firstname=VALUES(firstname), lastname=VALUES(lastname), email=VALUES(email), phone=VALUES(phone),
+    deleted_at=NULL`
+
+const findByEmailStatement = `
+  SELECT id FROM addressbookentries WHERE email = ? AND address_book_id = ? AND deleted_at IS NULL
+  ORDER BY id LIMIT 1 FOR UPDATE`
+
+// replace moves every entry to the trash, so a bad replace can still be undone
+const listForReplaceStatement = `
+  SELECT id FROM addressbookentries WHERE address_book_id = ? AND deleted_at IS NULL FOR UPDATE`
+
+// BulkUpsertAddressBookEntries saves the given AddressBookEntries in a single transaction.
+//	Either every entry is saved, or none are.
+func (db *mysqlDB) BulkUpsertAddressBookEntries(abes []*AddressBookEntry, mode ImportMode) (*ImportResult, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not begin transaction: %v", err)
+	}
+	// Rollback is a no-op once Commit has succeeded
+	defer tx.Rollback()
+
+	if ImportReplace == mode {
+		if err := db.trashAll(tx); err != nil {
+			return nil, fmt.Errorf("mysql: could not clear table for replace: %v", err)
+		}
+	}
+
+	result := &ImportResult{}
+	for idx, abe := range abes {
+		updated, err := db.upsertAddressBookEntry(tx, abe, mode)
+		if err != nil {
+			return nil, fmt.Errorf("mysql: entry %d: %v", idx+1, err)
+		}
+		if updated {
+			result.Updated++
+		} else {
+			result.Inserted++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("mysql: could not commit transaction: %v", err)
+	}
+	return result, nil
+}
+
+// trashAll moves every entry to the trash within tx, one at a time so each gets a revision.
+func (db *mysqlDB) trashAll(tx *sql.Tx) error {
+	rows, err := tx.Query(listForReplaceStatement, db.bookID())
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := db.trashAddressBookEntry(tx, id, RevisionImport); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upsertAddressBookEntry saves one entry within tx, reporting whether an existing entry was updated.
+func (db *mysqlDB) upsertAddressBookEntry(tx *sql.Tx, abe *AddressBookEntry, mode ImportMode) (bool, error) {
+	switch mode {
+	case ImportInsert:
+		_, err := db.insertAddressBookEntry(tx, abe, RevisionImport)
+		return false, err
+
+	case ImportUpsertByID, ImportReplace:
+		// No ID means there is nothing to match against, so it is always new
+		if 0 == abe.ID {
+			_, err := db.insertAddressBookEntry(tx, abe, RevisionImport)
+			return false, err
+		}
+		// An entry in the trash is brought back by the upsert
+		before, err := db.lockAnyAddressBookEntry(tx, abe.ID)
+		if sql.ErrNoRows == err {
+			before = nil
+			// Not in this book, but the upsert would overwrite it if it is in another
+			var book int64
+			if err := tx.QueryRow(entryBookStatement, abe.ID).Scan(&book); nil == err {
+				return false, fmt.Errorf("mysql: ID %d is in another address book", abe.ID)
+			} else if sql.ErrNoRows != err {
+				return false, fmt.Errorf("mysql: could not find entry by id: %v", err)
+			}
+		} else if err != nil {
+			return false, fmt.Errorf("mysql: could not find entry by id: %v", err)
+		}
+		// A merged entry's ID redirects to its survivor, even once purged
+		if err := checkNotMerged(tx, abe.ID); err != nil {
+			return false, err
+		}
+		if _, err := db.upsertByID.in(tx).Exec(abe.ID, db.bookID(), abe.Firstname, abe.Lastname, abe.Email, abe.Phone); err != nil {
+			return false, fmt.Errorf("mysql: could not execute statement: %v", err)
+		}
+		if err := db.writeRevisionIfChanged(tx, RevisionImport, before, abe); err != nil {
+			return false, err
+		}
+		return nil != before, nil
+
+	case ImportUpsertByEmail:
+		var id int64
+		err := sql.ErrNoRows
+		// No Email means there is nothing to match against, so it is always new
+		if "" != abe.Email {
+			err = db.findByEmail.in(tx).QueryRow(abe.Email, db.bookID()).Scan(&id)
+		}
+		if sql.ErrNoRows == err {
+			_, err := db.insertAddressBookEntry(tx, abe, RevisionImport)
+			return false, err
+		}
+		if err != nil {
+			return false, fmt.Errorf("mysql: could not find entry by email: %v", err)
+		}
+		before, err := db.lockAddressBookEntry(tx, id)
+		if err != nil {
+			return false, fmt.Errorf("mysql: could not read entry %d: %v", id, err)
+		}
+		// Not execAffectingOneRow, MySQL reports 0 rows affected when nothing changed
+		if _, err := db.update.in(tx).Exec(abe.Firstname, abe.Lastname, abe.Email, abe.Phone, id, db.bookID()); err != nil {
+			return false, fmt.Errorf("mysql: could not execute statement: %v", err)
+		}
+		abe.ID = id
+		if err := db.writeRevisionIfChanged(tx, RevisionImport, before, abe); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("mysql: unknown import mode %q", mode)
+}
+
+const redirectStatement = `
+  INSERT INTO addressbookredirects (
+    id, survivorid
+  ) VALUES (?, ?)
+  ON DUPLICATE KEY UPDATE survivorid=VALUES(survivorid)`
+
+// Entries merged earlier into a victim now belong to its survivor, so redirects never chain
+const repointRedirectsStatement = `UPDATE addressbookredirects SET survivorid = ? WHERE survivorid = ?`
+
+const mergedStatement = `SELECT survivorid FROM addressbookredirects WHERE id = ? FOR UPDATE`
+
+// checkNotMerged returns an *EntryMergedError if id was merged into another entry.
+//	Bringing it back would leave the contact twice, its merged data is in the survivor.
+func checkNotMerged(tx *sql.Tx, id int64) error {
+	var survivorID int64
+	err := tx.QueryRow(mergedStatement, id).Scan(&survivorID)
+	if nil == err {
+		return &EntryMergedError{ID: id, SurvivorID: survivorID}
+	}
+	if sql.ErrNoRows != err {
+		return fmt.Errorf("mysql: could not find redirect: %v", err)
+	}
+	return nil
+}
+
+// MergeAddressBookEntries combines the victims into the survivor in a single transaction.
+//	The entries are locked while merge decides the survivor's fields.
+func (db *mysqlDB) MergeAddressBookEntries(survivorID int64, victimIDs []int64,
+	merge func(survivor *AddressBookEntry, victims []*AddressBookEntry)) (*AddressBookEntry, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not begin transaction: %v", err)
+	}
+	// Rollback is a no-op once Commit has succeeded
+	defer tx.Rollback()
+
+	// Locked in ID order, not the request's, so merges of the same entries wait on each other
+	//	instead of deadlocking
+	ids := append([]int64{survivorID}, victimIDs...)
+	slices.Sort(ids)
+	locked := map[int64]*AddressBookEntry{}
+	for _, id := range ids {
+		abe, err := db.lockAddressBookEntry(tx, id)
+		if sql.ErrNoRows == err {
+			return nil, &EntryNotFoundError{ID: id}
+		}
+		if err != nil {
+			return nil, err
+		}
+		locked[id] = abe
+	}
+	survivor := locked[survivorID]
+	victims := []*AddressBookEntry{}
+	for _, id := range victimIDs {
+		victims = append(victims, locked[id])
+	}
+
+	before := *survivor
+	merge(survivor, victims)
+	// Not execAffectingOneRow, MySQL reports 0 rows affected when nothing changed
+	if _, err := db.update.in(tx).Exec(survivor.Firstname, survivor.Lastname, survivor.Email, survivor.Phone, survivor.ID, db.bookID()); err != nil {
+		return nil, fmt.Errorf("mysql: could not update survivor: %v", err)
+	}
+	if err := db.writeRevisionIfChanged(tx, RevisionMerge, &before, survivor); err != nil {
+		return nil, err
+	}
+	for _, victim := range victims {
+		if err := db.trashAddressBookEntry(tx, victim.ID, RevisionMerge); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(redirectStatement, victim.ID, survivor.ID); err != nil {
+			return nil, fmt.Errorf("mysql: could not record redirect: %v", err)
+		}
+		if _, err := tx.Exec(repointRedirectsStatement, survivor.ID, victim.ID); err != nil {
+			return nil, fmt.Errorf("mysql: could not repoint redirects: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("mysql: could not commit transaction: %v", err)
+	}
+	return survivor, nil
+}
+
+const getRedirectStatement = `
+  SELECT r.survivorid FROM addressbookredirects r JOIN addressbookentries e ON e.id = r.survivorid
+  WHERE r.id = ? AND e.address_book_id = ?`
+
+// GetAddressBookRedirect returns the ID a merged entry was merged into.
+func (db *mysqlDB) GetAddressBookRedirect(id int64) (int64, error) {
+	var survivorID int64
+	err := db.getRedirect.QueryRow(id, db.bookID()).Scan(&survivorID)
+	return survivorID, err
 }
 
 
@@ -319,7 +851,7 @@ func (config MySQLConfig) ensureTableExists() error {
 	if _, err := conn.Exec(config.useDatabaseStatement()); err != nil {
 		// MySQL error 1049 is "database does not exist"
 		if mErr, ok := err.(*mysql.MySQLError); ok && mErr.Number == 1049 {
-			fmt.Printf("ensureTableExists:: USE connection 2 err(%v)\n", mErr)
+			slog.Info("ensureTableExists:: creating the database", "schema", config.Schema)
 			return createTable(conn, config.createTableStatements())
 		}
 		return fmt.Errorf("mysql: USE error %v", err)
@@ -339,7 +871,7 @@ func (config MySQLConfig) ensureTableExists() error {
 // createTable creates the table, and if necessary, the database.
 func createTable(conn *sql.DB, dbStatements []string) error {
 	for _, stmt := range dbStatements {
-		fmt.Printf("createTable:: Exec(%v)\n", stmt )
+		slog.Debug("createTable:: exec", "statement", stmt)
 		_, err := conn.Exec(stmt)
 		if err != nil {
 			return err
@@ -349,7 +881,7 @@ func createTable(conn *sql.DB, dbStatements []string) error {
 }
 
 // execAffectingOneRow executes a given statement, expecting one row to be affected.
-func execAffectingOneRow(stmt *sql.Stmt, args ...interface{}) (sql.Result, error) {
+func execAffectingOneRow(stmt *timedStmt, args ...interface{}) (sql.Result, error) {
 	r, err := stmt.Exec(args...)
 	if err != nil {
 		return r, fmt.Errorf("mysql: could not execute statement: %v", err)
@@ -379,6 +911,25 @@ const truncateStatement = `
 
 // TruncateTableAddressBookEntry deleted all data in the DB, and ID sequence is reset to 1.
 func (db *mysqlDB) TruncateTableAddressBookEntry() error {
-	_, err := db.conn.Exec(truncateStatement)
+	if _, err := db.conn.Exec(truncateStatement); err != nil {
+		return err
+	}
+	// IDs start again at 1, so old redirects and history would point the new entries astray
+	if _, err := db.conn.Exec(truncateRedirectsStatement); err != nil {
+		return err
+	}
+	if _, err := db.conn.Exec(truncateBooksStatement); err != nil {
+		return err
+	}
+	if _, err := db.conn.Exec(truncateBookGrantsStatement); err != nil {
+		return err
+	}
+	_, err := db.conn.Exec(truncateRevisionsStatement)
 	return err
 }
+
+const truncateRevisionsStatement = `
+  TRUNCATE TABLE addressbookrevisions`
+
+const truncateRedirectsStatement = `
+  TRUNCATE TABLE addressbookredirects`
@@ -0,0 +1,125 @@
+// 2026.10.19 rjj: MySQL storage for APIKeys
+
+package addressbook
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const createAPIKeysTableStatement = `CREATE TABLE IF NOT EXISTS apikeys (
+				id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+				name VARCHAR(255) NOT NULL,
+				prefix VARCHAR(16) NOT NULL,
+				hash CHAR(64) NOT NULL,
+				admin BOOLEAN NOT NULL,
+				createdDate datetime NOT NULL,
+				expiresAt datetime NULL DEFAULT NULL,
+				revokedAt datetime NULL DEFAULT NULL,
+				PRIMARY KEY (id),
+				UNIQUE KEY (hash)
+			);`
+
+func (db *mysqlDB) prepareAPIKeyStatements() (err error) {
+	if db.addAPIKey, err = db.prepare("addAPIKey", addAPIKeyStatement); err != nil {
+		return fmt.Errorf("mysql: prepare add api key: %v", err)
+	}
+	if db.getAPIKeyByHash, err = db.prepare("getAPIKeyByHash", getAPIKeyByHashStatement); err != nil {
+		return fmt.Errorf("mysql: prepare get api key: %v", err)
+	}
+	return nil
+}
+
+const apiKeyColumns = `id, name, prefix, hash, admin, createdDate, expiresAt, revokedAt`
+
+// scanAPIKey reads an APIKey from a sql.Row or sql.Rows
+func scanAPIKey(s rowScanner) (*APIKey, error) {
+	var (
+		key         APIKey
+		createdDate sql.NullString
+		expiresAt   sql.NullString
+		revokedAt   sql.NullString
+	)
+	if err := s.Scan(&key.ID, &key.Name, &key.Prefix, &key.Hash, &key.Admin,
+		&createdDate, &expiresAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	key.CreatedDate, _ = time.Parse(mysqlDateTime, createdDate.String)
+	if expiresAt.Valid {
+		t, _ := time.Parse(mysqlDateTime, expiresAt.String)
+		key.ExpiresAt = &t
+	}
+	if revokedAt.Valid {
+		t, _ := time.Parse(mysqlDateTime, revokedAt.String)
+		key.RevokedAt = &t
+	}
+	return &key, nil
+}
+
+const addAPIKeyStatement = `
+  INSERT INTO apikeys (
+    name, prefix, hash, admin, createdDate, expiresAt
+  ) VALUES (?, ?, ?, ?, ?, ?)`
+
+// AddAPIKey saves a new key, assigning it an ID.
+//	Dates are written as UTC, and read back as such.
+func (db *mysqlDB) AddAPIKey(key *APIKey) (int64, error) {
+	var expiresAt interface{}
+	if nil != key.ExpiresAt {
+		expiresAt = key.ExpiresAt.UTC().Format(mysqlDateTime)
+	}
+	r, err := execAffectingOneRow(db.addAPIKey, key.Name, key.Prefix, key.Hash, key.Admin,
+		key.CreatedDate.UTC().Format(mysqlDateTime), expiresAt)
+	if err != nil {
+		return 0, err
+	}
+
+	lastInsertID, err := r.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not get last insert ID: %v", err)
+	}
+	return lastInsertID, nil
+}
+
+const getAPIKeyByHashStatement = `SELECT ` + apiKeyColumns + ` FROM apikeys WHERE hash = ?`
+
+// GetAPIKeyByHash finds a key by the hash of the key, sql.ErrNoRows if there is none.
+func (db *mysqlDB) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	return scanAPIKey(db.getAPIKeyByHash.QueryRow(hash))
+}
+
+// ListAPIKeys returns every key, revoked and expired ones included, oldest first.
+func (db *mysqlDB) ListAPIKeys() ([]*APIKey, error) {
+	rows, err := db.query("listAPIKeys", `SELECT ` + apiKeyColumns + ` FROM apikeys ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+const revokeAPIKeyStatement = `UPDATE apikeys SET revokedAt = ? WHERE id = ? AND revokedAt IS NULL`
+
+// RevokeAPIKey stops a key from working, for good.  sql.ErrNoRows if there is no such key.
+//	Revoking a key twice keeps the first date.
+func (db *mysqlDB) RevokeAPIKey(id int64) error {
+	r, err := db.conn.Exec(revokeAPIKeyStatement, time.Now().UTC().Format(mysqlDateTime), id)
+	if err != nil {
+		return fmt.Errorf("mysql: could not execute statement: %v", err)
+	}
+	if n, err := r.RowsAffected(); err != nil || 0 < n {
+		return err
+	}
+	var exists int64
+	return db.queryRow("apiKeyExists", `SELECT id FROM apikeys WHERE id = ?`, id).Scan(&exists)
+}
@@ -0,0 +1,191 @@
+// 2026.10.19 rjj: MySQL storage for the audit log
+// audithead holds the Seq and Hash of the last record.  Appending locks it, so records are
+//	chained one at a time even across instances, and deleting the newest records from
+//	auditlog still leaves the head pointing past them.
+
+package addressbook
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const createAuditLogTableStatement = `CREATE TABLE IF NOT EXISTS auditlog (
+				seq BIGINT UNSIGNED NOT NULL,
+				recorded CHAR(32) NOT NULL,
+				actor VARCHAR(255) NOT NULL,
+				sourceip VARCHAR(64) NOT NULL,
+				requestid VARCHAR(128) NOT NULL,
+				action VARCHAR(32) NOT NULL,
+				method VARCHAR(16) NOT NULL,
+				path TEXT NOT NULL,
+				entityids TEXT NOT NULL,
+				status INT NOT NULL,
+				outcome VARCHAR(16) NOT NULL,
+				detail TEXT NOT NULL,
+				prevhash CHAR(64) NOT NULL,
+				hash CHAR(64) NOT NULL,
+				PRIMARY KEY (seq),
+				KEY (recorded),
+				KEY (actor)
+			);`
+
+const createAuditHeadTableStatement = `CREATE TABLE IF NOT EXISTS audithead (
+				id TINYINT UNSIGNED NOT NULL,
+				seq BIGINT UNSIGNED NOT NULL,
+				hash CHAR(64) NOT NULL,
+				PRIMARY KEY (id)
+			);`
+
+const initAuditHeadStatement = `INSERT IGNORE INTO audithead (id, seq, hash) VALUES (1, 0, '');`
+
+const lockAuditHeadStatement = `SELECT seq, hash FROM audithead WHERE id = 1 FOR UPDATE`
+
+const addAuditRecordStatement = `
+  INSERT INTO auditlog (
+    seq, recorded, actor, sourceip, requestid, action, method, path, entityids,
+    status, outcome, detail, prevhash, hash
+  ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+const moveAuditHeadStatement = `UPDATE audithead SET seq = ?, hash = ? WHERE id = 1`
+
+// AppendAuditRecord assigns rec the next Seq, chains it to the last record and saves it.
+func (db *mysqlDB) AppendAuditRecord(rec *AuditRecord) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("mysql: could not begin transaction: %v", err)
+	}
+	// Rollback is a no-op once Commit has succeeded
+	defer tx.Rollback()
+
+	var seq int64
+	var hash string
+	if err := tx.QueryRow(lockAuditHeadStatement).Scan(&seq, &hash); err != nil {
+		return fmt.Errorf("mysql: could not lock audit head: %v", err)
+	}
+	rec.Seq = seq + 1
+	rec.PrevHash = hash
+	rec.Hash = rec.ComputeHash()
+
+	if _, err := tx.Exec(addAuditRecordStatement, rec.Seq, rec.Date.UTC().Format(auditTimeFormat),
+		rec.Actor, rec.SourceIP, rec.RequestID, rec.Action, rec.Method, rec.Path, joinAuditEntityIDs(rec.EntityIDs),
+		rec.Status, rec.Outcome, rec.Detail, rec.PrevHash, rec.Hash); err != nil {
+		return fmt.Errorf("mysql: could not add audit record: %v", err)
+	}
+	if _, err := tx.Exec(moveAuditHeadStatement, rec.Seq, rec.Hash); err != nil {
+		return fmt.Errorf("mysql: could not move audit head: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("mysql: could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+// AuditChainHead returns the Seq and Hash of the last record appended, 0 and "" if none.
+func (db *mysqlDB) AuditChainHead() (int64, string, error) {
+	var seq int64
+	var hash string
+	err := db.queryRow("auditChainHead", `SELECT seq, hash FROM audithead WHERE id = 1`).Scan(&seq, &hash)
+	return seq, hash, err
+}
+
+// Entity IDs are kept as ",1,2," so one can be found with LIKE '%,1,%'
+func joinAuditEntityIDs(ids []int64) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.FormatInt(id, 10)
+	}
+	return "," + strings.Join(s, ",") + ","
+}
+
+func splitAuditEntityIDs(s string) ([]int64, error) {
+	ids := []int64{}
+	for _, f := range strings.Split(strings.Trim(s, ","), ",") {
+		if "" == f {
+			continue
+		}
+		id, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+const auditColumns = `seq, recorded, actor, sourceip, requestid, action, method, path, entityids,
+    status, outcome, detail, prevhash, hash`
+
+// scanAuditRecord reads an AuditRecord from a sql.Row or sql.Rows
+func scanAuditRecord(s rowScanner) (*AuditRecord, error) {
+	var (
+		rec       AuditRecord
+		recorded  string
+		entityIDs string
+	)
+	if err := s.Scan(&rec.Seq, &recorded, &rec.Actor, &rec.SourceIP, &rec.RequestID, &rec.Action,
+		&rec.Method, &rec.Path, &entityIDs, &rec.Status, &rec.Outcome, &rec.Detail,
+		&rec.PrevHash, &rec.Hash); err != nil {
+		return nil, err
+	}
+	var err error
+	if rec.Date, err = time.Parse(auditTimeFormat, recorded); err != nil {
+		return nil, fmt.Errorf("mysql: audit record %d date: %v", rec.Seq, err)
+	}
+	if rec.EntityIDs, err = splitAuditEntityIDs(entityIDs); err != nil {
+		return nil, fmt.Errorf("mysql: audit record %d entity IDs: %v", rec.Seq, err)
+	}
+	return &rec, nil
+}
+
+// IterateAuditRecords calls fn for each record the filter selects, in Seq order.
+func (db *mysqlDB) IterateAuditRecords(ctx context.Context, f AuditFilter, fn func(*AuditRecord) error) error {
+	query := `SELECT ` + auditColumns + ` FROM auditlog WHERE seq > ?`
+	args := []interface{}{f.AfterSeq}
+	if "" != f.Actor {
+		query += ` AND actor = ?`
+		args = append(args, f.Actor)
+	}
+	if "" != f.Action {
+		query += ` AND action = ?`
+		args = append(args, f.Action)
+	}
+	if 0 != f.EntityID {
+		query += ` AND entityids LIKE ?`
+		args = append(args, fmt.Sprintf("%%,%d,%%", f.EntityID))
+	}
+	if !f.Since.IsZero() {
+		query += ` AND recorded >= ?`
+		args = append(args, f.Since.UTC().Format(auditTimeFormat))
+	}
+	if !f.Until.IsZero() {
+		query += ` AND recorded < ?`
+		args = append(args, f.Until.UTC().Format(auditTimeFormat))
+	}
+	query += ` ORDER BY seq`
+	if 0 < f.Limit {
+		query += ` LIMIT ?`
+		args = append(args, f.Limit)
+	}
+
+	rows, err := db.queryContext(ctx, "iterateAuditRecords", query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rec, err := scanAuditRecord(rows)
+		if err != nil {
+			return fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
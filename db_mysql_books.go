@@ -0,0 +1,212 @@
+// 2026.10.19 rjj: MySQL storage for AddressBooks, and the grants on them
+// Every entry has an address_book_id, and every statement on entries is conditional on it, the
+//	book comes from WithBook.  Import jobs remember their book, so the runner imports into it.
+
+package addressbook
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const createAddressBooksTableStatement = `CREATE TABLE IF NOT EXISTS addressbooks (
+				id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+				name VARCHAR(64) NOT NULL,
+				owner VARCHAR(255) NOT NULL,
+				createdDate datetime DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (id),
+				UNIQUE KEY (name)
+			);`
+
+// The default book is shared, the entries from before there were books are in it
+const initDefaultBookStatement = `INSERT IGNORE INTO addressbooks (id, name, owner) VALUES (1, 'default', '');`
+
+// WithBook returns the database confined to the book with id, sharing the connection and statements.
+func (db *mysqlDB) WithBook(id int64) AddressBookDatabase {
+	c := *db
+	c.book = id
+	return &c
+}
+
+func (db *mysqlDB) bookID() int64 {
+	if 0 == db.book {
+		return defaultBookID
+	}
+	return db.book
+}
+
+const addAddressBookStatement = `INSERT INTO addressbooks (name, owner) VALUES (?, ?)`
+
+// AddAddressBook saves a new book, assigning it an ID.
+func (db *mysqlDB) AddAddressBook(book *AddressBook) (int64, error) {
+	r, err := db.conn.Exec(addAddressBookStatement, book.Name, book.Owner)
+	if err != nil {
+		// MySQL error 1062 is "duplicate entry"
+		if mErr, ok := err.(*mysql.MySQLError); ok && 1062 == mErr.Number {
+			return 0, ErrAddressBookExists
+		}
+		return 0, fmt.Errorf("mysql: could not add address book: %v", err)
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not get last insert ID: %v", err)
+	}
+	return id, nil
+}
+
+const addressBookColumns = `id, name, owner, createdDate`
+
+// scanAddressBook reads an AddressBook from a sql.Row or sql.Rows
+func scanAddressBook(s rowScanner) (*AddressBook, error) {
+	var (
+		book        AddressBook
+		createdDate sql.NullString
+	)
+	if err := s.Scan(&book.ID, &book.Name, &book.Owner, &createdDate); err != nil {
+		return nil, err
+	}
+	book.CreatedDate, _ = time.Parse(mysqlDateTime, createdDate.String)
+	return &book, nil
+}
+
+// GetAddressBook finds a book by name, sql.ErrNoRows if there is none.
+func (db *mysqlDB) GetAddressBook(name string) (*AddressBook, error) {
+	return scanAddressBook(db.queryRow("getAddressBook", `SELECT `+addressBookColumns+` FROM addressbooks WHERE name = ?`, name))
+}
+
+// ListAddressBooks returns every book, by name.
+func (db *mysqlDB) ListAddressBooks() ([]*AddressBook, error) {
+	rows, err := db.query("listAddressBooks", `SELECT ` + addressBookColumns + ` FROM addressbooks ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []*AddressBook{}
+	for rows.Next() {
+		book, err := scanAddressBook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		books = append(books, book)
+	}
+	return books, rows.Err()
+}
+
+const createBookGrantsTableStatement = `CREATE TABLE IF NOT EXISTS bookgrants (
+				address_book_id INT UNSIGNED NOT NULL,
+				grantee VARCHAR(255) NOT NULL,
+				role VARCHAR(16) NOT NULL,
+				createdDate datetime DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (address_book_id, grantee),
+				KEY (grantee)
+			);`
+
+// sourceBookOwnersStatement and sourceBookGranteesStatement give each user:<subject> from
+//	before subjects had a source its source: an API key's name if there is a key of that name,
+//	otherwise a token's subject.  A client certificate's common name can not be told apart,
+//	it has to be granted again as user:cert:<cn>.
+const sourceBookOwnersStatement = `UPDATE addressbooks
+  SET owner = CONCAT('user:', IF(SUBSTRING(owner, 6) IN (SELECT name FROM apikeys), 'key:', 'oidc:'), SUBSTRING(owner, 6))
+  WHERE owner LIKE 'user:%' AND owner NOT LIKE 'user:key:%' AND owner NOT LIKE 'user:oidc:%' AND owner NOT LIKE 'user:cert:%'`
+
+const sourceBookGranteesStatement = `UPDATE bookgrants
+  SET grantee = CONCAT('user:', IF(SUBSTRING(grantee, 6) IN (SELECT name FROM apikeys), 'key:', 'oidc:'), SUBSTRING(grantee, 6))
+  WHERE grantee LIKE 'user:%' AND grantee NOT LIKE 'user:key:%' AND grantee NOT LIKE 'user:oidc:%' AND grantee NOT LIKE 'user:cert:%'`
+
+const setBookGrantStatement = `
+  INSERT INTO bookgrants (address_book_id, grantee, role) VALUES (?, ?, ?)
+  ON DUPLICATE KEY UPDATE role=VALUES(role)`
+
+// SetBookGrant gives grantee role on the book, replacing any role they had.
+func (db *mysqlDB) SetBookGrant(bookID int64, grantee string, role BookRole) error {
+	if _, err := db.conn.Exec(setBookGrantStatement, bookID, grantee, role); err != nil {
+		return fmt.Errorf("mysql: could not set grant: %v", err)
+	}
+	return nil
+}
+
+// DeleteBookGrant takes away grantee's role on the book, sql.ErrNoRows if they had none.
+func (db *mysqlDB) DeleteBookGrant(bookID int64, grantee string) error {
+	r, err := db.conn.Exec(`DELETE FROM bookgrants WHERE address_book_id = ? AND grantee = ?`, bookID, grantee)
+	if err != nil {
+		return fmt.Errorf("mysql: could not execute statement: %v", err)
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("mysql: could not get rows affected: %v", err)
+	}
+	if 0 == n {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListBookGrants returns the grants on the book, by grantee.
+func (db *mysqlDB) ListBookGrants(bookID int64) ([]*BookGrant, error) {
+	rows, err := db.query("listBookGrants", `SELECT grantee, role, createdDate FROM bookgrants
+  WHERE address_book_id = ? ORDER BY grantee`, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []*BookGrant{}
+	for rows.Next() {
+		var (
+			grant       BookGrant
+			createdDate sql.NullString
+		)
+		if err := rows.Scan(&grant.Grantee, &grant.Role, &createdDate); err != nil {
+			return nil, fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		grant.CreatedDate, _ = time.Parse(mysqlDateTime, createdDate.String)
+		grants = append(grants, &grant)
+	}
+	return grants, rows.Err()
+}
+
+// BookRoles returns, for each book with a grant to any of grantees, the highest role granted.
+func (db *mysqlDB) BookRoles(grantees []string) (map[int64]BookRole, error) {
+	roles := map[int64]BookRole{}
+	if 0 == len(grantees) {
+		return roles, nil
+	}
+	args := make([]interface{}, len(grantees))
+	for i, g := range grantees {
+		args[i] = g
+	}
+	rows, err := db.query("bookRoles", `SELECT address_book_id, role FROM bookgrants WHERE grantee IN (?`+
+		strings.Repeat(`, ?`, len(grantees)-1)+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id   int64
+			role BookRole
+		)
+		if err := rows.Scan(&id, &role); err != nil {
+			return nil, fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		// A user can be granted one role, and their team another
+		if !roles[id].covers(role) {
+			roles[id] = role
+		}
+	}
+	return roles, rows.Err()
+}
+
+// An entry can only be upserted by ID into its own book, this finds one that is elsewhere
+const entryBookStatement = `SELECT address_book_id FROM addressbookentries WHERE id = ? FOR UPDATE`
+
+// The default book stays, it is not created by a test
+const truncateBooksStatement = `DELETE FROM addressbooks WHERE id <> 1`
+
+const truncateBookGrantsStatement = `TRUNCATE TABLE bookgrants`
@@ -0,0 +1,172 @@
+// 2026.10.18 rjj: MySQL storage for ImportJobs
+// The status column is the lock: a job is only ever moved out of a status by an UPDATE
+//	conditional on that status, so two workers (or a worker and a cancel) can not both win.
+
+package addressbook
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const createImportJobsTableStatement = `CREATE TABLE IF NOT EXISTS importjobs (
+				id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+				status VARCHAR(16) NOT NULL,
+				format VARCHAR(255) NOT NULL,
+				mode VARCHAR(16) NOT NULL,
+				atomic BOOLEAN NOT NULL,
+				path TEXT NOT NULL,
+				processed INT NOT NULL DEFAULT 0,
+				inserted INT NOT NULL DEFAULT 0,
+				updated INT NOT NULL DEFAULT 0,
+				failed INT NOT NULL DEFAULT 0,
+				messages MEDIUMTEXT NULL,
+				createdDate datetime DEFAULT CURRENT_TIMESTAMP,
+				updatedDate datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+				PRIMARY KEY (id),
+				KEY (status)
+			);`
+
+// mysqlDateTime is how a datetime column reads back without parseTime in the DSN
+const mysqlDateTime = "2006-01-02 15:04:05"
+
+func (db *mysqlDB) prepareImportJobStatements() (err error) {
+	if db.addImportJob, err = db.prepare("addImportJob", addImportJobStatement); err != nil {
+		return fmt.Errorf("mysql: prepare add import job: %v", err)
+	}
+	if db.getImportJob, err = db.prepare("getImportJob", getImportJobStatement); err != nil {
+		return fmt.Errorf("mysql: prepare get import job: %v", err)
+	}
+	if db.listImportJobs, err = db.prepare("listImportJobs", listImportJobsStatement); err != nil {
+		return fmt.Errorf("mysql: prepare list import jobs: %v", err)
+	}
+	if db.transitionImportJob, err = db.prepare("transitionImportJob", transitionImportJobStatement); err != nil {
+		return fmt.Errorf("mysql: prepare transition import job: %v", err)
+	}
+	if db.saveImportJob, err = db.prepare("saveImportJob", saveImportJobStatement); err != nil {
+		return fmt.Errorf("mysql: prepare save import job: %v", err)
+	}
+	return nil
+}
+
+const importJobColumns = `id, status, format, mode, atomic, path, actor, address_book_id, processed, inserted, updated, failed,
+    messages, createdDate, updatedDate`
+
+// scanImportJob reads an ImportJob from a sql.Row or sql.Rows
+func scanImportJob(s rowScanner) (*ImportJob, error) {
+	var (
+		job         ImportJob
+		messages    sql.NullString
+		createdDate sql.NullString
+		updatedDate sql.NullString
+	)
+	if err := s.Scan(&job.ID, &job.Status, &job.Format, &job.Mode, &job.Atomic, &job.Path, &job.Actor, &job.BookID,
+		&job.Processed, &job.Inserted, &job.Updated, &job.Failed,
+		&messages, &createdDate, &updatedDate); err != nil {
+		return nil, err
+	}
+
+	job.Messages = []string{}
+	if "" != messages.String {
+		if err := json.Unmarshal([]byte(messages.String), &job.Messages); err != nil {
+			return nil, fmt.Errorf("mysql: import job %d messages: %v", job.ID, err)
+		}
+	}
+	job.CreatedDate, _ = time.Parse(mysqlDateTime, createdDate.String)
+	job.UpdatedDate, _ = time.Parse(mysqlDateTime, updatedDate.String)
+	return &job, nil
+}
+
+const addImportJobStatement = `
+  INSERT INTO importjobs (
+    status, format, mode, atomic, path, actor, address_book_id
+  ) VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+// AddImportJob saves a new ImportJob, assigning it a new ID.
+func (db *mysqlDB) AddImportJob(job *ImportJob) (id int64, err error) {
+	r, err := execAffectingOneRow(db.addImportJob, job.Status, job.Format, job.Mode, job.Atomic, job.Path, job.Actor, job.BookID)
+	if err != nil {
+		return 0, err
+	}
+
+	lastInsertID, err := r.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not get last insert ID: %v", err)
+	}
+	return lastInsertID, nil
+}
+
+const getImportJobStatement = `SELECT ` + importJobColumns + ` FROM importjobs WHERE id = ?`
+
+// GetImportJob retrieves an ImportJob by its ID, sql.ErrNoRows if there is none.
+func (db *mysqlDB) GetImportJob(id int64) (*ImportJob, error) {
+	return scanImportJob(db.getImportJob.QueryRow(id))
+}
+
+const listImportJobsStatement = `SELECT ` + importJobColumns + ` FROM importjobs WHERE status = ? ORDER BY id`
+
+// ListImportJobs returns the ImportJobs with the given status, oldest first.
+func (db *mysqlDB) ListImportJobs(status ImportJobStatus) ([]*ImportJob, error) {
+	rows, err := db.listImportJobs.Query(status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []*ImportJob{}
+	for rows.Next() {
+		job, err := scanImportJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+const transitionImportJobStatement = `UPDATE importjobs SET status = ? WHERE id = ? AND status = ?`
+
+// TransitionImportJob moves an ImportJob from one status to another, if it is still in from.
+func (db *mysqlDB) TransitionImportJob(id int64, from, to ImportJobStatus) (bool, error) {
+	return execAffectingAtMostOneRow(db.transitionImportJob, to, id, from)
+}
+
+const saveImportJobStatement = `
+  UPDATE importjobs
+  SET status=?, processed=?, inserted=?, updated=?, failed=?, messages=?, updatedDate=CURRENT_TIMESTAMP
+  WHERE id = ? AND status = 'running'`
+
+// SaveImportJob saves the progress of a running ImportJob.
+func (db *mysqlDB) SaveImportJob(job *ImportJob) (bool, error) {
+	messages, err := json.Marshal(job.Messages)
+	if err != nil {
+		return false, fmt.Errorf("mysql: import job %d messages: %v", job.ID, err)
+	}
+	saved, err := execAffectingAtMostOneRow(db.saveImportJob,
+		job.Status, job.Processed, job.Inserted, job.Updated, job.Failed, string(messages), job.ID)
+	if saved || err != nil {
+		return saved, err
+	}
+
+	// MySQL reports 0 rows affected when nothing changed, so check it really is no longer running
+	current, err := db.GetImportJob(job.ID)
+	if err != nil {
+		return false, err
+	}
+	return ImportJobRunning == current.Status, nil
+}
+
+// execAffectingAtMostOneRow executes a conditional update, reporting whether its row matched.
+func execAffectingAtMostOneRow(stmt *timedStmt, args ...interface{}) (bool, error) {
+	r, err := stmt.Exec(args...)
+	if err != nil {
+		return false, fmt.Errorf("mysql: could not execute statement: %v", err)
+	}
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("mysql: could not get rows affected: %v", err)
+	}
+	return 1 == rowsAffected, nil
+}
@@ -0,0 +1,140 @@
+// 2026.10.19 rjj: MySQL metrics
+// Every prepared statement is a timedStmt, which times each use by the statement's name, and
+//	counts its errors.  Inside a transaction, use db.x.in(tx) rather than tx.Stmt(db.x), so the
+//	statement is still timed, and is not tried again, see db_mysql_resilience.go.  The pool's
+//	stats, and how many entries there are, are read from the database as they are scraped.
+//	See metrics.go.
+
+package addressbook
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// timedStmt is a prepared statement, with its name for the metrics
+type timedStmt struct {
+	*sql.Stmt
+	name string
+	// read is set for a read outside a transaction, which is tried again after a transient error
+	read bool
+}
+
+// prepare prepares query as the statement name
+func (db *mysqlDB) prepare(name, query string) (*timedStmt, error) {
+	s, err := db.conn.Prepare(query)
+	if nil != err {
+		return nil, err
+	}
+	return &timedStmt{Stmt: s, name: name, read: isRead(query)}, nil
+}
+
+// in is the statement within tx
+func (s *timedStmt) in(tx *sql.Tx) *timedStmt {
+	return &timedStmt{Stmt: tx.Stmt(s.Stmt), name: s.name}
+}
+
+// observe records a use of s that started at start.  sql.ErrNoRows is an answer, not an error.
+func (s *timedStmt) observe(start time.Time, err error) {
+	dbStatementDuration.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+	if nil != err && !errors.Is(err, sql.ErrNoRows) {
+		dbErrors.WithLabelValues(s.name).Inc()
+	}
+}
+
+// retry runs use, and again if s is a read, see retryRead
+func (s *timedStmt) retry(ctx context.Context, use func() error) error {
+	if !s.read {
+		return use()
+	}
+	return retryRead(ctx, s.name, use)
+}
+
+func (s *timedStmt) Exec(args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	r, err := s.Stmt.Exec(args...)
+	s.observe(start, err)
+	return r, err
+}
+
+// Query is timed until the first row is ready, not until the last is read
+func (s *timedStmt) Query(args ...interface{}) (*sql.Rows, error) {
+	return s.QueryContext(context.Background(), args...)
+}
+
+func (s *timedStmt) QueryContext(ctx context.Context, args ...interface{}) (rows *sql.Rows, err error) {
+	err = s.retry(ctx, func() error {
+		start := time.Now()
+		rows, err = s.Stmt.QueryContext(ctx, args...)
+		s.observe(start, err)
+		return err
+	})
+	return rows, err
+}
+
+func (s *timedStmt) QueryRow(args ...interface{}) (row *sql.Row) {
+	s.retry(context.Background(), func() error {
+		start := time.Now()
+		row = s.Stmt.QueryRow(args...)
+		s.observe(start, row.Err())
+		return row.Err()
+	})
+	return row
+}
+
+// mysqlCollector has the pool's stats, and counts the entries, each time it is scraped
+type mysqlCollector struct {
+	conn    *sql.DB
+	pool    prometheus.Collector
+	entries *prometheus.Desc
+}
+
+func newMySQLCollector(conn *sql.DB, schema string) *mysqlCollector {
+	return &mysqlCollector{
+		conn: conn,
+		pool: collectors.NewDBStatsCollector(conn, schema),
+		entries: prometheus.NewDesc("addressbook_entries",
+			"Address book entries, in every book, live or in the trash.", []string{"state"}, nil),
+	}
+}
+
+func (c *mysqlCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.pool.Describe(ch)
+	ch <- c.entries
+}
+
+func (c *mysqlCollector) Collect(ch chan<- prometheus.Metric) {
+	c.pool.Collect(ch)
+
+	var live, trash float64
+	err := c.conn.QueryRow(`SELECT COUNT(*) - COUNT(deleted_at), COUNT(deleted_at) FROM addressbookentries`).Scan(&live, &trash)
+	if nil != err {
+		// The rest of the scrape is still worth having
+		slog.Error("mysqlCollector:: could not count the entries", "err", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, live, "live")
+	ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, trash, "trash")
+}
+
+// registerMySQLCollector registers conn's collector, in place of an earlier database's
+func registerMySQLCollector(conn *sql.DB, schema string) error {
+	c := newMySQLCollector(conn, schema)
+	err := prometheus.Register(c)
+	var already prometheus.AlreadyRegisteredError
+	if errors.As(err, &already) {
+		prometheus.Unregister(already.ExistingCollector)
+		err = prometheus.Register(c)
+	}
+	if nil != err {
+		return fmt.Errorf("mysql: could not register metrics: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// 2026.10.18 rjj: Schema migrations
+// createTableStatement is the schema as first released, version 0.  Every change since is a
+//	migration, applied in order and recorded in the schemaversion table, so an existing database
+//	is brought up to date on start-up the same way a new one is built.
+// Never edit a released migration, add a new one.
+
+package addressbook
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// migrations[i] takes the schema from version i to version i+1
+var migrations = []string{
+	// 1: Import jobs
+	createImportJobsTableStatement,
+
+	// 2: Redirects for merged entries
+	`CREATE TABLE IF NOT EXISTS addressbookredirects (
+				id INT UNSIGNED NOT NULL,
+				survivorid INT UNSIGNED NOT NULL,
+				createdDate datetime DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (id),
+				KEY (survivorid)
+			);`,
+
+	// 3: Soft delete
+	`ALTER TABLE addressbookentries
+				ADD COLUMN deleted_at datetime NULL DEFAULT NULL,
+				ADD KEY (deleted_at);`,
+
+	// 4: Revision history
+	createRevisionsTableStatement,
+
+	// 5: Who started an import job, for the history of what it imports
+	`ALTER TABLE importjobs
+				ADD COLUMN actor VARCHAR(255) NOT NULL DEFAULT '';`,
+
+	// 6-8: Audit log, and the head of its hash chain
+	createAuditLogTableStatement,
+	createAuditHeadTableStatement,
+	initAuditHeadStatement,
+
+	// 9: API keys
+	createAPIKeysTableStatement,
+
+	// 10-11: Address books, and the default one the existing entries are in
+	createAddressBooksTableStatement,
+	initDefaultBookStatement,
+
+	// 12-13: The book of each entry, and of each import job
+	`ALTER TABLE addressbookentries
+				ADD COLUMN address_book_id INT UNSIGNED NOT NULL DEFAULT 1,
+				ADD KEY (address_book_id, deleted_at);`,
+	`ALTER TABLE importjobs
+				ADD COLUMN address_book_id INT UNSIGNED NOT NULL DEFAULT 1;`,
+
+	// 14: Sharing address books
+	createBookGrantsTableStatement,
+
+	// 15: A baseline revision for the entries from before the history
+	backfillRevisionsStatement,
+
+	// 16-17: The source of each user's subject, user:bob is user:key:bob or user:oidc:bob
+	sourceBookOwnersStatement,
+	sourceBookGranteesStatement,
+}
+
+// currentSchemaVersion is the version of the schema this code expects
+var currentSchemaVersion = len(migrations)
+
+const createSchemaVersionTableStatement = `CREATE TABLE IF NOT EXISTS schemaversion (
+				version INT NOT NULL
+			);`
+
+// readSchemaVersion returns the version the database is at, 0 if it has never been migrated.
+func readSchemaVersion(conn *sql.DB) (int, error) {
+	var version int
+	err := conn.QueryRow(`SELECT version FROM schemaversion`).Scan(&version)
+	if sql.ErrNoRows == err {
+		return 0, nil
+	}
+	return version, err
+}
+
+// CheckHealth pings the database, and checks it has had every migration.  A newer version is
+//	fine, it is an instance of newer code that has migrated it.
+func (db *mysqlDB) CheckHealth(ctx context.Context) error {
+	if err := db.conn.PingContext(ctx); err != nil {
+		return fmt.Errorf("mysql: ping failed: %v", err)
+	}
+	version, err := readSchemaVersion(db.conn)
+	if err != nil {
+		return fmt.Errorf("mysql: could not read schema version: %v", err)
+	}
+	if version < currentSchemaVersion {
+		return fmt.Errorf("mysql: schema version %d is older than this code (%d)", version, currentSchemaVersion)
+	}
+	return nil
+}
+
+// alreadyMigrated reports the errors from re-running an ALTER that was applied before a crash:
+//	MySQL error 1060 is "duplicate column name", 1061 is "duplicate key name"
+func alreadyMigrated(err error) bool {
+	mErr, ok := err.(*mysql.MySQLError)
+	return ok && (1060 == mErr.Number || 1061 == mErr.Number)
+}
+
+// migrateSchema applies the migrations the database has not had yet.
+//	conn must have the schema selected, i.e. be opened with it in the DSN.
+// Note: MySQL DDL implicitly commits, so a migration can not share a transaction with its
+//	version update.  A crash between the two re-runs the migration, so keep them re-runnable:
+//	CREATE ... IF NOT EXISTS, and ALTERs whose only re-run error is alreadyMigrated.
+func migrateSchema(conn *sql.DB) error {
+	if _, err := conn.Exec(createSchemaVersionTableStatement); err != nil {
+		return fmt.Errorf("mysql: could not create schemaversion: %v", err)
+	}
+	version, err := readSchemaVersion(conn)
+	if err != nil {
+		return fmt.Errorf("mysql: could not read schema version: %v", err)
+	}
+	if 0 == version {
+		if _, err := conn.Exec(`INSERT INTO schemaversion (version) SELECT 0 FROM DUAL
+				WHERE NOT EXISTS (SELECT * FROM schemaversion)`); err != nil {
+			return fmt.Errorf("mysql: could not initialize schema version: %v", err)
+		}
+	}
+	if version > currentSchemaVersion {
+		return fmt.Errorf("mysql: schema version %d is newer than this code (%d)", version, currentSchemaVersion)
+	}
+
+	for ; version < currentSchemaVersion; version++ {
+		slog.Info("mysql: migrating schema", "version", version+1)
+		if _, err := conn.Exec(migrations[version]); err != nil && !alreadyMigrated(err) {
+			return fmt.Errorf("mysql: migration %d failed: %v", version+1, err)
+		}
+		if _, err := conn.Exec(`UPDATE schemaversion SET version = ?`, version+1); err != nil {
+			return fmt.Errorf("mysql: could not record schema version %d: %v", version+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+// 2026.10.19 rjj: MySQL resilience
+// The pool is sized, and its connections replaced, as a PoolConfig says.  Connections are made
+//	through a circuit breaker: after breakerThreshold failures in a row it opens, and for
+//	breakerCooldown each new connection fails at once with ErrDatabaseUnavailable, rather than
+//	every request waiting on a database that is down.  Then one connection is let through to
+//	try it, if it is made the breaker closes, if not it is open another breakerCooldown.
+// Reads outside a transaction are tried again after a transient error: a connection that went
+//	bad, a deadlock or a lock wait timeout.  Writes are not, nor is anything in a transaction,
+//	a transaction that deadlocked has been rolled back, and is the caller's to run again.
+
+package addressbook
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// PoolConfig sizes the pool of connections to the database.
+type PoolConfig struct {
+	// MaxOpenConns is the most connections open at once, defaults to 25, negative is no limit
+	MaxOpenConns int
+	// MaxIdleConns is the most kept open while idle, defaults to MaxOpenConns, negative is none
+	MaxIdleConns int
+	// ConnMaxLifetime is how long a connection is used before it is replaced, defaults to 5m,
+	//	well within MySQL's wait_timeout.  Negative keeps them for ever.
+	ConnMaxLifetime time.Duration
+}
+
+// Pool defaults
+const (
+	defaultMaxOpenConns    = 25
+	defaultConnMaxLifetime = 5 * time.Minute
+	// dialTimeout is how long making a connection may take
+	dialTimeout = 5 * time.Second
+)
+
+// apply sizes conn's pool
+func (p PoolConfig) apply(conn *sql.DB) {
+	maxOpen, maxIdle, lifetime := p.MaxOpenConns, p.MaxIdleConns, p.ConnMaxLifetime
+	if 0 == maxOpen {
+		maxOpen = defaultMaxOpenConns
+	}
+	if 0 == maxIdle {
+		maxIdle = maxOpen
+		if 0 > maxOpen {
+			// No limit open, but not so many idle
+			maxIdle = defaultMaxOpenConns
+		}
+	}
+	if 0 == lifetime {
+		lifetime = defaultConnMaxLifetime
+	}
+	// database/sql has 0 and below as no limit open, none idle, and for ever
+	conn.SetMaxOpenConns(maxOpen)
+	conn.SetMaxIdleConns(maxIdle)
+	conn.SetConnMaxLifetime(max(lifetime, 0))
+}
+
+// **************** Circuit breaker ****************
+
+// ErrDatabaseUnavailable is a connection the circuit breaker did not try, the database is down
+var ErrDatabaseUnavailable = errors.New("mysql: the database is unavailable, not trying it again yet")
+
+// Circuit breaker settings
+const (
+	breakerThreshold = 5
+	breakerCooldown  = 10 * time.Second
+)
+
+// circuitBreaker counts failures in a row, see above
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	// trying is set while the one connection let through is being made
+	trying bool
+}
+
+func (b *circuitBreaker) open() bool {
+	return breakerThreshold <= b.failures
+}
+
+// allow says whether to try a connection, ErrDatabaseUnavailable if not
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open() {
+		return nil
+	}
+	if b.trying || time.Now().Before(b.openUntil) {
+		return ErrDatabaseUnavailable
+	}
+	b.trying = true
+	return nil
+}
+
+// record is how a connection allow let through went, nil if it was made
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trying = false
+	if nil == err {
+		if b.open() {
+			slog.Info("circuitBreaker:: the database is back, closed")
+			dbCircuitOpen.Set(0)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if !b.open() {
+		return
+	}
+	if breakerThreshold == b.failures {
+		slog.Error("circuitBreaker:: the database is down, open", "failures", b.failures, "err", err)
+		dbCircuitOpen.Set(1)
+	}
+	b.openUntil = time.Now().Add(breakerCooldown)
+}
+
+// abandon is a connection allow let through that its caller gave up on, which says nothing
+//	about the database
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trying = false
+}
+
+// available is false while the breaker is open, until it is time to try again
+func (b *circuitBreaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.open() || !time.Now().Before(b.openUntil)
+}
+
+// breakerConnector makes connections through the breaker
+type breakerConnector struct {
+	driver.Connector
+	breaker *circuitBreaker
+}
+
+func (c *breakerConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if err := c.breaker.allow(); nil != err {
+		return nil, err
+	}
+	conn, err := c.Connector.Connect(ctx)
+	if nil != err && nil != ctx.Err() {
+		c.breaker.abandon()
+	} else {
+		c.breaker.record(err)
+	}
+	return conn, err
+}
+
+// connector connects as config says, through breaker
+func (config MySQLConfig) connector(breaker *circuitBreaker) (driver.Connector, error) {
+	cfg, err := mysql.ParseDSN(config.dataStoreName())
+	if err != nil {
+		return nil, err
+	}
+	if 0 == cfg.Timeout {
+		cfg.Timeout = dialTimeout
+	}
+	c, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &breakerConnector{Connector: c, breaker: breaker}, nil
+}
+
+// Available is false while the circuit breaker is open
+func (db *mysqlDB) Available() bool {
+	return db.breaker.available()
+}
+
+// **************** Retries ****************
+
+// How many times a read is tried, and how long after the first try the second is
+const (
+	readAttempts   = 3
+	readRetryDelay = 50 * time.Millisecond
+	readRetryMax   = time.Second
+)
+
+// transient reports the errors a read is worth trying again after
+func transient(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) {
+		return true
+	}
+	var mErr *mysql.MySQLError
+	// 1213 is a deadlock, 1205 a lock wait timeout
+	return errors.As(err, &mErr) && (1213 == mErr.Number || 1205 == mErr.Number)
+}
+
+// backoff is how long to wait before try attempt+1: first, doubling each time up to most,
+//	less up to half of it at random, so those waiting do not all try again at once
+func backoff(attempt int, first, most time.Duration) time.Duration {
+	d := first
+	for i := 1; i < attempt && d < most; i++ {
+		d *= 2
+	}
+	d = min(d, most)
+	return d - time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryRead runs read, the statement name, and again while it fails with a transient error
+func retryRead(ctx context.Context, name string, read func() error) error {
+	err := read()
+	for attempt := 1; attempt < readAttempts && transient(err); attempt++ {
+		slog.Warn("retryRead:: trying again", "statement", name, "attempt", attempt+1, "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff(attempt, readRetryDelay, readRetryMax)):
+		}
+		dbRetries.WithLabelValues(name).Inc()
+		err = read()
+	}
+	return err
+}
+
+// isRead reports whether query only reads, so may be run again
+func isRead(query string) bool {
+	q := strings.ToUpper(strings.TrimSpace(query))
+	return strings.HasPrefix(q, "SELECT") && !strings.Contains(q, "FOR UPDATE")
+}
+
+// query, queryContext and queryRow are for reads that are not prepared, tried again as name
+func (db *mysqlDB) query(name, query string, args ...interface{}) (*sql.Rows, error) {
+	return db.queryContext(context.Background(), name, query, args...)
+}
+
+func (db *mysqlDB) queryContext(ctx context.Context, name, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	err = retryRead(ctx, name, func() error {
+		rows, err = db.conn.QueryContext(ctx, query, args...)
+		return err
+	})
+	return rows, err
+}
+
+func (db *mysqlDB) queryRow(name, query string, args ...interface{}) (row *sql.Row) {
+	retryRead(context.Background(), name, func() error {
+		row = db.conn.QueryRow(query, args...)
+		return row.Err()
+	})
+	return row
+}
@@ -0,0 +1,237 @@
+// 2026.10.19 rjj: MySQL resilience, without MySQL
+// The circuit breaker, and which errors and statements are tried again, are checked here on
+//	their own, the integration tests in app/ need a database that is up.
+
+package addressbook
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// downConnector fails every connection with err, or makes none if err is nil
+type downConnector struct {
+	tries atomic.Int32
+	err   error
+}
+
+func (c *downConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.tries.Add(1)
+	return nil, c.err
+}
+
+func (c *downConnector) Driver() driver.Driver {
+	return nil
+}
+
+// The breaker opens after breakerThreshold failures, and then does not try the database at all
+func TestCircuitBreakerOpens(t *testing.T) {
+	b := &circuitBreaker{}
+	down := &downConnector{err: errors.New("dial tcp: connection refused")}
+	c := &breakerConnector{Connector: down, breaker: b}
+
+	for i := 1; breakerThreshold >= i; i++ {
+		if _, err := c.Connect(context.Background()); errors.Is(err, ErrDatabaseUnavailable) {
+			t.Fatalf("Expected try %d to reach the database, got %v", i, err)
+		}
+	}
+	if b.available() {
+		t.Errorf("Expected the breaker to be open after %d failures", breakerThreshold)
+	}
+	if 1 != testutil.ToFloat64(dbCircuitOpen) {
+		t.Errorf("Expected addressbook_db_circuit_open to be 1")
+	}
+	for i := 0; 3 > i; i++ {
+		if _, err := c.Connect(context.Background()); !errors.Is(err, ErrDatabaseUnavailable) {
+			t.Errorf("Expected ErrDatabaseUnavailable while open, got %v", err)
+		}
+	}
+	if breakerThreshold != int(down.tries.Load()) {
+		t.Errorf("Expected %d tries of the database, got %d", breakerThreshold, down.tries.Load())
+	}
+}
+
+// Fewer failures than breakerThreshold, or a success between them, leave it closed
+func TestCircuitBreakerCloses(t *testing.T) {
+	b := &circuitBreaker{}
+	failed := errors.New("dial tcp: connection refused")
+	for i := 1; breakerThreshold > i; i++ {
+		b.record(failed)
+	}
+	b.record(nil)
+	b.record(failed)
+	if !b.available() || nil != b.allow() {
+		t.Errorf("Expected the breaker to be closed, with %d failures in a row", b.failures)
+	}
+}
+
+// Once the cooldown is over, one connection, and only one, is let through to try the database
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	b := &circuitBreaker{}
+	for i := 0; breakerThreshold > i; i++ {
+		b.record(errors.New("dial tcp: connection refused"))
+	}
+	b.openUntil = time.Now().Add(-time.Millisecond)
+	if !b.available() {
+		t.Errorf("Expected the breaker to be available once the cooldown is over")
+	}
+
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; 20 > i; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if nil == b.allow() {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if 1 != allowed.Load() {
+		t.Fatalf("Expected a single probe to be let through, got %d", allowed.Load())
+	}
+
+	// A probe that fails opens it for another cooldown
+	b.record(errors.New("dial tcp: connection refused"))
+	if b.available() || !errors.Is(b.allow(), ErrDatabaseUnavailable) {
+		t.Errorf("Expected the failed probe to open the breaker again")
+	}
+
+	// A probe that is made closes it
+	b.openUntil = time.Now().Add(-time.Millisecond)
+	if err := b.allow(); nil != err {
+		t.Fatalf("Expected a probe after the cooldown, got %v", err)
+	}
+	b.record(nil)
+	if 0 != b.failures || nil != b.allow() || nil != b.allow() {
+		t.Errorf("Expected the breaker to be closed after the probe was made")
+	}
+	if 0 != testutil.ToFloat64(dbCircuitOpen) {
+		t.Errorf("Expected addressbook_db_circuit_open to be 0")
+	}
+}
+
+// A probe its caller gave up on says nothing about the database, the next one is let through
+func TestCircuitBreakerAbandon(t *testing.T) {
+	b := &circuitBreaker{}
+	for i := 0; breakerThreshold > i; i++ {
+		b.record(errors.New("dial tcp: connection refused"))
+	}
+	b.openUntil = time.Now().Add(-time.Millisecond)
+	down := &downConnector{err: context.Canceled}
+	c := &breakerConnector{Connector: down, breaker: b}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Connect(ctx)
+	if err := b.allow(); nil != err {
+		t.Errorf("Expected another probe after an abandoned one, got %v", err)
+	}
+}
+
+func TestTransient(t *testing.T) {
+	for err, want := range map[error]bool{
+		driver.ErrBadConn:                        true,
+		fmt.Errorf("get: %w", driver.ErrBadConn): true,
+		mysql.ErrInvalidConn:                     true,
+		&mysql.MySQLError{Number: 1213}:          true,
+		&mysql.MySQLError{Number: 1205}:          true,
+		&mysql.MySQLError{Number: 1062}:          false,
+		&mysql.MySQLError{Number: 1146}:          false,
+		sql.ErrNoRows:                            false,
+		ErrDatabaseUnavailable:                   false,
+		context.DeadlineExceeded:                 false,
+	} {
+		if want != transient(err) {
+			t.Errorf("Expected transient(%v) to be %v", err, want)
+		}
+	}
+}
+
+// backoff doubles up to most, less up to half at random
+func TestBackoff(t *testing.T) {
+	first, most := 100*time.Millisecond, time.Second
+	for attempt, full := range map[int]time.Duration{
+		1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond,
+		4: 800 * time.Millisecond, 5: time.Second, 50: time.Second,
+	} {
+		for i := 0; 100 > i; i++ {
+			if d := backoff(attempt, first, most); d < full/2 || d > full {
+				t.Fatalf("Expected backoff(%d) within [%v, %v], got %v", attempt, full/2, full, d)
+			}
+		}
+	}
+}
+
+func TestRetryRead(t *testing.T) {
+	retries := testutil.ToFloat64(dbRetries.WithLabelValues("test"))
+	for name, c := range map[string]struct {
+		errs  []error
+		tries int
+		err   error
+	}{
+		"deadlock":          {[]error{&mysql.MySQLError{Number: 1213}}, 2, nil},
+		"lock wait timeout": {[]error{&mysql.MySQLError{Number: 1205}}, 2, nil},
+		"bad connection":    {[]error{driver.ErrBadConn, driver.ErrBadConn}, 3, nil},
+		"gives up":          {[]error{driver.ErrBadConn, driver.ErrBadConn, driver.ErrBadConn}, readAttempts, driver.ErrBadConn},
+		"not transient":     {[]error{sql.ErrNoRows}, 1, sql.ErrNoRows},
+		"duplicate key":     {[]error{&mysql.MySQLError{Number: 1062}}, 1, &mysql.MySQLError{Number: 1062}},
+	} {
+		tries := 0
+		err := retryRead(context.Background(), "test", func() error {
+			tries++
+			if tries <= len(c.errs) {
+				return c.errs[tries-1]
+			}
+			return nil
+		})
+		if c.tries != tries || fmt.Sprint(c.err) != fmt.Sprint(err) {
+			t.Errorf("%s: expected %d tries and %v, got %d and %v", name, c.tries, c.err, tries, err)
+		}
+	}
+	if got := testutil.ToFloat64(dbRetries.WithLabelValues("test")) - retries; 1+1+2+2 != got {
+		t.Errorf("Expected 6 retries counted, got %v", got)
+	}
+
+	// A caller that has given up is not kept waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tries := 0
+	retryRead(ctx, "test", func() error { tries++; return driver.ErrBadConn })
+	if 1 != tries {
+		t.Errorf("Expected a cancelled read to be tried once, got %d", tries)
+	}
+}
+
+// Writes and locking reads are never tried again, a prepared read outside a transaction is
+func TestRetryOnlyReads(t *testing.T) {
+	for query, want := range map[string]bool{
+		listStatement:                    true,
+		getStatement:                     true,
+		"  select 1":                     true,
+		getForUpdateStatement:            false,
+		insertStatement:                  false,
+		updateStatement:                  false,
+		"DELETE FROM addressbookentries": false,
+	} {
+		if want != isRead(query) {
+			t.Errorf("Expected isRead to be %v for %.40q", want, query)
+		}
+		tries := 0
+		s := &timedStmt{name: "test", read: isRead(query)}
+		s.retry(context.Background(), func() error { tries++; return &mysql.MySQLError{Number: 1213} })
+		if want != (1 < tries) {
+			t.Errorf("Expected %.40q to be tried again %v, tried %d times", query, want, tries)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// 2026.10.18 rjj: MySQL storage for Revisions
+// Revisions are written in the same transaction as the change they record, with the entry
+//	row locked, so an entry's revisions can not race each other for the next rev number.
+
+package addressbook
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const createRevisionsTableStatement = `CREATE TABLE IF NOT EXISTS addressbookrevisions (
+				entryid INT UNSIGNED NOT NULL,
+				rev INT UNSIGNED NOT NULL,
+				createdDate datetime DEFAULT CURRENT_TIMESTAMP,
+				actor VARCHAR(255) NOT NULL,
+				action VARCHAR(16) NOT NULL,
+				snapshot TEXT NOT NULL,
+				diff TEXT NOT NULL,
+				PRIMARY KEY (entryid, rev)
+			);`
+
+// WithActor returns the database as used by actor, sharing the connection and statements.
+func (db *mysqlDB) WithActor(actor string) AddressBookDatabase {
+	c := *db
+	c.actor = actor
+	return &c
+}
+
+func (db *mysqlDB) actorName() string {
+	if "" == db.actor {
+		return systemActor
+	}
+	return db.actor
+}
+
+const nextRevStatement = `SELECT COALESCE(MAX(rev), 0) + 1 FROM addressbookrevisions WHERE entryid = ?`
+
+const addRevisionStatement = `
+  INSERT INTO addressbookrevisions (
+    entryid, rev, actor, action, snapshot, diff
+  ) VALUES (?, ?, ?, ?, ?, ?)`
+
+// backfillRevisionsStatement gives each entry without a history a baseline revision, as it is.
+//	The snapshot has the fields revisionSnapshot keeps, and nothing changed.
+const backfillRevisionsStatement = `
+  INSERT INTO addressbookrevisions (entryid, rev, createdDate, actor, action, snapshot, diff)
+  SELECT e.id, 1, COALESCE(e.createdDate, CURRENT_TIMESTAMP), '` + systemActor + `', '` + string(RevisionBaseline) + `',
+    JSON_OBJECT('id', e.id, 'firstname', COALESCE(e.firstname, ''), 'lastname', COALESCE(e.lastname, ''),
+      'email', COALESCE(e.email, ''), 'phone', COALESCE(e.phone, '')),
+    '{}'
+  FROM addressbookentries e
+  WHERE NOT EXISTS (SELECT 1 FROM addressbookrevisions r WHERE r.entryid = e.id);`
+
+// writeRevision appends a Revision for the entry, before is nil if it was just created.
+//	The entry must be locked by tx, e.g. by lockAddressBookEntry.  An existing entry without
+//	a history, e.g. one written around this code, gets a baseline revision of before first.
+func (db *mysqlDB) writeRevision(tx *sql.Tx, action RevisionAction, before, after *AddressBookEntry) error {
+	var rev int
+	if err := db.nextRev.in(tx).QueryRow(after.ID).Scan(&rev); err != nil {
+		return fmt.Errorf("mysql: could not number revision: %v", err)
+	}
+	if 1 == rev && nil != before {
+		if err := db.insertRevision(tx, after.ID, rev, systemActor, RevisionBaseline, before, map[string]FieldChange{}); err != nil {
+			return err
+		}
+		rev++
+	}
+	return db.insertRevision(tx, after.ID, rev, db.actorName(), action, after, diffAddressBookEntries(before, after))
+}
+
+func (db *mysqlDB) insertRevision(tx *sql.Tx, id int64, rev int, actor string, action RevisionAction,
+	abe *AddressBookEntry, changes map[string]FieldChange) error {
+	snapshot, err := json.Marshal(revisionSnapshot(abe))
+	if err != nil {
+		return fmt.Errorf("mysql: revision snapshot: %v", err)
+	}
+	diff, err := json.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("mysql: revision diff: %v", err)
+	}
+	if _, err := db.addRevision.in(tx).Exec(id, rev, actor, action, string(snapshot), string(diff)); err != nil {
+		return fmt.Errorf("mysql: could not write revision: %v", err)
+	}
+	return nil
+}
+
+// writeRevisionIfChanged is writeRevision, but only if a field changed
+func (db *mysqlDB) writeRevisionIfChanged(tx *sql.Tx, action RevisionAction, before, after *AddressBookEntry) error {
+	if nil != before && nil == before.DeletedAt && 0 == len(diffAddressBookEntries(before, after)) {
+		return nil
+	}
+	return db.writeRevision(tx, action, before, after)
+}
+
+// The history of an entry in another book is not there
+const listRevisionsStatement = `
+  SELECT r.entryid, r.rev, r.createdDate, r.actor, r.action, r.snapshot, r.diff
+  FROM addressbookrevisions r JOIN addressbookentries e ON e.id = r.entryid
+  WHERE r.entryid = ? AND e.address_book_id = ? ORDER BY r.rev`
+
+// ListRevisions returns the history of an entry, oldest first.
+func (db *mysqlDB) ListRevisions(id int64) ([]*Revision, error) {
+	rows, err := db.listRevisions.Query(id, db.bookID())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revs := []*Revision{}
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		revs = append(revs, rev)
+	}
+	return revs, rows.Err()
+}
+
+// scanRevision reads a Revision from a sql.Row or sql.Rows
+func scanRevision(s rowScanner) (*Revision, error) {
+	var (
+		rev         Revision
+		createdDate sql.NullString
+		snapshot    string
+		diff        string
+	)
+	if err := s.Scan(&rev.EntryID, &rev.Rev, &createdDate, &rev.Actor, &rev.Action, &snapshot, &diff); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(snapshot), &rev.Entry); err != nil {
+		return nil, fmt.Errorf("revision %d of %d snapshot: %v", rev.Rev, rev.EntryID, err)
+	}
+	if err := json.Unmarshal([]byte(diff), &rev.Diff); err != nil {
+		return nil, fmt.Errorf("revision %d of %d diff: %v", rev.Rev, rev.EntryID, err)
+	}
+	rev.Date, _ = time.Parse(mysqlDateTime, createdDate.String)
+	return &rev, nil
+}
+
+const getRevisionStatement = `
+  SELECT entryid, rev, createdDate, actor, action, snapshot, diff
+  FROM addressbookrevisions WHERE entryid = ? AND rev = ?`
+
+// RevertAddressBookEntry sets the entry's fields back to those of one of its revisions.
+func (db *mysqlDB) RevertAddressBookEntry(id int64, rev int) (*AddressBookEntry, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not begin transaction: %v", err)
+	}
+	// Rollback is a no-op once Commit has succeeded
+	defer tx.Rollback()
+
+	before, err := db.lockAddressBookEntry(tx, id)
+	if sql.ErrNoRows == err {
+		return nil, &EntryNotFoundError{ID: id}
+	}
+	if err != nil {
+		return nil, err
+	}
+	revision, err := scanRevision(tx.QueryRow(getRevisionStatement, id, rev))
+	if err != nil {
+		return nil, err
+	}
+
+	after := revision.Entry
+	after.ID = id
+	if _, err := db.update.in(tx).Exec(after.Firstname, after.Lastname, after.Email, after.Phone, id, db.bookID()); err != nil {
+		return nil, fmt.Errorf("mysql: could not execute statement: %v", err)
+	}
+	if err := db.writeRevisionIfChanged(tx, RevisionRevert, before, after); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("mysql: could not commit transaction: %v", err)
+	}
+	return after, nil
+}
@@ -0,0 +1,260 @@
+// 2026.10.19 rjj: Tracing the database
+// tracedDB wraps an AddressBookDatabase, making each call a span, a child of the request's
+//	or import job's, so a slow request shows how much of it was the database.  sql.ErrNoRows is
+//	an answer, not an error, so it does not mark a span as failed.  See tracing.go.
+
+package addressbook
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedDB is a database, with a span for each call under ctx's.  Close, the health checks
+//	and the testing support are not traced.
+type tracedDB struct {
+	AddressBookDatabase
+	ctx    context.Context
+	tracer trace.Tracer
+	// book is the WithBook, for the spans
+	book int64
+}
+
+// Ensure tracedDB conforms to the AddressBookDatabase interface.
+var _ AddressBookDatabase = &tracedDB{}
+
+// traced is a.DB, with a span for each call made with it, under ctx's.  Without a.Tracing it
+//	is a.DB as is.
+func (a *Application) traced(ctx context.Context) AddressBookDatabase {
+	if nil == a.tracerProvider {
+		return a.DB
+	}
+	return &tracedDB{AddressBookDatabase: a.DB, ctx: ctx, tracer: a.tracer()}
+}
+
+// start begins the span for a call to method, under ctx's
+func (db *tracedDB) start(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if 0 != db.book {
+		attrs = append(attrs, attribute.Int64("addressbook.book_id", db.book))
+	}
+	return db.tracer.Start(ctx, "AddressBookDatabase."+method,
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// span begins the span for a call to method.  The func it returns ends it, with the call's
+//	error, so a call is traced by: defer db.span("Method", &err)()
+func (db *tracedDB) span(method string, err *error, attrs ...attribute.KeyValue) func() {
+	_, s := db.start(db.ctx, method, attrs...)
+	return func() { endSpan(s, *err) }
+}
+
+func endSpan(s trace.Span, err error) {
+	if nil != err && !errors.Is(err, sql.ErrNoRows) {
+		s.RecordError(err)
+		s.SetStatus(codes.Error, err.Error())
+	}
+	s.End()
+}
+
+func entryID(id int64) attribute.KeyValue {
+	return attribute.Int64("addressbook.entry_id", id)
+}
+
+// **************** Entries ****************
+
+func (db *tracedDB) ListAddressBookEntries() (abes []*AddressBookEntry, err error) {
+	defer db.span("ListAddressBookEntries", &err)()
+	return db.AddressBookDatabase.ListAddressBookEntries()
+}
+
+// The span lasts as long as the iteration, fn's work included
+func (db *tracedDB) IterateAddressBookEntries(ctx context.Context, fn func(*AddressBookEntry) error) (err error) {
+	ctx, s := db.start(ctx, "IterateAddressBookEntries")
+	defer func() { endSpan(s, err) }()
+	return db.AddressBookDatabase.IterateAddressBookEntries(ctx, fn)
+}
+
+func (db *tracedDB) GetAddressBookEntry(id int64) (abe *AddressBookEntry, err error) {
+	defer db.span("GetAddressBookEntry", &err, entryID(id))()
+	return db.AddressBookDatabase.GetAddressBookEntry(id)
+}
+
+func (db *tracedDB) AddAddressBookEntry(abe *AddressBookEntry) (id int64, err error) {
+	defer db.span("AddAddressBookEntry", &err)()
+	return db.AddressBookDatabase.AddAddressBookEntry(abe)
+}
+
+func (db *tracedDB) DeleteAddressBookEntry(id int64) (err error) {
+	defer db.span("DeleteAddressBookEntry", &err, entryID(id))()
+	return db.AddressBookDatabase.DeleteAddressBookEntry(id)
+}
+
+func (db *tracedDB) ListDeletedAddressBookEntries() (abes []*AddressBookEntry, err error) {
+	defer db.span("ListDeletedAddressBookEntries", &err)()
+	return db.AddressBookDatabase.ListDeletedAddressBookEntries()
+}
+
+func (db *tracedDB) RestoreAddressBookEntry(id int64) (err error) {
+	defer db.span("RestoreAddressBookEntry", &err, entryID(id))()
+	return db.AddressBookDatabase.RestoreAddressBookEntry(id)
+}
+
+func (db *tracedDB) PurgeDeletedAddressBookEntries(olderThan time.Duration) (n int64, err error) {
+	defer db.span("PurgeDeletedAddressBookEntries", &err)()
+	return db.AddressBookDatabase.PurgeDeletedAddressBookEntries(olderThan)
+}
+
+func (db *tracedDB) UpdateAddressBookEntry(abe *AddressBookEntry) (err error) {
+	defer db.span("UpdateAddressBookEntry", &err, entryID(abe.ID))()
+	return db.AddressBookDatabase.UpdateAddressBookEntry(abe)
+}
+
+func (db *tracedDB) BulkUpsertAddressBookEntries(abes []*AddressBookEntry, mode ImportMode) (r *ImportResult, err error) {
+	defer db.span("BulkUpsertAddressBookEntries", &err,
+		attribute.Int("addressbook.entries", len(abes)), attribute.String("addressbook.import_mode", string(mode)))()
+	return db.AddressBookDatabase.BulkUpsertAddressBookEntries(abes, mode)
+}
+
+func (db *tracedDB) MergeAddressBookEntries(survivorID int64, victimIDs []int64,
+	merge func(survivor *AddressBookEntry, victims []*AddressBookEntry)) (abe *AddressBookEntry, err error) {
+	defer db.span("MergeAddressBookEntries", &err, entryID(survivorID))()
+	return db.AddressBookDatabase.MergeAddressBookEntries(survivorID, victimIDs, merge)
+}
+
+func (db *tracedDB) GetAddressBookRedirect(id int64) (survivorID int64, err error) {
+	defer db.span("GetAddressBookRedirect", &err, entryID(id))()
+	return db.AddressBookDatabase.GetAddressBookRedirect(id)
+}
+
+func (db *tracedDB) WithActor(actor string) AddressBookDatabase {
+	c := *db
+	c.AddressBookDatabase = db.AddressBookDatabase.WithActor(actor)
+	return &c
+}
+
+func (db *tracedDB) ListRevisions(id int64) (revs []*Revision, err error) {
+	defer db.span("ListRevisions", &err, entryID(id))()
+	return db.AddressBookDatabase.ListRevisions(id)
+}
+
+func (db *tracedDB) RevertAddressBookEntry(id int64, rev int) (abe *AddressBookEntry, err error) {
+	defer db.span("RevertAddressBookEntry", &err, entryID(id), attribute.Int("addressbook.rev", rev))()
+	return db.AddressBookDatabase.RevertAddressBookEntry(id, rev)
+}
+
+// **************** Books ****************
+
+func (db *tracedDB) AddAddressBook(book *AddressBook) (id int64, err error) {
+	defer db.span("AddAddressBook", &err)()
+	return db.AddressBookDatabase.AddAddressBook(book)
+}
+
+func (db *tracedDB) GetAddressBook(name string) (book *AddressBook, err error) {
+	defer db.span("GetAddressBook", &err)()
+	return db.AddressBookDatabase.GetAddressBook(name)
+}
+
+func (db *tracedDB) ListAddressBooks() (books []*AddressBook, err error) {
+	defer db.span("ListAddressBooks", &err)()
+	return db.AddressBookDatabase.ListAddressBooks()
+}
+
+func (db *tracedDB) WithBook(id int64) AddressBookDatabase {
+	c := *db
+	c.AddressBookDatabase = db.AddressBookDatabase.WithBook(id)
+	c.book = id
+	return &c
+}
+
+func (db *tracedDB) SetBookGrant(bookID int64, grantee string, role BookRole) (err error) {
+	defer db.span("SetBookGrant", &err)()
+	return db.AddressBookDatabase.SetBookGrant(bookID, grantee, role)
+}
+
+func (db *tracedDB) DeleteBookGrant(bookID int64, grantee string) (err error) {
+	defer db.span("DeleteBookGrant", &err)()
+	return db.AddressBookDatabase.DeleteBookGrant(bookID, grantee)
+}
+
+func (db *tracedDB) ListBookGrants(bookID int64) (grants []*BookGrant, err error) {
+	defer db.span("ListBookGrants", &err)()
+	return db.AddressBookDatabase.ListBookGrants(bookID)
+}
+
+func (db *tracedDB) BookRoles(grantees []string) (roles map[int64]BookRole, err error) {
+	defer db.span("BookRoles", &err)()
+	return db.AddressBookDatabase.BookRoles(grantees)
+}
+
+// **************** Import jobs ****************
+
+func (db *tracedDB) AddImportJob(job *ImportJob) (id int64, err error) {
+	defer db.span("AddImportJob", &err)()
+	return db.AddressBookDatabase.AddImportJob(job)
+}
+
+func (db *tracedDB) GetImportJob(id int64) (job *ImportJob, err error) {
+	defer db.span("GetImportJob", &err)()
+	return db.AddressBookDatabase.GetImportJob(id)
+}
+
+func (db *tracedDB) ListImportJobs(status ImportJobStatus) (jobs []*ImportJob, err error) {
+	defer db.span("ListImportJobs", &err)()
+	return db.AddressBookDatabase.ListImportJobs(status)
+}
+
+func (db *tracedDB) TransitionImportJob(id int64, from, to ImportJobStatus) (ok bool, err error) {
+	defer db.span("TransitionImportJob", &err)()
+	return db.AddressBookDatabase.TransitionImportJob(id, from, to)
+}
+
+func (db *tracedDB) SaveImportJob(job *ImportJob) (ok bool, err error) {
+	defer db.span("SaveImportJob", &err)()
+	return db.AddressBookDatabase.SaveImportJob(job)
+}
+
+// **************** Audit ****************
+
+func (db *tracedDB) AppendAuditRecord(rec *AuditRecord) (err error) {
+	defer db.span("AppendAuditRecord", &err)()
+	return db.AddressBookDatabase.AppendAuditRecord(rec)
+}
+
+func (db *tracedDB) IterateAuditRecords(ctx context.Context, filter AuditFilter, fn func(*AuditRecord) error) (err error) {
+	ctx, s := db.start(ctx, "IterateAuditRecords")
+	defer func() { endSpan(s, err) }()
+	return db.AddressBookDatabase.IterateAuditRecords(ctx, filter, fn)
+}
+
+func (db *tracedDB) AuditChainHead() (seq int64, hash string, err error) {
+	defer db.span("AuditChainHead", &err)()
+	return db.AddressBookDatabase.AuditChainHead()
+}
+
+// **************** API keys ****************
+
+func (db *tracedDB) AddAPIKey(key *APIKey) (id int64, err error) {
+	defer db.span("AddAPIKey", &err)()
+	return db.AddressBookDatabase.AddAPIKey(key)
+}
+
+func (db *tracedDB) GetAPIKeyByHash(hash string) (key *APIKey, err error) {
+	defer db.span("GetAPIKeyByHash", &err)()
+	return db.AddressBookDatabase.GetAPIKeyByHash(hash)
+}
+
+func (db *tracedDB) ListAPIKeys() (keys []*APIKey, err error) {
+	defer db.span("ListAPIKeys", &err)()
+	return db.AddressBookDatabase.ListAPIKeys()
+}
+
+func (db *tracedDB) RevokeAPIKey(id int64) (err error) {
+	defer db.span("RevokeAPIKey", &err)()
+	return db.AddressBookDatabase.RevokeAPIKey(id)
+}
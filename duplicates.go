@@ -0,0 +1,401 @@
+// 2026.10.18 rjj: Duplicate contact detection
+// Nothing stops the same person being entered twice, and imports have done exactly that.
+//	GET /duplicates groups the entries that are likely the same person, by:
+//		- email, ignoring case and any +tag
+//		- phone, in E.164 form
+//		- name, by Jaro-Winkler similarity
+//	Only the AddressBookDatabase interface is used, so it works with any backend.
+
+package addressbook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// DuplicateCluster is a group of AddressBookEntries that are likely the same contact.
+type DuplicateCluster struct {
+	// Confidence is from 0 to 1, that of the weakest link holding the cluster together
+	Confidence float64 `json:"confidence"`
+	// Reasons are what matched: email, phone and/or name
+	Reasons []string            `json:"reasons"`
+	Entries []*AddressBookEntry `json:"entries"`
+}
+
+// The confidence each match gives on its own, they are combined as independent evidence.
+//	A name alone is the weakest, plenty of different people share one.
+const (
+	duplicateEmailConfidence = 0.9
+	duplicatePhoneConfidence = 0.8
+	duplicateNameConfidence  = 0.7
+
+	// duplicateNameSimilarity is the Jaro-Winkler similarity at which names count as a match
+	duplicateNameSimilarity = 0.9
+
+	// DefaultDuplicateConfidence is the lowest confidence reported unless asked otherwise
+	DefaultDuplicateConfidence = 0.6
+)
+
+// defaultCountryCode is assumed for phone numbers without one, the examples are all NANP
+const defaultCountryCode = "1"
+
+// duplicateCandidate is an AddressBookEntry with its normalized match keys
+type duplicateCandidate struct {
+	abe   *AddressBookEntry
+	email string
+	phone string
+	name  string
+	// block narrows which names are compared, comparing every pair would be n squared
+	block string
+}
+
+// FindDuplicates returns the clusters of likely duplicate entries with at least minConfidence,
+//	most confident first.
+func FindDuplicates(ctx context.Context, db AddressBookDatabase, minConfidence float64) ([]*DuplicateCluster, error) {
+	var cands []*duplicateCandidate
+	err := db.IterateAddressBookEntries(ctx, func(abe *AddressBookEntry) error {
+		cands = append(cands, newDuplicateCandidate(abe))
+		return nil
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	// Candidate pairs: neighbours sharing an email or phone, and similar names within a block.
+	//	Neighbours are enough for exact keys, they all end up in one cluster anyway.
+	emails, phones, blocks := map[string][]int{}, map[string][]int{}, map[string][]int{}
+	for i, c := range cands {
+		if "" != c.email {
+			emails[c.email] = append(emails[c.email], i)
+		}
+		if "" != c.phone {
+			phones[c.phone] = append(phones[c.phone], i)
+		}
+		if "" != c.name {
+			blocks[c.block] = append(blocks[c.block], i)
+		}
+	}
+
+	type pair struct{ i, j int }
+	seen := map[pair]bool{}
+	var links []duplicateLink
+	consider := func(i, j int) {
+		if i > j {
+			i, j = j, i
+		}
+		if seen[pair{i, j}] {
+			return
+		}
+		seen[pair{i, j}] = true
+		if link := scoreDuplicatePair(cands[i], cands[j]); 0 < link.confidence {
+			link.i, link.j = i, j
+			links = append(links, link)
+		}
+	}
+	for _, bucket := range []map[string][]int{emails, phones} {
+		for _, idxs := range bucket {
+			for k := 1; k < len(idxs); k++ {
+				consider(idxs[k-1], idxs[k])
+			}
+		}
+	}
+	for _, idxs := range blocks {
+		for x := 0; x < len(idxs); x++ {
+			for y := x + 1; y < len(idxs); y++ {
+				if duplicateNameSimilarity <= jaroWinkler(cands[idxs[x]].name, cands[idxs[y]].name) {
+					consider(idxs[x], idxs[y])
+				}
+			}
+		}
+	}
+
+	return clusterDuplicates(cands, links, minConfidence), nil
+}
+
+func newDuplicateCandidate(abe *AddressBookEntry) *duplicateCandidate {
+	c := &duplicateCandidate{
+		abe:   abe,
+		email: normalizeEmail(abe.Email),
+		phone: normalizePhone(abe.Phone),
+	}
+	first, last := normalizeName(abe.Firstname), normalizeName(abe.Lastname)
+	c.name = strings.TrimSpace(first + " " + last)
+	if "" != c.name {
+		c.block = firstRune(last) + firstRune(first)
+	}
+	return c
+}
+
+// normalizeEmail lower cases the address and drops any +tag, e.g. Fn.Ln+news@Example.com is fn.ln@example.com
+func normalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndexByte(email, '@')
+	if 1 > at {
+		return ""
+	}
+	local, domain := email[:at], email[at+1:]
+	if plus := strings.IndexByte(local, '+'); 0 < plus {
+		local = local[:plus]
+	}
+	return local + "@" + domain
+}
+
+// normalizePhone returns the number in E.164 form, e.g. (123)456-7890 is +11234567890,
+//	or "" if it does not look like a phone number.  Extensions are ignored.
+func normalizePhone(phone string) string {
+	phone = strings.TrimSpace(phone)
+	if idx := strings.IndexAny(strings.ToLower(phone), "x#"); -1 != idx {
+		phone = phone[:idx]
+	}
+
+	international := strings.HasPrefix(phone, "+")
+	var digits strings.Builder
+	for _, r := range phone {
+		if '0' <= r && r <= '9' {
+			digits.WriteRune(r)
+		}
+	}
+	d := digits.String()
+	switch {
+	case international:
+	case strings.HasPrefix(d, "00"):
+		d = d[2:]
+	case 10 == len(d):
+		d = defaultCountryCode + d
+	case 11 == len(d) && strings.HasPrefix(d, defaultCountryCode):
+	default:
+		return ""
+	}
+
+	// E.164 allows at most 15 digits, and nothing real is shorter than 8
+	if 8 > len(d) || 15 < len(d) || strings.HasPrefix(d, "0") {
+		return ""
+	}
+	return "+" + d
+}
+
+// normalizeName lower cases the name, strips accents and drops punctuation, e.g. "O'Brien-Núñez" is "obriennunez"
+func normalizeName(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(strings.ToLower(name)) {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r):
+			b.WriteRune(r)
+		case unicode.IsSpace(r):
+			b.WriteByte(' ')
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func firstRune(s string) string {
+	for _, r := range s {
+		return string(r)
+	}
+	return ""
+}
+
+// duplicateLink is the evidence that two candidates are the same contact
+type duplicateLink struct {
+	i, j       int
+	confidence float64
+	reasons    []string
+}
+
+func scoreDuplicatePair(a, b *duplicateCandidate) duplicateLink {
+	var link duplicateLink
+	// The chance that this is NOT a duplicate, given each independent match
+	doubt := 1.0
+	if "" != a.email && a.email == b.email {
+		doubt *= 1 - duplicateEmailConfidence
+		link.reasons = append(link.reasons, "email")
+	}
+	if "" != a.phone && a.phone == b.phone {
+		doubt *= 1 - duplicatePhoneConfidence
+		link.reasons = append(link.reasons, "phone")
+	}
+	if "" != a.name && "" != b.name {
+		if similarity := jaroWinkler(a.name, b.name); duplicateNameSimilarity <= similarity {
+			doubt *= 1 - duplicateNameConfidence*similarity
+			link.reasons = append(link.reasons, "name")
+		}
+	}
+	if 0 < len(link.reasons) {
+		link.confidence = 1 - doubt
+	}
+	return link
+}
+
+// clusterDuplicates joins the linked candidates, strongest links first, so each cluster's
+//	confidence is that of the weakest link it needed.
+func clusterDuplicates(cands []*duplicateCandidate, links []duplicateLink, minConfidence float64) []*DuplicateCluster {
+	sort.Slice(links, func(x, y int) bool { return links[x].confidence > links[y].confidence })
+
+	parent := make([]int, len(cands))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	confidence := map[int]float64{}
+	reasons := map[int]map[string]bool{}
+	for _, link := range links {
+		if link.confidence < minConfidence {
+			break
+		}
+		ri, rj := find(link.i), find(link.j)
+		if ri == rj {
+			for _, reason := range link.reasons {
+				reasons[ri][reason] = true
+			}
+			continue
+		}
+
+		// Links come strongest first, so this one is the weakest so far
+		parent[rj] = ri
+		confidence[ri] = link.confidence
+		if nil == reasons[ri] {
+			reasons[ri] = map[string]bool{}
+		}
+		for reason := range reasons[rj] {
+			reasons[ri][reason] = true
+		}
+		for _, reason := range link.reasons {
+			reasons[ri][reason] = true
+		}
+		delete(confidence, rj)
+		delete(reasons, rj)
+	}
+
+	byRoot := map[int]*DuplicateCluster{}
+	var clusters []*DuplicateCluster
+	for i, c := range cands {
+		root := find(i)
+		if _, ok := confidence[root]; !ok {
+			continue
+		}
+		cluster := byRoot[root]
+		if nil == cluster {
+			cluster = &DuplicateCluster{Confidence: confidence[root], Reasons: []string{}}
+			for _, reason := range []string{"email", "phone", "name"} {
+				if reasons[root][reason] {
+					cluster.Reasons = append(cluster.Reasons, reason)
+				}
+			}
+			byRoot[root] = cluster
+			clusters = append(clusters, cluster)
+		}
+		cluster.Entries = append(cluster.Entries, c.abe)
+	}
+	for _, cluster := range clusters {
+		// Oldest first, it is the natural one to keep
+		sort.Slice(cluster.Entries, func(x, y int) bool { return cluster.Entries[x].ID < cluster.Entries[y].ID })
+	}
+
+	sort.SliceStable(clusters, func(x, y int) bool { return clusters[x].Confidence > clusters[y].Confidence })
+	return clusters
+}
+
+// jaroWinkler is the Jaro similarity of s1 and s2, 0 to 1, boosted for a common prefix of up to 4 runes.
+func jaroWinkler(s1, s2 string) float64 {
+	a, b := []rune(s1), []rune(s2)
+	if 0 == len(a) && 0 == len(b) {
+		return 1
+	}
+	if 0 == len(a) || 0 == len(b) {
+		return 0
+	}
+
+	window := len(a)
+	if len(b) > window {
+		window = len(b)
+	}
+	window = window/2 - 1
+	if 0 > window {
+		window = 0
+	}
+
+	aMatched, bMatched := make([]bool, len(a)), make([]bool, len(b))
+	matches := 0
+	for i := range a {
+		lo, hi := i-window, i+window+1
+		if 0 > lo {
+			lo = 0
+		}
+		if len(b) < hi {
+			hi = len(b)
+		}
+		for j := lo; j < hi; j++ {
+			if !bMatched[j] && a[i] == b[j] {
+				aMatched[i], bMatched[j] = true, true
+				matches++
+				break
+			}
+		}
+	}
+	if 0 == matches {
+		return 0
+	}
+
+	// Half the number of matched runes that are out of order
+	transpositions, j := 0, 0
+	for i := range a {
+		if !aMatched[i] {
+			continue
+		}
+		for !bMatched[j] {
+			j++
+		}
+		if a[i] != b[j] {
+			transpositions++
+		}
+		j++
+	}
+
+	m := float64(matches)
+	jaro := (m/float64(len(a)) + m/float64(len(b)) + (m-float64(transpositions)/2)/m) / 3
+
+	prefix := 0
+	for prefix < 4 && prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
+
+// **************** Handler ****************
+
+// The optional *confidence* query parameter, 0 to 1, is the lowest confidence reported.
+func (a *Application) getDuplicates(w http.ResponseWriter, r *http.Request) {
+	minConfidence := DefaultDuplicateConfidence
+	if v := r.URL.Query().Get("confidence"); "" != v {
+		var err error
+		minConfidence, err = strconv.ParseFloat(v, 64)
+		if nil != err || 0 > minConfidence || 1 < minConfidence {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Bad confidence (%s), must be from 0 to 1", v))
+			return
+		}
+	}
+
+	clusters, err := FindDuplicates(r.Context(), a.db(r), minConfidence)
+	if nil != err {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if nil == clusters {
+		clusters = []*DuplicateCluster{}
+	}
+	respondWithJSON(w, http.StatusOK, clusters)
+}
@@ -0,0 +1,175 @@
+// 2026.10.19 rjj: Health, readiness and shutdown
+// /healthz says the process is up, for a liveness probe.  /readyz says whether it should be sent
+//	requests, for a readiness probe: not while it is starting, i.e. connecting to the database
+//	and bringing its schema up to date, nor once it is shutting down, nor while the database
+//	does not answer or has a schema older than this code.  Neither needs credentials.
+// A database that is down at start-up is waited for, so the server is up, answering the
+//	probes and a 503 to everything else, until it is there.  It is tried again after a second,
+//	then after twice as long each time, up to a minute.  A database that goes down later gets
+//	the same 503, once the circuit breaker has opened, see db_mysql_resilience.go.
+
+package addressbook
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// How long to wait between tries to reach the database at start-up, at first and at most,
+//	what Retry-After says meanwhile, and how long it has to answer /readyz
+const (
+	databaseRetryFirst = time.Second
+	databaseRetryMax   = time.Minute
+	databaseRetryAfter = 5 * time.Second
+	readyzTimeout      = 2 * time.Second
+)
+
+// Shutdown defaults
+const (
+	defaultShutdownDelay   = 5 * time.Second
+	defaultShutdownTimeout = 30 * time.Second
+)
+
+// openDatabase connects to the database, and starts what needs it.  If the database is not
+//	there yet, it keeps trying in the background, and the server is not ready until it is.
+func (a *Application) openDatabase(open func() (AddressBookDatabase, error)) {
+	db, err := open()
+	if nil == err {
+		a.connected(db)
+		return
+	}
+
+	slog.Error("openDatabase:: the database is not available, waiting for it", "err", err)
+	a.starting.Store(true)
+	go func() {
+		for attempt := 1; !a.stopping.Load(); attempt++ {
+			time.Sleep(backoff(attempt, databaseRetryFirst, databaseRetryMax))
+			if db, err = open(); nil == err {
+				slog.Info("openDatabase:: connected", "attempts", attempt+1)
+				a.connected(db)
+				return
+			}
+			slog.Warn("openDatabase:: still waiting for the database", "attempts", attempt+1, "err", err)
+		}
+	}()
+}
+
+// connected starts what needs the database.  a.DB is set before starting is cleared, so a
+//	request that finds the server started finds the database.
+func (a *Application) connected(db AddressBookDatabase) {
+	a.DB = db
+	a.startImportRunner()
+	a.startTrashPurger()
+	a.starting.Store(false)
+}
+
+// whenStarted refuses requests with a 503 until the database is there, and while it is down
+func (a *Application) whenStarted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notStarted := ""
+		switch {
+		case isProbe(r):
+		case a.starting.Load():
+			notStarted = "The server is starting, waiting for the database"
+		case !a.DB.Available():
+			notStarted = "The database is unavailable"
+		}
+		if "" != notStarted {
+			w.Header().Set("Retry-After", seconds(databaseRetryAfter))
+			respondWithProblem(w, r, http.StatusServiceUnavailable, notStarted)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isProbe reports whether r is for /healthz or /readyz
+func isProbe(r *http.Request) bool {
+	return "/healthz" == r.URL.Path || "/readyz" == r.URL.Path
+}
+
+// **************** Handlers ****************
+
+// healthz: if we can answer, we are alive
+func (a *Application) healthz(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (a *Application) readyz(w http.ResponseWriter, r *http.Request) {
+	notReady := ""
+	switch {
+	case a.stopping.Load():
+		notReady = "The server is shutting down"
+	case a.starting.Load():
+		notReady = "The server is starting, waiting for the database"
+	default:
+		ctx, cancel := context.WithTimeout(r.Context(), readyzTimeout)
+		defer cancel()
+		if err := a.DB.CheckHealth(ctx); nil != err {
+			notReady = fmt.Sprintf("The database is not ready (%v)", err)
+		}
+	}
+	if "" != notReady {
+		respondWithProblem(w, r, http.StatusServiceUnavailable, notReady)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// **************** Shutdown ****************
+
+// shutdownOnSignal shuts down once the process is told to stop, by SIGTERM or SIGINT
+func (a *Application) shutdownOnSignal(server *http.Server, done chan<- struct{}) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	a.shutdown(server)
+	close(done)
+}
+
+// shutdown stops gracefully: /readyz fails at once, so the orchestrator stops sending requests.
+//	ShutdownDelay later, by when it has noticed, the server stops taking new requests, and waits
+//	up to ShutdownTimeout for those it has.  Within the same ShutdownTimeout the import jobs
+//	running finish, or go back in the queue, and the trash purger stops.  Then the last spans
+//	are sent and the database is closed.
+func (a *Application) shutdown(server *http.Server) {
+	a.stopping.Store(true)
+	delay, timeout := a.ShutdownDelay, a.ShutdownTimeout
+	if 0 == delay {
+		delay = defaultShutdownDelay
+	}
+	if 0 >= timeout {
+		timeout = defaultShutdownTimeout
+	}
+	slog.Info("shutdown:: stopping", "delay", delay.String(), "timeout", timeout.String())
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); nil != err {
+		slog.Error("shutdown:: requests still running were cut off", "err", err)
+	}
+	// The background work uses the database, so stops first
+	started := !a.starting.Load() && nil != a.DB
+	if started {
+		a.stopTrashPurger(ctx)
+		if nil != a.imports {
+			a.imports.stop(ctx)
+		}
+	}
+	if nil != a.tracerProvider {
+		if err := a.tracerProvider.Shutdown(ctx); nil != err {
+			slog.Error("shutdown:: could not send the last spans", "err", err)
+		}
+	}
+	if started {
+		a.DB.Close()
+	}
+	slog.Info("shutdown:: stopped")
+}
@@ -0,0 +1,563 @@
+// 2026.10.18 rjj: Asynchronous import jobs
+// POST /imports stores the upload and returns 202 straight away, the import itself is run by a
+//	pool of background workers.  The job, its progress and its row errors are kept in the DB,
+//	so a restart picks up where it left off.
+//	A graceful shutdown lets the running jobs finish, or puts them back in the queue, see stop.
+// Note: jobs need a single instance.  The upload is in this instance's ImportDir, and a restart
+//	takes every running job to be its own, see recoverInterrupted.
+
+package addressbook
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ImportJobStatus is where an ImportJob is in its life:
+//	queued -> running -> done | failed, and queued or running -> cancelled
+type ImportJobStatus string
+
+const (
+	ImportJobQueued    ImportJobStatus = "queued"
+	ImportJobRunning   ImportJobStatus = "running"
+	ImportJobDone      ImportJobStatus = "done"
+	ImportJobFailed    ImportJobStatus = "failed"
+	ImportJobCancelled ImportJobStatus = "cancelled"
+)
+
+// ImportJob is an import running in the background.
+type ImportJob struct {
+	ID     int64           `json:"id"`
+	Status ImportJobStatus `json:"status"`
+	// Format is the media type of the upload, e.g. text/csv
+	Format string     `json:"format"`
+	Mode   ImportMode `json:"mode"`
+	Atomic bool       `json:"atomic"`
+	// Path is where the upload is kept until the job is over
+	Path string `json:"-"`
+	// Actor started the job, the entries it imports are recorded as written by them
+	Actor string `json:"actor"`
+	// BookID is the AddressBook it imports into
+	BookID int64 `json:"-"`
+
+	Processed int `json:"processed"`
+	Inserted  int `json:"inserted"`
+	Updated   int `json:"updated"`
+	Failed    int `json:"failed"`
+	// Messages has one message per bad record, and a summary once the job is over
+	Messages []string `json:"messages"`
+
+	CreatedDate time.Time `json:"createdDate"`
+	UpdatedDate time.Time `json:"updatedDate"`
+}
+
+// ImportJobDatabase keeps the state of ImportJobs, so it survives a restart.
+type ImportJobDatabase interface {
+	// AddImportJob saves a new ImportJob, assigning it a new ID.
+	AddImportJob(job *ImportJob) (id int64, err error)
+
+	// GetImportJob retrieves an ImportJob by its ID.
+	GetImportJob(id int64) (*ImportJob, error)
+
+	// ListImportJobs returns the ImportJobs with the given status, oldest first.
+	ListImportJobs(status ImportJobStatus) ([]*ImportJob, error)
+
+	// TransitionImportJob moves an ImportJob from one status to another, reporting false if
+	//	it was not in the from status, e.g. another worker already claimed it.
+	TransitionImportJob(id int64, from, to ImportJobStatus) (bool, error)
+
+	// SaveImportJob saves the status, counts and messages of a running ImportJob, reporting
+	//	false if it is no longer running, e.g. it was cancelled.
+	SaveImportJob(job *ImportJob) (bool, error)
+}
+
+// importJobMaxMessages caps the messages kept per job, a bad file could have millions
+const importJobMaxMessages = 1000
+
+func (job *ImportJob) report() *importReport {
+	return &importReport{
+		Processed: job.Processed,
+		Inserted:  job.Inserted,
+		Updated:   job.Updated,
+		Failed:    job.Failed,
+		Msgs:      append([]string{}, job.Messages...),
+	}
+}
+
+func (job *ImportJob) setReport(rep *importReport) {
+	job.Processed, job.Inserted, job.Updated, job.Failed = rep.Processed, rep.Inserted, rep.Updated, rep.Failed
+	job.Messages = rep.Msgs
+	if importJobMaxMessages < len(job.Messages) {
+		// Keep the first ones, and the summary at the end
+		last := job.Messages[len(job.Messages)-1]
+		job.Messages = append(append([]string{}, job.Messages[:importJobMaxMessages-2]...),
+			fmt.Sprintf("... %d more messages not kept", len(rep.Msgs)-importJobMaxMessages+1), last)
+	}
+}
+
+// newEntryDecoder returns the import decoder for a media type, or nil if it can not be imported.
+func newEntryDecoder(mediaType string, r io.Reader, mode ImportMode) entryDecoder {
+	switch mediaType {
+	case "text/csv":
+		return &csvEntryDecoder{r: csv.NewReader( r ), ignoreID: ImportInsert == mode}
+	case ndjsonContentType:
+		return newNDJSONEntryDecoder(r)
+	}
+	return nil
+}
+
+// **************** Workers ****************
+
+// importPollInterval is how often the queue is checked anyway, should a job be missed.
+//	New jobs are started at once, see wakeUp.
+const importPollInterval = 10 * time.Second
+
+var errImportJobCancelled = errors.New("import job cancelled")
+
+// errImportJobInterrupted stops a job for a shutdown, it goes back in the queue
+var errImportJobInterrupted = errors.New("import job interrupted by a shutdown")
+
+// importRunner runs queued ImportJobs on a pool of workers.
+type importRunner struct {
+	a    *Application
+	wake chan struct{}
+	ids  chan int64
+	// done is closed to stop, the workers finish the job they have and stop
+	done    chan struct{}
+	workers sync.WaitGroup
+
+	mu sync.Mutex
+	// cancels stops the running jobs, with the cause
+	cancels map[int64]context.CancelCauseFunc
+}
+
+func (a *Application) startImportRunner() {
+	if "" == a.ImportDir {
+		a.ImportDir = filepath.Join(os.TempDir(), "yum-addressbook-imports")
+	}
+	if err := os.MkdirAll(a.ImportDir, 0700); nil != err {
+		log.Fatal( err )
+	}
+	if 0 >= a.ImportWorkers {
+		a.ImportWorkers = 2
+	}
+
+	q := &importRunner{
+		a:       a,
+		wake:    make(chan struct{}, 1),
+		ids:     make(chan int64),
+		done:    make(chan struct{}),
+		cancels: map[int64]context.CancelCauseFunc{},
+	}
+	a.imports = q
+
+	q.recoverInterrupted()
+	go q.dispatch()
+	q.workers.Add(a.ImportWorkers)
+	for i := 0; i < a.ImportWorkers; i++ {
+		go q.work()
+	}
+}
+
+// stop stops taking jobs, and waits for those running until ctx is done.  Those still running
+//	then are interrupted, and put back in the queue with their progress, to carry on from
+//	there at the next start, rather than be failed by recoverInterrupted.
+func (q *importRunner) stop(ctx context.Context) {
+	close(q.done)
+	finished := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	slog.Warn("importRunner:: interrupting the running jobs", "jobs", len(q.cancels))
+	for _, interrupt := range q.cancels {
+		interrupt(errImportJobInterrupted)
+	}
+	q.mu.Unlock()
+	// They stop between records
+	<-finished
+}
+
+// recoverInterrupted deals with the jobs left running by a restart.
+//	Atomic jobs saved nothing, so start again.  Upserts are safe to repeat, so carry on.
+//	A non-atomic insert can not know if its last records went in, so it is failed rather
+//	than risk duplicates.
+// Note: only right for a single instance, see the top of this file.
+func (q *importRunner) recoverInterrupted() {
+	jobs, err := q.a.DB.ListImportJobs(ImportJobRunning)
+	if nil != err {
+		slog.Error("importRunner:: could not list interrupted jobs", "err", err)
+		return
+	}
+
+	for _, job := range jobs {
+		switch {
+		case job.Atomic:
+			job.setReport(&importReport{})
+		case ImportInsert == job.Mode:
+			job.Status = ImportJobFailed
+			job.Messages = append(job.Messages, fmt.Sprintf(
+				"Interrupted by a restart after %d input records, the rest were not imported.", job.Processed))
+			if _, err := q.a.DB.SaveImportJob(job); nil != err {
+				slog.Error("importRunner:: could not fail interrupted job", "job", job.ID, "err", err)
+			}
+			os.Remove(job.Path)
+			continue
+		}
+		if _, err := q.a.DB.SaveImportJob(job); nil != err {
+			slog.Error("importRunner:: could not reset interrupted job", "job", job.ID, "err", err)
+			continue
+		}
+		if _, err := q.a.DB.TransitionImportJob(job.ID, ImportJobRunning, ImportJobQueued); nil != err {
+			slog.Error("importRunner:: could not requeue interrupted job", "job", job.ID, "err", err)
+		}
+	}
+}
+
+// wakeUp has the dispatcher check the queue now, rather than at the next poll
+func (q *importRunner) wakeUp() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch hands the queued jobs to the workers, who claim them.
+func (q *importRunner) dispatch() {
+	ticker := time.NewTicker(importPollInterval)
+	defer ticker.Stop()
+
+	for {
+		jobs, err := q.a.DB.ListImportJobs(ImportJobQueued)
+		if nil != err {
+			slog.Error("importRunner:: could not list queued jobs", "err", err)
+		}
+		for _, job := range jobs {
+			select {
+			case q.ids <- job.ID:
+			case <-q.done:
+				return
+			}
+		}
+
+		select {
+		case <-q.wake:
+		case <-ticker.C:
+		case <-q.done:
+			return
+		}
+	}
+}
+
+func (q *importRunner) work() {
+	defer q.workers.Done()
+	for {
+		select {
+		case <-q.done:
+			return
+		case id := <-q.ids:
+			q.process(id)
+		}
+	}
+}
+
+// cancel stops the job if it is running
+func (q *importRunner) cancel(id int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if cancel, ok := q.cancels[id]; ok {
+		cancel(errImportJobCancelled)
+	}
+}
+
+func (q *importRunner) process(id int64) {
+	// Each job is a trace of its own, see tracing.go
+	traceCtx, span := q.a.tracer().Start(context.Background(), "importJob",
+		trace.WithAttributes(attribute.Int64("addressbook.import_job_id", id)))
+	defer span.End()
+	db := q.a.traced(traceCtx)
+	claimed, err := db.TransitionImportJob(id, ImportJobQueued, ImportJobRunning)
+	if nil != err {
+		slog.Error("importRunner:: could not claim job", "job", id, "err", err)
+	}
+	if !claimed {
+		return
+	}
+
+	job, err := db.GetImportJob(id)
+	if nil != err {
+		slog.Error("importRunner:: could not read job", "job", id, "err", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancelCause(traceCtx)
+	q.mu.Lock()
+	q.cancels[id] = cancel
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		delete(q.cancels, id)
+		q.mu.Unlock()
+		cancel(nil)
+	}()
+
+	rep := job.report()
+	err = q.run(ctx, job, rep)
+	job.setReport(rep)
+	switch {
+	case nil != err && errImportJobInterrupted == context.Cause(ctx):
+		span.SetAttributes(attribute.String("addressbook.import_status", string(ImportJobQueued)))
+		q.requeue(db, job)
+		return
+	case errImportJobCancelled == err || context.Canceled == err:
+		// Already cancelled in the DB, by cancelImportJob
+		os.Remove(job.Path)
+		return
+	case nil != err:
+		job.Status = ImportJobFailed
+		job.Messages = append(job.Messages, err.Error())
+	case rep.Rejected, 0 < rep.Failed && rep.Processed <= rep.Failed:
+		job.Status = ImportJobFailed
+	default:
+		job.Status = ImportJobDone
+	}
+
+	span.SetAttributes(attribute.String("addressbook.import_status", string(job.Status)))
+	if _, err := db.SaveImportJob(job); nil != err {
+		slog.Error("importRunner:: could not save job", "job", id, "err", err)
+		return
+	}
+	os.Remove(job.Path)
+	q.audit(traceCtx, job)
+}
+
+// requeue puts a job interrupted by a shutdown back in the queue.  It stopped between
+//	records, so its report is what it saved: the next start skips those and carries on.  An
+//	atomic job saved nothing, so starts again.
+func (q *importRunner) requeue(db AddressBookDatabase, job *ImportJob) {
+	if job.Atomic {
+		job.setReport(&importReport{})
+	}
+	if _, err := db.SaveImportJob(job); nil != err {
+		slog.Error("importRunner:: could not save interrupted job", "job", job.ID, "err", err)
+		return
+	}
+	if _, err := db.TransitionImportJob(job.ID, ImportJobRunning, ImportJobQueued); nil != err {
+		slog.Error("importRunner:: could not requeue interrupted job", "job", job.ID, "err", err)
+		return
+	}
+	slog.Info("importRunner:: requeued interrupted job", "job", job.ID, "processed", job.Processed)
+}
+
+// audit records the end of a job, the request that queued it was audited when it was made
+func (q *importRunner) audit(ctx context.Context, job *ImportJob) {
+	outcome := AuditSuccess
+	if ImportJobDone != job.Status {
+		outcome = AuditFailure
+	}
+	q.a.recordAudit(ctx, &AuditRecord{
+		Actor:     job.Actor,
+		Action:    AuditImport,
+		Path:      fmt.Sprintf("/imports/%d", job.ID),
+		EntityIDs: []int64{},
+		Outcome:   outcome,
+		Detail:    fmt.Sprintf("job %d %s, %s %s, processed %d, inserted %d, updated %d, failed %d",
+			job.ID, job.Status, job.Format, job.Mode, job.Processed, job.Inserted, job.Updated, job.Failed),
+	})
+}
+
+func (q *importRunner) run(ctx context.Context, job *ImportJob, rep *importReport) error {
+	f, err := os.Open(job.Path)
+	if nil != err {
+		return fmt.Errorf("Could not read the upload: %v", err)
+	}
+	defer f.Close()
+
+	dec := newEntryDecoder(job.Format, f, job.Mode)
+	if nil == dec {
+		return fmt.Errorf("Unsupported import format (%s)", job.Format)
+	}
+
+	// Carrying on after a restart, skip what was already done
+	for i := 0; i < rep.Processed; i++ {
+		if _, err := dec.Decode(); io.EOF == err {
+			break
+		} else if _, bad := err.(*badRecordError); nil != err && !bad {
+			return err
+		}
+	}
+
+	progress := func() error {
+		job.setReport(rep)
+		running, err := q.a.traced(ctx).SaveImportJob(job)
+		if nil != err {
+			return err
+		}
+		if !running {
+			return errImportJobCancelled
+		}
+		return nil
+	}
+	return q.a.runImport(ctx, q.a.traced(ctx).WithBook(job.BookID).WithActor(job.Actor), dec, job.Mode, job.Atomic, rep, progress)
+}
+
+// **************** Import Job Handlers ****************
+
+// The request body is the file to import, its Content-Type says which format it is in.
+//	Takes the same *mode* and *atomic* query parameters as the CSV import.
+func (a *Application) createImportJob(w http.ResponseWriter, r *http.Request) {
+	mode, err := importModeFromRequest(r)
+	if nil != err {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	atomic, err := importAtomicFromRequest(r, mode)
+	if nil != err {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	format, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if nil != err || nil == newEntryDecoder(format, nil, mode) {
+		respondWithError(w, http.StatusUnsupportedMediaType,
+			fmt.Sprintf("Unsupported import format (%v), use text/csv or %s", r.Header.Get("Content-Type"), ndjsonContentType))
+		return
+	}
+
+	f, err := os.CreateTemp(a.ImportDir, "import-*.upload")
+	if nil != err {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Could not store the upload (%v)", err))
+		return
+	}
+	_, err = io.Copy(f, r.Body)
+	if cerr := f.Close(); nil == err {
+		err = cerr
+	}
+	if nil != err {
+		os.Remove(f.Name())
+		if tooBig, ok := bodyTooLarge(err); ok {
+			respondBodyTooLarge(w, r, tooBig)
+		} else {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Could not read the upload (%v)", err))
+		}
+		return
+	}
+
+	id, err := a.traced(r.Context()).AddImportJob(&ImportJob{
+		Status: ImportJobQueued,
+		Format: format,
+		Mode:   mode,
+		Atomic: atomic,
+		Path:   f.Name(),
+		Actor:  requestActor(r),
+		BookID: requestBookID(r),
+	})
+	if nil != err {
+		os.Remove(f.Name())
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Could not queue the import (%v)", err))
+		return
+	}
+	a.imports.wakeUp()
+	auditDetail(r, "job %d queued, %s %s", id, format, mode)
+
+	job, err := a.traced(r.Context()).GetImportJob(id)
+	if nil != err {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", r.URL.Path, id))
+	respondWithJSON(w, http.StatusAccepted, job)
+}
+
+func (a *Application) getImportJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.importJobFromRequest(w, r)
+	if !ok {
+		return
+	}
+	respondWithJSON(w, http.StatusOK, job)
+}
+
+// Cancelling a job that already finished is a 409, it is too late.
+//	An atomic job can only be cancelled until it reaches the database.
+func (a *Application) cancelImportJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.importJobFromRequest(w, r)
+	if !ok {
+		return
+	}
+	auditDetail(r, "job %d", job.ID)
+
+	for _, from := range []ImportJobStatus{ImportJobQueued, ImportJobRunning} {
+		cancelled, err := a.traced(r.Context()).TransitionImportJob(job.ID, from, ImportJobCancelled)
+		if nil != err {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !cancelled {
+			continue
+		}
+
+		if ImportJobQueued == from {
+			os.Remove(job.Path)
+		} else {
+			// The worker running it cleans up
+			a.imports.cancel(job.ID)
+		}
+		job.Status = ImportJobCancelled
+		respondWithJSON(w, http.StatusOK, job)
+		return
+	}
+
+	if job, ok = a.importJobFromRequest(w, r); ok {
+		respondWithError(w, http.StatusConflict,
+			fmt.Sprintf("ImportJob with ID (%d) is already %s.", job.ID, job.Status))
+	}
+}
+
+// importJobFromRequest reads the job named in the URL, or responds with why not.
+func (a *Application) importJobFromRequest(w http.ResponseWriter, r *http.Request) (*ImportJob, bool) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"],10,64)
+	if nil != err {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Bad ImportJob ID (%v)", vars["id"]))
+		return nil, false
+	}
+
+	job, err := a.traced(r.Context()).GetImportJob(id)
+	if nil == err && requestBookID(r) != job.BookID {
+		// Another book's job is none of the caller's business
+		err = sql.ErrNoRows
+	}
+	if nil != err {
+		if sql.ErrNoRows == err {
+			respondWithError(w, http.StatusNotFound, fmt.Sprintf("ImportJob with ID (%d) not found.", id))
+		} else {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return nil, false
+	}
+	return job, true
+}
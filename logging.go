@@ -0,0 +1,145 @@
+// 2026.10.19 rjj: Logging
+// Everything logs through log/slog, as JSON by default.  Initialize makes the Application's
+//	Logger the default, so code without an Application logs the same way, as does the log package.
+// Each request has an ID, the caller's X-Request-ID or a new one, which goes back on the response
+//	and into every line logged with the request's context, and every error response.  Every
+//	request is logged once it is over, see logRequests.
+
+package addressbook
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewLogger logs to w as JSON, from level up, adding the request ID to every line logged with a
+//	request's context.
+func NewLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(requestIDHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})})
+}
+
+type requestIDKey struct{}
+
+// requestIDFromContext is the ID of the request ctx belongs to, "" if none
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDHandler adds request_id, and trace_id, to records logged with a request's context
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := requestIDFromContext(ctx); "" != id {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	// And, if the request is traced, the trace's ID, see tracing.go
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		rec.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// responseRecorder keeps the status and size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if 0 == w.status {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if 0 == w.status {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streamed exports streaming
+func (w *responseRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logRequests gives each request its ID, and logs it once it is over: method, route (the
+//	template it matched, so the lines for one route can be counted), status, latency and bytes.
+//	The same goes to the request metrics, see metrics.go.
+//	It is the outermost middleware, and also wraps the not found and method not allowed handlers.
+func (a *Application) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx := context.WithValue(r.Context(), requestIDKey{}, requestID(w, r))
+		r = r.WithContext(ctx)
+		rw := &responseRecorder{ResponseWriter: w}
+
+		route := ""
+		if current := mux.CurrentRoute(r); nil != current {
+			route, _ = current.GetPathTemplate()
+		}
+
+		// A handler may panic to abort its response, that is logged too
+		defer func() {
+			p := recover()
+			status, level := rw.status, slog.LevelInfo
+			switch {
+			case nil != p && 0 == status:
+				status = http.StatusInternalServerError
+				fallthrough
+			case 500 <= status:
+				level = slog.LevelError
+			case nil != p:
+				level = slog.LevelWarn
+			case 0 == status:
+				status = http.StatusOK
+			}
+			// Probes come every few seconds, and are about the server, not the request
+			if isProbe(r) && nil == p {
+				level = slog.LevelDebug
+			}
+			elapsed := time.Since(start)
+			observeRequest(r, route, status, elapsed)
+			slog.Log(ctx, level, "request",
+				"method", r.Method,
+				"route", route,
+				"path", r.URL.Path,
+				"status", status,
+				"duration_ms", float64(elapsed.Microseconds())/1000,
+				"bytes", rw.bytes,
+				"aborted", nil != p,
+			)
+			if nil != p {
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,166 @@
+// 2026.10.18 rjj: Merging duplicate contacts
+// POST /addressbookentries/merge folds the victims into the survivor, field by field, then
+//	deletes the victims.  Their IDs are not forgotten: a GET on one is redirected to the survivor.
+
+package addressbook
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// MergeRule picks a field's value from the survivor and victims.
+type MergeRule string
+
+const (
+	// MergeFirst takes the first non-empty value: the survivor's, then the victims' in the order given.
+	MergeFirst MergeRule = "first"
+	// MergeSurvivor keeps the survivor's value, even if it is empty.
+	MergeSurvivor MergeRule = "survivor"
+	// MergeNewest takes the non-empty value of the most recently added entry, i.e. the highest ID.
+	MergeNewest MergeRule = "newest"
+	// MergeLongest takes the longest non-empty value.
+	MergeLongest MergeRule = "longest"
+)
+
+// mergeFields are the AddressBookEntry fields a MergeRule can be given for
+var mergeFields = map[string]func(abe *AddressBookEntry) *string{
+	"firstname": func(abe *AddressBookEntry) *string { return &abe.Firstname },
+	"lastname":  func(abe *AddressBookEntry) *string { return &abe.Lastname },
+	"email":     func(abe *AddressBookEntry) *string { return &abe.Email },
+	"phone":     func(abe *AddressBookEntry) *string { return &abe.Phone },
+}
+
+// mergeRequest is the body of POST /addressbookentries/merge, e.g.
+//	{"survivor": 1, "victims": [2, 3], "rules": {"email": "newest"}}
+//	Fields without a rule use MergeFirst.
+type mergeRequest struct {
+	Survivor int64                `json:"survivor"`
+	Victims  []int64              `json:"victims"`
+	Rules    map[string]MergeRule `json:"rules"`
+}
+
+func (req *mergeRequest) validate() error {
+	if 0 >= req.Survivor {
+		return fmt.Errorf("A survivor ID is required")
+	}
+	if 0 == len(req.Victims) {
+		return fmt.Errorf("At least one victim ID is required")
+	}
+	seen := map[int64]bool{req.Survivor: true}
+	for _, id := range req.Victims {
+		if seen[id] {
+			return fmt.Errorf("ID (%d) is given more than once, or is also the survivor", id)
+		}
+		seen[id] = true
+	}
+	for field, rule := range req.Rules {
+		if _, ok := mergeFields[field]; !ok {
+			return fmt.Errorf("Unknown field (%s), rules can be given for: firstname, lastname, email, phone", field)
+		}
+		switch rule {
+		case MergeFirst, MergeSurvivor, MergeNewest, MergeLongest:
+		default:
+			return fmt.Errorf("Unknown rule (%s) for %s, use one of: %s, %s, %s, %s",
+				rule, field, MergeFirst, MergeSurvivor, MergeNewest, MergeLongest)
+		}
+	}
+	return nil
+}
+
+// merge sets each of the survivor's fields according to its rule.
+func (req *mergeRequest) merge(survivor *AddressBookEntry, victims []*AddressBookEntry) {
+	all := append([]*AddressBookEntry{survivor}, victims...)
+	for field, value := range mergeFields {
+		rule := req.Rules[field]
+		if "" == rule {
+			rule = MergeFirst
+		}
+		*value(survivor) = mergeField(rule, all, value)
+	}
+}
+
+// mergeField applies rule to one field, all starts with the survivor
+func mergeField(rule MergeRule, all []*AddressBookEntry, value func(*AddressBookEntry) *string) string {
+	if MergeSurvivor == rule {
+		return *value(all[0])
+	}
+
+	candidates := all
+	if MergeNewest == rule {
+		candidates = append([]*AddressBookEntry{}, all...)
+		sort.SliceStable(candidates, func(x, y int) bool { return candidates[x].ID > candidates[y].ID })
+	}
+
+	var best string
+	for _, abe := range candidates {
+		v := strings.TrimSpace(*value(abe))
+		if "" == v {
+			continue
+		}
+		if MergeLongest != rule {
+			return v
+		}
+		if len(v) > len(best) {
+			best = v
+		}
+	}
+	return best
+}
+
+func (a *Application) mergeAddressBookEntries(w http.ResponseWriter, r *http.Request) {
+	var req mergeRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if err := req.validate(); nil != err {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	auditEntities(r, append([]int64{req.Survivor}, req.Victims...)...)
+	survivor, err := a.db(r).MergeAddressBookEntries(req.Survivor, req.Victims, req.merge)
+	if nil != err {
+		if _, ok := err.(*EntryNotFoundError); ok {
+			respondWithError(w, http.StatusNotFound, err.Error())
+		} else {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	respondWithJSON(w, http.StatusOK, survivor)
+}
+
+// redirectMergedAddressBookEntry sends a 301 to the entry that id was merged into, on the same
+//	route, e.g. /addressbookentry/2.vcf to /addressbookentry/1.vcf.  It reports false if id was never merged.
+func (a *Application) redirectMergedAddressBookEntry(w http.ResponseWriter, r *http.Request, id int64) bool {
+	survivorID, err := a.db(r).GetAddressBookRedirect(id)
+	if nil != err {
+		return false
+	}
+
+	// The same route, e.g. in the same book, with the survivor's ID
+	pairs := []string{"id", fmt.Sprintf("%d", survivorID)}
+	for k, v := range mux.Vars(r) {
+		if "id" != k {
+			pairs = append(pairs, k, v)
+		}
+	}
+	location, err := mux.CurrentRoute(r).URL(pairs...)
+	if nil != err {
+		return false
+	}
+	location.RawQuery = r.URL.RawQuery
+
+	w.Header().Set("Location", location.String())
+	respondWithJSON(w, http.StatusMovedPermanently, map[string]interface{}{
+		"error":      fmt.Sprintf("AddressBookEntry with ID (%d) was merged into ID (%d).", id, survivorID),
+		"mergedInto": survivorID,
+	})
+	return true
+}
@@ -0,0 +1,93 @@
+// 2026.10.19 rjj: Metrics
+// Prometheus metrics, registered with its default registry, and served at /metrics to callers
+//	with ScopeAdmin.  Requests are counted and timed by the route template they matched, so the
+//	IDs in paths do not make a series each, see logRequests.  The database's metrics are in
+//	db_mysql_metrics.go.
+
+package addressbook
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// What went wrong on our side, by kind
+const (
+	internalErrorPanic    = "panic"
+	internalErrorEncoding = "encoding"
+)
+
+// internalErrors counts the bugs recovered from, see recover.go
+var internalErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "addressbook_internal_errors_total",
+	Help: "Handler panics and responses that could not be encoded, by kind.",
+}, []string{"kind"})
+
+// auditAppendFailures counts the audit records that could not be written, see audit.go
+var auditAppendFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "addressbook_audit_append_failures_total",
+	Help: "Audit records that could not be appended to the audit log, by action.",
+}, []string{"action"})
+
+// **************** HTTP ****************
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "addressbook_http_requests_total",
+		Help: "Requests, by method, route template and status.  The route is empty when none matched.",
+	}, []string{"method", "route", "status"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "addressbook_http_request_duration_seconds",
+		Help:    "How long requests took, by method, route template and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+// observeRequest counts and times a request
+func observeRequest(r *http.Request, route string, status int, d time.Duration) {
+	s := strconv.Itoa(status)
+	httpRequests.WithLabelValues(r.Method, route, s).Inc()
+	httpRequestDuration.WithLabelValues(r.Method, route, s).Observe(d.Seconds())
+}
+
+// **************** DATABASE ****************
+var (
+	dbStatementDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "addressbook_db_statement_duration_seconds",
+		Help:    "How long each prepared statement took, by statement.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"statement"})
+	dbErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "addressbook_db_errors_total",
+		Help: "Prepared statements that failed, by statement.",
+	}, []string{"statement"})
+	dbRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "addressbook_db_retries_total",
+		Help: "Reads tried again after a transient error, by statement.",
+	}, []string{"statement"})
+	dbCircuitOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "addressbook_db_circuit_open",
+		Help: "1 while the database is down, and connections to it are not tried.",
+	})
+)
+
+// **************** IMPORTS ****************
+var (
+	importRowsProcessed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "addressbook_import_rows_processed_total",
+		Help: "Records read by imports, synchronous or jobs.",
+	})
+	importRowsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "addressbook_import_rows_failed_total",
+		Help: "Records imports could not save.",
+	})
+)
+
+// observeImport counts the records an import got through, from before, rep as it started
+func observeImport(before importReport, rep *importReport) {
+	importRowsProcessed.Add(float64(rep.Processed - before.Processed))
+	importRowsFailed.Add(float64(rep.Failed - before.Failed))
+}
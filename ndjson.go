@@ -0,0 +1,106 @@
+// 2026.10.18 rjj: JSON Lines (NDJSON) bulk export and import of AddressBookEntries
+// One AddressBookEntry per line, in exactly the JSON shape of the other endpoints.
+// See http://jsonlines.org/ and https://github.com/ndjson/ndjson-spec
+
+package addressbook
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// ndjsonEntryEncoder writes each AddressBookEntry as one line of JSON.
+type ndjsonEntryEncoder struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func newNDJSONEntryEncoder(w io.Writer) *ndjsonEntryEncoder {
+	bw := bufio.NewWriter(w)
+	return &ndjsonEntryEncoder{w: bw, enc: json.NewEncoder(bw)}
+}
+
+// NDJSON has no header
+func (e *ndjsonEntryEncoder) Begin() error {
+	return nil
+}
+
+// json.Encoder ends each value with a newline, which is exactly what NDJSON needs
+func (e *ndjsonEntryEncoder) Encode(abe *AddressBookEntry) error {
+	return e.enc.Encode(abe)
+}
+
+// NDJSON has no trailer either
+func (e *ndjsonEntryEncoder) End() error {
+	return nil
+}
+
+func (e *ndjsonEntryEncoder) Flush() error {
+	return e.w.Flush()
+}
+
+// ndjsonEntryDecoder reads one AddressBookEntry per line.  Blank lines are skipped.
+type ndjsonEntryDecoder struct {
+	r    *bufio.Reader
+	line int
+}
+
+func newNDJSONEntryDecoder(r io.Reader) *ndjsonEntryDecoder {
+	return &ndjsonEntryDecoder{r: bufio.NewReader(r)}
+}
+
+func (d *ndjsonEntryDecoder) Decode() (*AddressBookEntry, error) {
+	for {
+		line, err := d.r.ReadBytes('\n')
+		if 0 == len(line) && io.EOF == err {
+			return nil, io.EOF
+		}
+		if nil != err && io.EOF != err {
+			return nil, err
+		}
+		d.line++
+
+		line = bytes.TrimSpace(line)
+		if 0 == len(line) {
+			continue
+		}
+		// Unmarshal also rejects anything after the object, i.e. two objects on one line
+		var abe AddressBookEntry
+		if err := json.Unmarshal(line, &abe); nil != err {
+			return nil, &badRecordError{d.line, err}
+		}
+		return &abe, nil
+	}
+}
+
+func (d *ndjsonEntryDecoder) Record() int {
+	return d.line
+}
+
+// **************** NDJSON Handlers ****************
+
+func (a *Application) getAddressBookEntriesAsNDJSON(w http.ResponseWriter, r *http.Request) {
+	a.streamAddressBookEntries(w, r, serializers.get(ndjsonContentType), true)
+}
+
+// The request body is one AddressBookEntry per line.
+//	Takes the same *mode* and *atomic* query parameters as the CSV import.
+func (a *Application) addAddressBookEntriesFromNDJSON(w http.ResponseWriter, r *http.Request) {
+	mode, err := importModeFromRequest(r)
+	if nil != err {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	atomic, err := importAtomicFromRequest(r, mode)
+	if nil != err {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	a.importAddressBookEntries(w, r, newNDJSONEntryDecoder(r.Body), mode, atomic)
+}
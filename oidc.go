@@ -0,0 +1,244 @@
+// 2026.10.19 rjj: OIDC bearer tokens
+// Tokens from the organisation's identity provider are JWTs, checked against the provider's
+//	signing keys (a JWKS, from a URL or a local file), its issuer, our audience, and expiry.
+// Scopes come from the standard "scope" (or "scp") claim, and from roles mapped to scopes.
+
+package addressbook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// OIDCConfig says which tokens to accept.
+type OIDCConfig struct {
+	// Issuer must match the "iss" claim
+	Issuer string
+	// Audience must be one of the "aud" claim
+	Audience string
+	// JWKS is where the signing keys are: an http(s):// URL or a file
+	JWKS string
+	// RolesClaim names the claim listing the caller's roles, defaults to "roles"
+	RolesClaim string
+	// RoleScopes grants scopes to roles, e.g. {"contacts-editor": ["contacts:read", "contacts:write"]}
+	RoleScopes map[string][]string
+	// GroupsClaim names the claim listing the caller's teams, defaults to "groups"
+	GroupsClaim string
+	// Leeway allows for clock skew on exp and nbf, defaults to a minute
+	Leeway time.Duration
+}
+
+// oidcSignatureAlgorithms are the only ones accepted, never "none" or a symmetric one
+var oidcSignatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512, jose.EdDSA,
+}
+
+// jwksMaxAge is how long fetched keys are used before they are fetched again
+const jwksMaxAge = time.Hour
+
+// jwksMinRefresh limits how often an unknown key ID can cause a fetch
+const jwksMinRefresh = time.Minute
+
+// jwksCache holds the provider's keys, refetching them as they are rotated.  A fetch is made
+//	without holding mu, one at a time, and the keys it replaces are used until it is done.
+type jwksCache struct {
+	source string
+	client *http.Client
+
+	mu   sync.Mutex
+	keys jose.JSONWebKeySet
+	// fetched is when the keys were last fetched, tried when that was last attempted
+	fetched time.Time
+	tried   time.Time
+	// fetching is closed once the fetch under way, if any, is done
+	fetching chan struct{}
+}
+
+// fetch gets the keys from the source
+func (c *jwksCache) fetch() (jose.JSONWebKeySet, error) {
+	var keys jose.JSONWebKeySet
+	var b []byte
+	var err error
+	if strings.HasPrefix(c.source, "http://") || strings.HasPrefix(c.source, "https://") {
+		var resp *http.Response
+		if resp, err = c.client.Get(c.source); nil != err {
+			return keys, fmt.Errorf("Could not fetch JWKS: %v", err)
+		}
+		defer resp.Body.Close()
+		if http.StatusOK != resp.StatusCode {
+			return keys, fmt.Errorf("Could not fetch JWKS: %s", resp.Status)
+		}
+		// A JWKS is a few keys, not megabytes
+		b, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	} else {
+		b, err = os.ReadFile(c.source)
+	}
+	if nil != err {
+		return keys, fmt.Errorf("Could not read JWKS: %v", err)
+	}
+
+	if err := json.Unmarshal(b, &keys); nil != err {
+		return keys, fmt.Errorf("Bad JWKS: %v", err)
+	}
+	if 0 == len(keys.Keys) {
+		return keys, fmt.Errorf("JWKS has no keys")
+	}
+	return keys, nil
+}
+
+// load fetches the keys, keeping the old ones if that fails
+func (c *jwksCache) load() error {
+	keys, err := c.fetch()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tried = time.Now()
+	if nil != err {
+		return err
+	}
+	c.keys, c.fetched = keys, time.Now()
+	return nil
+}
+
+// refresh loads the keys, then closes done for those waiting on them
+func (c *jwksCache) refresh(done chan struct{}) {
+	if err := c.load(); nil != err {
+		slog.Error("jwksCache:: could not refresh the keys", "err", err)
+	}
+	c.mu.Lock()
+	c.fetching = nil
+	c.mu.Unlock()
+	close(done)
+}
+
+// find returns the keys with kid, all of them if kid is "", c.mu must be held
+func (c *jwksCache) find(kid string) []jose.JSONWebKey {
+	if "" == kid {
+		return c.keys.Keys
+	}
+	return c.keys.Key(kid)
+}
+
+// lookup returns the keys with kid, all of them if kid is "".  Stale keys, or an unknown kid,
+//	cause a fetch, at most every jwksMinRefresh.  Stale keys are returned without waiting for
+//	it, an unknown kid waits, as does every other lookup that comes while it is under way.
+func (c *jwksCache) lookup(kid string) []jose.JSONWebKey {
+	c.mu.Lock()
+	keys := c.find(kid)
+	stale := jwksMaxAge < time.Since(c.fetched) || 0 == len(keys)
+	if stale && nil == c.fetching && jwksMinRefresh < time.Since(c.tried) {
+		c.tried = time.Now()
+		c.fetching = make(chan struct{})
+		go c.refresh(c.fetching)
+	}
+	fetching := c.fetching
+	c.mu.Unlock()
+
+	if 0 < len(keys) || nil == fetching {
+		return keys
+	}
+	<-fetching
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.find(kid)
+}
+
+// oidcVerifier checks tokens against an OIDCConfig.
+type oidcVerifier struct {
+	cfg  OIDCConfig
+	jwks *jwksCache
+}
+
+func newOIDCVerifier(cfg OIDCConfig) (*oidcVerifier, error) {
+	if "" == cfg.Issuer || "" == cfg.Audience || "" == cfg.JWKS {
+		return nil, fmt.Errorf("OIDC needs an issuer, an audience and a JWKS")
+	}
+	if "" == cfg.RolesClaim {
+		cfg.RolesClaim = "roles"
+	}
+	if "" == cfg.GroupsClaim {
+		cfg.GroupsClaim = "groups"
+	}
+	if 0 == cfg.Leeway {
+		cfg.Leeway = jwt.DefaultLeeway
+	}
+	v := &oidcVerifier{
+		cfg:  cfg,
+		jwks: &jwksCache{source: cfg.JWKS, client: &http.Client{Timeout: 10 * time.Second}},
+	}
+	// Fail at start-up, not on the first request
+	if err := v.jwks.load(); nil != err {
+		return nil, err
+	}
+	return v, nil
+}
+
+// verify checks token, and returns who it was issued to.
+func (v *oidcVerifier) verify(token string) (*Identity, error) {
+	tok, err := jwt.ParseSigned(token, oidcSignatureAlgorithms)
+	if nil != err {
+		return nil, err
+	}
+
+	var claims jwt.Claims
+	var extra map[string]interface{}
+	err = fmt.Errorf("signed with an unknown key")
+	for _, key := range v.jwks.lookup(tok.Headers[0].KeyID) {
+		if err = tok.Claims(key, &claims, &extra); nil == err {
+			break
+		}
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	if nil == claims.Expiry {
+		return nil, fmt.Errorf("no expiry")
+	}
+	expected := jwt.Expected{Issuer: v.cfg.Issuer, AnyAudience: jwt.Audience{v.cfg.Audience}, Time: time.Now()}
+	if err := claims.ValidateWithLeeway(expected, v.cfg.Leeway); nil != err {
+		return nil, err
+	}
+	if "" == claims.Subject {
+		return nil, fmt.Errorf("no subject")
+	}
+	return &Identity{Subject: subjectOIDC + claims.Subject, Scopes: v.scopes(extra), Groups: claimStrings(extra[v.cfg.GroupsClaim])}, nil
+}
+
+// scopes maps a token's claims to our scopes
+func (v *oidcVerifier) scopes(claims map[string]interface{}) []string {
+	scopes := []string{}
+	scopes = append(scopes, claimStrings(claims["scope"])...)
+	scopes = append(scopes, claimStrings(claims["scp"])...)
+	for _, role := range claimStrings(claims[v.cfg.RolesClaim]) {
+		scopes = append(scopes, v.cfg.RoleScopes[role]...)
+	}
+	return scopes
+}
+
+// claimStrings reads a claim that is either a space separated string or a list of strings
+func claimStrings(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return strings.Fields(c)
+	case []interface{}:
+		s := []string{}
+		for _, v := range c {
+			if str, ok := v.(string); ok {
+				s = append(s, str)
+			}
+		}
+		return s
+	}
+	return nil
+}
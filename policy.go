@@ -0,0 +1,218 @@
+// 2026.10.19 rjj: Who may do what to an address book
+// A caller has a role on each book: its owner (or a member of the owning team) is an owner,
+//	others have whatever role the book's grants give them, or none.  Every book route is
+//	wrapped by allow with the role it needs, see bookRoutes in config.go:
+//		viewer  reads and exports entries
+//		editor  also writes and imports them
+//		owner   also shares the book, by managing its grants
+// Admins are owners of every book, and everyone is an editor of a shared book, e.g. the default one.
+
+package addressbook
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// BookRole is what a caller may do to an AddressBook.
+type BookRole string
+
+const (
+	RoleViewer BookRole = "viewer"
+	RoleEditor BookRole = "editor"
+	RoleOwner  BookRole = "owner"
+)
+
+// bookRoleRank orders the roles, each can do everything the ones below it can
+var bookRoleRank = map[BookRole]int{RoleViewer: 1, RoleEditor: 2, RoleOwner: 3}
+
+// covers reports whether role is at least need
+func (role BookRole) covers(need BookRole) bool {
+	return bookRoleRank[role] >= bookRoleRank[need]
+}
+
+// BookGrant gives a user or team a role on an AddressBook.
+type BookGrant struct {
+	// Grantee is "user:<subject>", e.g. user:oidc:alice, or "team:<group>", like an AddressBook's Owner
+	Grantee     string    `json:"grantee"`
+	Role        BookRole  `json:"role"`
+	CreatedDate time.Time `json:"createdDate"`
+}
+
+// BookGrantDatabase stores BookGrants.
+type BookGrantDatabase interface {
+	// SetBookGrant gives grantee role on the book, replacing any role they had.
+	SetBookGrant(bookID int64, grantee string, role BookRole) error
+
+	// DeleteBookGrant takes away grantee's role on the book, sql.ErrNoRows if they had none.
+	DeleteBookGrant(bookID int64, grantee string) error
+
+	// ListBookGrants returns the grants on the book, by grantee.
+	ListBookGrants(bookID int64) ([]*BookGrant, error)
+
+	// BookRoles returns, for each book with a grant to any of grantees, the highest role granted.
+	BookRoles(grantees []string) (map[int64]BookRole, error)
+}
+
+// grantees are the names the caller can be granted a role under
+func (id *Identity) grantees() []string {
+	names := []string{bookOwnerUser + id.Subject}
+	for _, g := range id.Groups {
+		names = append(names, bookOwnerTeam+g)
+	}
+	return names
+}
+
+// bookRole returns the caller's role on book, "" if they have none.  grants are the caller's
+//	BookRoles, nil to look them up.
+func (a *Application) bookRole(r *http.Request, book *AddressBook, grants map[int64]BookRole) (BookRole, error) {
+	if a.AuthDisabled {
+		return RoleOwner, nil
+	}
+	id, ok := IdentityFromContext(r.Context())
+	if !ok {
+		return "", nil
+	}
+	if id.HasScope(ScopeAdmin) || id.owns(book.Owner) {
+		return RoleOwner, nil
+	}
+
+	if nil == grants {
+		var err error
+		if grants, err = a.traced(r.Context()).BookRoles(id.grantees()); nil != err {
+			return "", err
+		}
+	}
+	role := grants[book.ID]
+	if "" == book.Owner && !role.covers(RoleEditor) {
+		role = RoleEditor
+	}
+	return role, nil
+}
+
+// bookRoleKey holds the caller's role on requestBook
+type bookRoleKey struct{}
+
+// requestBookRole is the caller's role on the book r works on.
+func requestBookRole(r *http.Request) BookRole {
+	role, _ := r.Context().Value(bookRoleKey{}).(BookRole)
+	return role
+}
+
+// allow finds the book r is about, the one in the URL or the default one, and lets the request
+//	through only if the caller's role on it is at least need.  A book they have no role on is a
+//	404, the same as one that does not exist, so names do not leak; too low a role is a 403.
+func (a *Application) allow(need BookRole, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, ok := mux.Vars(r)["book"]
+		if !ok {
+			name = defaultBookName
+		}
+		book, err := a.traced(r.Context()).GetAddressBook(name)
+		if nil != err && sql.ErrNoRows != err {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var role BookRole
+		if nil == err {
+			if role, err = a.bookRole(r, book, nil); nil != err {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		if "" == role {
+			respondWithError(w, http.StatusNotFound, fmt.Sprintf("AddressBook (%s) not found.", name))
+			return
+		}
+		if !role.covers(need) {
+			respondWithProblem(w, r, http.StatusForbidden,
+				fmt.Sprintf("This needs the %s role on address book (%s), yours is %s", need, name, role))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), bookKey{}, book)
+		h(w, r.WithContext(context.WithValue(ctx, bookRoleKey{}, role)))
+	}
+}
+
+// **************** Grant Handlers ****************
+
+// granteeForms says what validGrantee takes
+const granteeForms = "use user:key:<name>, user:oidc:<subject>, user:cert:<common name> or team:<name>"
+
+// validGrantee reports whether s is "team:<name>", or "user:<subject>" with the subject's source
+func validGrantee(s string) bool {
+	if name, ok := strings.CutPrefix(s, bookOwnerTeam); ok {
+		return "" != name
+	}
+	subject, ok := strings.CutPrefix(s, bookOwnerUser)
+	if !ok {
+		return false
+	}
+	for _, source := range []string{subjectKey, subjectOIDC, subjectCert} {
+		if name, ok := strings.CutPrefix(subject, source); ok {
+			return "" != name
+		}
+	}
+	return false
+}
+
+func (a *Application) getBookGrants(w http.ResponseWriter, r *http.Request) {
+	grants, err := a.traced(r.Context()).ListBookGrants(requestBookID(r))
+	if nil != err {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, grants)
+}
+
+// bookGrantRequest is the body of PUT /books/{book}/grants/{grantee}, e.g. {"role": "editor"}
+type bookGrantRequest struct {
+	Role BookRole `json:"role"`
+}
+
+func (a *Application) setBookGrant(w http.ResponseWriter, r *http.Request) {
+	grantee := mux.Vars(r)["grantee"]
+	var req bookGrantRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if !validGrantee(grantee) {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Bad grantee (%s), %s", grantee, granteeForms))
+		return
+	}
+	if _, ok := bookRoleRank[req.Role]; !ok {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("Bad role (%s), use %s, %s or %s", req.Role, RoleViewer, RoleEditor, RoleOwner))
+		return
+	}
+	auditDetail(r, "%s is %s of %s", grantee, req.Role, requestBook(r).Name)
+
+	if err := a.traced(r.Context()).SetBookGrant(requestBookID(r), grantee, req.Role); nil != err {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.getBookGrants(w, r)
+}
+
+func (a *Application) deleteBookGrant(w http.ResponseWriter, r *http.Request) {
+	grantee := mux.Vars(r)["grantee"]
+	auditDetail(r, "%s of %s", grantee, requestBook(r).Name)
+
+	if err := a.traced(r.Context()).DeleteBookGrant(requestBookID(r), grantee); nil != err {
+		if sql.ErrNoRows == err {
+			respondWithError(w, http.StatusNotFound, fmt.Sprintf("No grant to (%s) on address book (%s).", grantee, requestBook(r).Name))
+		} else {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
@@ -0,0 +1,193 @@
+// 2026.10.19 rjj: Rate limiting
+// Each client has a token bucket for each group of routes: reads, writes, and bulk imports and
+//	exports.  A request takes a token, tokens come back at the group's rate up to its burst, and
+//	a request that finds none is a 429.  Every limited response tells the client where it stands,
+//	in the RateLimit-* headers of the IETF draft, and a 429 also has a Retry-After.
+// A client is its API key, or its token's subject.  Only with authentication disabled is it
+//	the IP address.  The buckets are in memory, so each instance of the server has its own.
+// Failed authentications, which have no client yet, spend the auth budget of their IP address,
+//	and while it is spent every request from there is a 429 before its credentials are looked at.
+
+package addressbook
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitGroup is a set of routes that share a budget, see initializeRoutes.
+type RateLimitGroup string
+
+const (
+	// RateLimitRead reads books, entries and their history
+	RateLimitRead RateLimitGroup = "read"
+	// RateLimitWrite changes them
+	RateLimitWrite RateLimitGroup = "write"
+	// RateLimitBulk is imports, exports and anything else that goes through every entry
+	RateLimitBulk RateLimitGroup = "bulk"
+	// RateLimitAuth is failed authentications, by IP address, see authenticate
+	RateLimitAuth RateLimitGroup = "auth"
+)
+
+// RateLimit is a group's budget: Burst requests at once, then Rate a second.  A Rate of 0 is unlimited.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// defaultRateLimits are for the groups Application.RateLimits leaves out
+var defaultRateLimits = map[RateLimitGroup]RateLimit{
+	RateLimitRead:  {Rate: 20, Burst: 100},
+	RateLimitWrite: {Rate: 5, Burst: 20},
+	RateLimitBulk:  {Rate: 0.1, Burst: 3},
+	RateLimitAuth:  {Rate: 0.2, Burst: 10},
+}
+
+// rateLimitSweepInterval is how often buckets that have filled up again are dropped
+const rateLimitSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds one group's buckets, by client
+type rateLimiter struct {
+	limit   RateLimit
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if 1 > limit.Burst {
+		limit.Burst = 1
+	}
+	return &rateLimiter{limit: limit, buckets: map[string]*tokenBucket{}, swept: time.Now()}
+}
+
+// refill adds the tokens that came back since b was last used, and returns how long until it is full
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) time.Duration {
+	burst := float64(l.limit.Burst)
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+	return time.Duration((burst - b.tokens) / l.limit.Rate * float64(time.Second))
+}
+
+// take spends one of key's tokens, if it has one.  It returns the tokens left, how long until
+//	key's bucket is full again, and, if there was no token, how long until there is one.
+func (l *rateLimiter) take(key string, now time.Time) (ok bool, remaining int, reset, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rateLimitSweepInterval < now.Sub(l.swept) {
+		// A full bucket is the same as none
+		for k, b := range l.buckets {
+			if 0 == l.refill(b, now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &tokenBucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if 1 <= b.tokens {
+		b.tokens--
+		ok = true
+	} else {
+		wait = l.wait(b)
+	}
+	return ok, int(b.tokens), l.refill(b, now), wait
+}
+
+// wait is how long until b, just refilled, has a token
+func (l *rateLimiter) wait(b *tokenBucket) time.Duration {
+	if 1 <= b.tokens {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+}
+
+// waiting is how long until key has a token, 0 if it has one now, without spending it
+func (l *rateLimiter) waiting(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, found := l.buckets[key]
+	if !found {
+		return 0
+	}
+	l.refill(b, now)
+	return l.wait(b)
+}
+
+// rateLimitKey is who r is, for their buckets
+func rateLimitKey(r *http.Request) string {
+	if id, ok := IdentityFromContext(r.Context()); ok {
+		if 0 != id.KeyID {
+			return fmt.Sprintf("key:%d", id.KeyID)
+		}
+		return "sub:" + id.Subject
+	}
+	return "ip:" + sourceIP(r)
+}
+
+// seconds rounds d up to whole seconds, as the headers want them
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// limiter is group's limiter, made from a.RateLimits the first time, nil if it is unlimited
+func (a *Application) limiter(group RateLimitGroup) *rateLimiter {
+	l, ok := a.limiters[group]
+	if !ok {
+		limit, set := a.RateLimits[group]
+		if !set {
+			limit = defaultRateLimits[group]
+		}
+		if 0 < limit.Rate {
+			l = newRateLimiter(limit)
+		}
+		if nil == a.limiters {
+			a.limiters = map[RateLimitGroup]*rateLimiter{}
+		}
+		a.limiters[group] = l
+	}
+	return l
+}
+
+// respondRateLimited is the 429 for group, after wait
+func respondRateLimited(w http.ResponseWriter, r *http.Request, group RateLimitGroup, wait time.Duration) {
+	w.Header().Set("Retry-After", seconds(wait))
+	respondWithProblem(w, r, http.StatusTooManyRequests,
+		fmt.Sprintf("Too many %s requests, try again in %s seconds", group, seconds(wait)))
+}
+
+// limited counts the request against the caller's budget for group, refusing it with a 429 once
+//	the budget is spent.  The limiters are made as the routes are, from a.RateLimits.
+func (a *Application) limited(group RateLimitGroup, h http.HandlerFunc) http.HandlerFunc {
+	l := a.limiter(group)
+	if nil == l {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, remaining, reset, wait := l.take(rateLimitKey(r), time.Now())
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(l.limit.Burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Reset", seconds(reset))
+		if !ok {
+			respondRateLimited(w, r, group, wait)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,57 @@
+// 2026.10.19 rjj: Keeping the server up
+// A bug in one request must not take down the rest: a panic in a handler is recovered, and a
+//	response that can not be encoded is a 500, instead of the log.Fatal it once was.  Either
+//	is logged with its stack and the request's ID, and counted, see metrics.go.
+
+package addressbook
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// respondWithEncodingFailure is a 500 for a response that could not be encoded, e.g. by
+//	json.Marshal.  Nothing has been sent yet, so the client at least gets a problem.
+func respondWithEncodingFailure(w http.ResponseWriter, err error) {
+	id := w.Header().Get(requestIDHeader)
+	slog.Error("respondWithEncodingFailure:: could not encode the response",
+		"request_id", id, "err", err, "stack", string(debug.Stack()))
+	internalErrors.WithLabelValues(internalErrorEncoding).Inc()
+
+	writeProblem(w, &problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(http.StatusInternalServerError),
+		Status:    http.StatusInternalServerError,
+		Detail:    "The response could not be encoded",
+		RequestID: id,
+	})
+}
+
+// recoverPanics turns a panic in a handler into a 500 problem, or, once the response has
+//	started, aborts it so a truncated one is not taken for whole.  http.ErrAbortHandler is how
+//	a handler aborts on purpose, see streamAddressBookEntries, so it is passed on as is.
+func (a *Application) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if nil == p {
+				return
+			}
+			if http.ErrAbortHandler == p {
+				panic(p)
+			}
+
+			slog.ErrorContext(r.Context(), "recoverPanics:: handler panicked",
+				"method", r.Method, "path", r.URL.Path, "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+			internalErrors.WithLabelValues(internalErrorPanic).Inc()
+			if 0 != rw.status {
+				panic(http.ErrAbortHandler)
+			}
+			respondWithProblem(w, r, http.StatusInternalServerError, "The request could not be handled")
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
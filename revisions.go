@@ -0,0 +1,149 @@
+// 2026.10.18 rjj: Revision history
+// Every write to an AddressBookEntry appends a Revision: who made it, when, what the entry
+//	looked like afterwards and what changed.  PUT replaces the whole entry, so an accidental
+//	overwrite can be undone by reverting to an earlier revision.
+
+package addressbook
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RevisionAction is the kind of write a Revision records.
+type RevisionAction string
+
+const (
+	RevisionCreate  RevisionAction = "create"
+	RevisionUpdate  RevisionAction = "update"
+	RevisionDelete  RevisionAction = "delete"
+	RevisionRestore RevisionAction = "restore"
+	RevisionImport  RevisionAction = "import"
+	RevisionMerge   RevisionAction = "merge"
+	RevisionRevert  RevisionAction = "revert"
+	// RevisionBaseline is the entry as it was when its history began, for one from before there
+	//	was any, so its first change can be undone too
+	RevisionBaseline RevisionAction = "baseline"
+)
+
+// Revision is one write to an AddressBookEntry.
+type Revision struct {
+	EntryID int64          `json:"entryId"`
+	// Rev counts up from 1 for each entry
+	Rev     int            `json:"rev"`
+	Date    time.Time      `json:"date"`
+	Actor   string         `json:"actor"`
+	Action  RevisionAction `json:"action"`
+	// Entry is the AddressBookEntry as it was after the write
+	Entry   *AddressBookEntry      `json:"entry"`
+	Diff    map[string]FieldChange `json:"diff"`
+}
+
+// FieldChange is a field's value before and after a write.
+type FieldChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// systemActor makes the writes no caller asked for, e.g. from the command line
+const systemActor = "system"
+
+// diffAddressBookEntries lists the fields that differ, before is nil for a new entry.
+func diffAddressBookEntries(before, after *AddressBookEntry) map[string]FieldChange {
+	if nil == before {
+		before = &AddressBookEntry{}
+	}
+	diff := map[string]FieldChange{}
+	for field, value := range mergeFields {
+		if from, to := *value(before), *value(after); from != to {
+			diff[field] = FieldChange{From: from, To: to}
+		}
+	}
+	return diff
+}
+
+// revisionSnapshot is the entry as kept in a Revision, the fields only
+func revisionSnapshot(abe *AddressBookEntry) *AddressBookEntry {
+	snapshot := *abe
+	snapshot.DeletedAt = nil
+	return &snapshot
+}
+
+// requestActor names the caller of r, for the history and audit log: their subject, e.g.
+//	key:<the name of their API key>, or with authentication off, the address they called from.
+func requestActor(r *http.Request) string {
+	if id, ok := IdentityFromContext(r.Context()); ok {
+		return id.Subject
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if nil != err || "" == host {
+		return "unknown"
+	}
+	return host
+}
+
+// db is the AddressBookDatabase as used by the caller of r: confined to the book in the URL,
+//	with their writes attributed to them, and its calls traced as part of r, see tracing.go.
+func (a *Application) db(r *http.Request) AddressBookDatabase {
+	return a.traced(r.Context()).WithBook(requestBookID(r)).WithActor(requestActor(r))
+}
+
+// **************** Revision Handlers ****************
+
+func (a *Application) getAddressBookEntryHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"],10,64)
+	if nil != err {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Bad AddressBookEntry ID (%v)", vars["id"]))
+		return
+	}
+
+	revs, err := a.db(r).ListRevisions(id)
+	if nil != err {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Every entry has at least the revision that created it
+	if 0 == len(revs) {
+		respondWithError(w, http.StatusNotFound, fmt.Sprintf("AddressBookEntry with ID (%d) not found.", id))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, revs)
+}
+
+// Reverting is itself a write, so it adds a revision rather than removing the later ones.
+func (a *Application) revertAddressBookEntry(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"],10,64)
+	if nil != err {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Bad AddressBookEntry ID (%v)", vars["id"]))
+		return
+	}
+	rev, err := strconv.Atoi(vars["rev"])
+	if nil != err {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Bad revision (%v)", vars["rev"]))
+		return
+	}
+
+	auditEntities(r, id)
+	auditDetail(r, "to revision %d", rev)
+	abe, err := a.db(r).RevertAddressBookEntry(id, rev)
+	if nil != err {
+		if _, ok := err.(*EntryNotFoundError); ok {
+			respondWithError(w, http.StatusNotFound, err.Error())
+		} else if sql.ErrNoRows == err {
+			respondWithError(w, http.StatusNotFound,
+				fmt.Sprintf("AddressBookEntry with ID (%d) has no revision %d.", id, rev))
+		} else {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	respondWithJSON(w, http.StatusOK, abe)
+}
@@ -0,0 +1,331 @@
+// 2026.10.18 rjj: Serializer registry and Accept header content negotiation
+// Every format an AddressBookEntry can be written in is registered here once, and is then
+//	available to the list and get endpoints (via Accept) and to the export endpoints.
+// To add a format: write an entryEncoder for it and add it to newSerializerRegistry.
+
+package addressbook
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// serializer writes AddressBookEntries in one media type.
+type serializer struct {
+	// MediaType is sent as the Content-Type, and matched against Accept
+	MediaType string
+	// Aliases are other media types accepted for the same format, e.g. text/xml
+	Aliases []string
+	// FileExt is used to name export downloads
+	FileExt string
+	// NewEncoder returns an encoder writing to w.  single is set when exactly one entry
+	//	will be written, for formats where that looks different from a list (e.g. JSON).
+	//	The request is passed for format options, e.g. the vCard version.
+	NewEncoder func(w io.Writer, r *http.Request, single bool) (entryEncoder, error)
+}
+
+// serializerRegistry is the list of supported formats, the first one is the default.
+type serializerRegistry struct {
+	serializers []*serializer
+}
+
+func newSerializerRegistry() *serializerRegistry {
+	reg := &serializerRegistry{}
+	reg.register(&serializer{
+		MediaType: "application/json",
+		FileExt:   "json",
+		NewEncoder: func(w io.Writer, r *http.Request, single bool) (entryEncoder, error) {
+			return &jsonEntryEncoder{w: bufio.NewWriter(w), single: single}, nil
+		},
+	})
+	reg.register(&serializer{
+		MediaType: "text/csv",
+		FileExt:   "csv",
+		NewEncoder: func(w io.Writer, r *http.Request, single bool) (entryEncoder, error) {
+			return &csvEntryEncoder{csv.NewWriter( w )}, nil
+		},
+	})
+	reg.register(&serializer{
+		MediaType: "text/vcard",
+		Aliases:   []string{"text/x-vcard", "text/directory"},
+		FileExt:   "vcf",
+		NewEncoder: func(w io.Writer, r *http.Request, single bool) (entryEncoder, error) {
+			version, err := vCardVersionFromRequest(r)
+			if nil != err {
+				return nil, err
+			}
+			return newVCardEncoder(w, version), nil
+		},
+	})
+	reg.register(&serializer{
+		MediaType: ndjsonContentType,
+		Aliases:   []string{"application/jsonl", "application/x-jsonlines"},
+		FileExt:   "ndjson",
+		NewEncoder: func(w io.Writer, r *http.Request, single bool) (entryEncoder, error) {
+			return newNDJSONEntryEncoder(w), nil
+		},
+	})
+	reg.register(&serializer{
+		MediaType: "application/xml",
+		Aliases:   []string{"text/xml"},
+		FileExt:   "xml",
+		NewEncoder: func(w io.Writer, r *http.Request, single bool) (entryEncoder, error) {
+			return newXMLEntryEncoder(w, single), nil
+		},
+	})
+	return reg
+}
+
+// serializers are the formats the Application can respond with.
+var serializers = newSerializerRegistry()
+
+func (reg *serializerRegistry) register(s *serializer) {
+	reg.serializers = append(reg.serializers, s)
+}
+
+// get returns the serializer registered for mediaType, or nil.
+func (reg *serializerRegistry) get(mediaType string) *serializer {
+	for _, s := range reg.serializers {
+		for _, name := range s.names() {
+			if strings.EqualFold(name, mediaType) {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// mediaTypes lists the primary media types, for 406 responses.
+func (reg *serializerRegistry) mediaTypes() []string {
+	var types []string
+	for _, s := range reg.serializers {
+		types = append(types, s.MediaType)
+	}
+	return types
+}
+
+func (s *serializer) names() []string {
+	return append([]string{s.MediaType}, s.Aliases...)
+}
+
+// negotiate picks the serializer that best matches an Accept header, RFC 7231 5.3.2, or nil if none
+//	is acceptable.  No Accept header at all means anything goes, so the default (JSON).
+//	Between equal q values the more specific media range wins, e.g. for "text/csv, */*" it is CSV,
+//	and after that the registry order.
+func (reg *serializerRegistry) negotiate(accept string) *serializer {
+	if "" == strings.TrimSpace(accept) {
+		return reg.serializers[0]
+	}
+	ranges := parseAccept(accept)
+
+	var best *serializer
+	var bestQ float64
+	bestSpecificity := -1
+	for _, s := range reg.serializers {
+		q, specificity := s.quality(ranges)
+		if 0 < q && (q > bestQ || (q == bestQ && specificity > bestSpecificity)) {
+			best, bestQ, bestSpecificity = s, q, specificity
+		}
+	}
+	return best
+}
+
+// acceptRange is one media range of an Accept header, e.g. text/*;q=0.5
+type acceptRange struct {
+	Type, Subtype string
+	Q             float64
+}
+
+func parseAccept(accept string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+		slash := strings.IndexByte(mediaRange, '/')
+		if -1 == slash {
+			continue
+		}
+
+		ar := acceptRange{Type: mediaRange[:slash], Subtype: mediaRange[slash+1:], Q: 1}
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if 2 == len(kv) && strings.EqualFold("q", kv[0]) {
+				if q, err := strconv.ParseFloat(kv[1], 64); nil == err {
+					ar.Q = q
+				}
+			}
+		}
+		ranges = append(ranges, ar)
+	}
+	return ranges
+}
+
+// quality is the q value of the most specific range matching any of s.names(), and how specific
+//	that match was: 2 for type/subtype, 1 for type/*, 0 for */*
+func (s *serializer) quality(ranges []acceptRange) (float64, int) {
+	var q float64
+	specificity := -1
+	for _, name := range s.names() {
+		slash := strings.IndexByte(name, '/')
+		typ, subtype := name[:slash], name[slash+1:]
+		for _, ar := range ranges {
+			var sp int
+			switch {
+			case typ == ar.Type && subtype == ar.Subtype:
+				sp = 2
+			case typ == ar.Type && "*" == ar.Subtype:
+				sp = 1
+			case "*" == ar.Type && "*" == ar.Subtype:
+				sp = 0
+			default:
+				continue
+			}
+			if sp > specificity {
+				q, specificity = ar.Q, sp
+			}
+		}
+	}
+	return q, specificity
+}
+
+// negotiateSerializer picks the serializer for the request, or responds 406 and returns nil.
+func negotiateSerializer(w http.ResponseWriter, r *http.Request) *serializer {
+	// Caches must not hand one format to a client that asked for another
+	w.Header().Add("Vary", "Accept")
+
+	s := serializers.negotiate(r.Header.Get("Accept"))
+	if nil == s {
+		respondWithError(w, http.StatusNotAcceptable,
+			fmt.Sprintf("None of the accepted media types (%s) are supported, use one of: %s",
+				r.Header.Get("Accept"), strings.Join(serializers.mediaTypes(), ", ")))
+	}
+	return s
+}
+
+// respondWithEntry writes a single AddressBookEntry using s.  download adds a Content-Disposition,
+//	so browsers save it as a file.
+func respondWithEntry(w http.ResponseWriter, r *http.Request, statusCode int, s *serializer, abe *AddressBookEntry, download bool) {
+	b := &bytes.Buffer{}
+	enc, err := s.NewEncoder(b, r, true)
+	if nil != err {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err = enc.Begin(); nil == err {
+		if err = enc.Encode(abe); nil == err {
+			if err = enc.End(); nil == err {
+				err = enc.Flush()
+			}
+		}
+	}
+	if nil != err {
+		respondWithEncodingFailure(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", s.MediaType)
+	if download {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment;filename=AddressBookEntry-%d.%s", abe.ID, s.FileExt))
+	}
+	w.WriteHeader(statusCode)
+	w.Write(b.Bytes())
+}
+
+// **************** JSON ****************
+
+// jsonEntryEncoder writes a JSON array of entries, or a single object.
+//	The bytes are the same as json.Marshal of the slice or entry, i.e. respondWithJSON.
+type jsonEntryEncoder struct {
+	w      *bufio.Writer
+	single bool
+	cnt    int
+}
+
+func (e *jsonEntryEncoder) Begin() error {
+	if e.single {
+		return nil
+	}
+	return e.w.WriteByte('[')
+}
+
+func (e *jsonEntryEncoder) Encode(abe *AddressBookEntry) error {
+	b, err := json.Marshal(abe)
+	if nil != err {
+		return err
+	}
+	if 0 < e.cnt {
+		if err := e.w.WriteByte(','); nil != err {
+			return err
+		}
+	}
+	e.cnt++
+	_, err = e.w.Write(b)
+	return err
+}
+
+func (e *jsonEntryEncoder) End() error {
+	if e.single {
+		return nil
+	}
+	return e.w.WriteByte(']')
+}
+
+func (e *jsonEntryEncoder) Flush() error {
+	return e.w.Flush()
+}
+
+// **************** XML ****************
+
+// xmlEntryEncoder writes <addressbookentries><addressbookentry>...</addressbookentry></addressbookentries>
+//	or, for a single entry, just the <addressbookentry>.
+type xmlEntryEncoder struct {
+	w      *bufio.Writer
+	enc    *xml.Encoder
+	single bool
+}
+
+var (
+	xmlListElement  = xml.StartElement{Name: xml.Name{Local: "addressbookentries"}}
+	xmlEntryElement = xml.StartElement{Name: xml.Name{Local: "addressbookentry"}}
+)
+
+func newXMLEntryEncoder(w io.Writer, single bool) *xmlEntryEncoder {
+	bw := bufio.NewWriter(w)
+	return &xmlEntryEncoder{w: bw, enc: xml.NewEncoder(bw), single: single}
+}
+
+func (e *xmlEntryEncoder) Begin() error {
+	if _, err := e.w.WriteString(xml.Header); nil != err {
+		return err
+	}
+	if e.single {
+		return nil
+	}
+	return e.enc.EncodeToken(xmlListElement)
+}
+
+func (e *xmlEntryEncoder) Encode(abe *AddressBookEntry) error {
+	return e.enc.EncodeElement(abe, xmlEntryElement)
+}
+
+func (e *xmlEntryEncoder) End() error {
+	if e.single {
+		return nil
+	}
+	return e.enc.EncodeToken(xmlListElement.End())
+}
+
+func (e *xmlEntryEncoder) Flush() error {
+	if err := e.enc.Flush(); nil != err {
+		return err
+	}
+	return e.w.Flush()
+}
@@ -0,0 +1,166 @@
+// 2026.10.19 rjj: HTTPS, and client certificates
+// With a TLSConfig, Run serves HTTPS.  The certificate and key files are read again once they
+//	change, so a renewed certificate is picked up without a restart.  With a ClientCAFile, clients
+//	may, or with RequireClientCert must, present a certificate signed by one of its CAs.
+// A verified client certificate authenticates a request that has no Authorization header: the
+//	caller is the certificate's subject common name, with the scopes ClientScopes gives it, see
+//	auth.go.  A request with a bearer is authenticated by that, whatever its certificate.
+
+package addressbook
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig is where the server's certificate is, and which client certificates to accept.
+type TLSConfig struct {
+	// CertFile and KeyFile are PEM, the certificate file may have the chain after the certificate
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, if set, is a PEM bundle of the CAs client certificates are verified against
+	ClientCAFile string
+	// RequireClientCert refuses the connection of a client without a certificate
+	RequireClientCert bool
+	// ClientScopes grants scopes to client certificates, by subject common name,
+	//	e.g. {"crm-sync": ["contacts:read", "contacts:write"]}.  Any other certificate is a 401.
+	ClientScopes map[string][]string
+}
+
+// tlsReloadInterval is how often the files are checked for a change
+const tlsReloadInterval = 10 * time.Second
+
+// tlsFiles holds what was last read from a TLSConfig's files
+type tlsFiles struct {
+	cfg TLSConfig
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	// modTimes are the files' when they were read, checked when they were last looked at
+	modTimes []time.Time
+	checked  time.Time
+}
+
+func newTLSFiles(cfg TLSConfig) (*tlsFiles, error) {
+	if "" == cfg.CertFile || "" == cfg.KeyFile {
+		return nil, fmt.Errorf("TLS needs a certificate and a key file")
+	}
+	if cfg.RequireClientCert && "" == cfg.ClientCAFile {
+		return nil, fmt.Errorf("Requiring client certificates needs a client CA file")
+	}
+	f := &tlsFiles{cfg: cfg}
+	if err := f.load(); nil != err {
+		return nil, err
+	}
+	return f, nil
+}
+
+// stat returns the files' modification times
+func (f *tlsFiles) stat() ([]time.Time, error) {
+	names := []string{f.cfg.CertFile, f.cfg.KeyFile}
+	if "" != f.cfg.ClientCAFile {
+		names = append(names, f.cfg.ClientCAFile)
+	}
+	mod := make([]time.Time, len(names))
+	for i, name := range names {
+		fi, err := os.Stat(name)
+		if nil != err {
+			return nil, err
+		}
+		mod[i] = fi.ModTime()
+	}
+	return mod, nil
+}
+
+// load reads the files, keeping what was read before if any of them is no good
+func (f *tlsFiles) load() error {
+	f.checked = time.Now()
+	mod, err := f.stat()
+	if nil != err {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(f.cfg.CertFile, f.cfg.KeyFile)
+	if nil != err {
+		return fmt.Errorf("Could not load the TLS certificate: %v", err)
+	}
+	var pool *x509.CertPool
+	if "" != f.cfg.ClientCAFile {
+		pem, err := os.ReadFile(f.cfg.ClientCAFile)
+		if nil != err {
+			return fmt.Errorf("Could not read the client CAs: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates in the client CA file (%s)", f.cfg.ClientCAFile)
+		}
+	}
+	f.cert, f.clientCAs, f.modTimes = &cert, pool, mod
+	return nil
+}
+
+// reload loads the files again if they have changed, looking at most every tlsReloadInterval.
+//	A renewal is often two writes, so a bad pair is logged and the old one kept until the next look.
+func (f *tlsFiles) reload() {
+	if tlsReloadInterval > time.Since(f.checked) {
+		return
+	}
+	f.checked = time.Now()
+	mod, err := f.stat()
+	if nil == err {
+		changed := len(mod) != len(f.modTimes)
+		for i := 0; !changed && i < len(mod); i++ {
+			changed = !mod[i].Equal(f.modTimes[i])
+		}
+		if !changed {
+			return
+		}
+		if err = f.load(); nil == err {
+			slog.Info("tlsFiles:: reloaded", "cert", f.cfg.CertFile)
+			return
+		}
+	}
+	slog.Error("tlsFiles:: keeping the certificate already loaded", "err", err)
+}
+
+// configForClient is the tls.Config for each connection, from the files as they are now
+func (f *tlsFiles) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	f.mu.Lock()
+	f.reload()
+	cert, pool := f.cert, f.clientCAs
+	f.mu.Unlock()
+
+	c := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if nil != pool {
+		c.ClientCAs = pool
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		if f.cfg.RequireClientCert {
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return c, nil
+}
+
+// clientCertIdentity is the caller of r by their verified client certificate, nil if they did
+//	not present one.  A certificate ClientScopes does not know is an error.
+func (a *Application) clientCertIdentity(r *http.Request) (*Identity, error) {
+	if nil == a.TLS || nil == r.TLS || 0 == len(r.TLS.VerifiedChains) {
+		return nil, nil
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	scopes, ok := a.TLS.ClientScopes[cn]
+	if !ok || "" == cn {
+		return nil, fmt.Errorf("Client certificate (%s) is not allowed", cn)
+	}
+	return &Identity{Subject: subjectCert + cn, Scopes: scopes}, nil
+}
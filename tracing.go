@@ -0,0 +1,127 @@
+// 2026.10.19 rjj: Tracing, with OpenTelemetry
+// With a TracingConfig each request is a span, named for its method and route template, and
+//	each AddressBookDatabase call it makes is a child span, see db_traced.go.  A caller's W3C
+//	traceparent header makes the request's span part of the caller's trace.  Background import
+//	jobs are a trace each.  Log lines about a traced request have its trace_id, see logging.go.
+// Spans go to an OpenTelemetry collector over OTLP/HTTP, or to stdout for tests and debugging.
+
+package addressbook
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// The exporters a TracingConfig can name
+const (
+	// TracingOTLP sends spans to a collector, over OTLP/HTTP
+	TracingOTLP = "otlp"
+	// TracingStdout writes spans as JSON, one per line
+	TracingStdout = "stdout"
+)
+
+// TracingConfig says where spans go.
+type TracingConfig struct {
+	// Exporter is TracingOTLP or TracingStdout
+	Exporter string
+	// Endpoint is the collector's host:port, e.g. "localhost:4318".  Left empty, the
+	//	OTEL_EXPORTER_OTLP_* environment variables say, or the default, localhost:4318.
+	Endpoint string
+	// Insecure sends spans to the collector over plain HTTP, as to one on the same host
+	Insecure bool
+	// SampleRatio is the share of new traces kept, 0 keeps every one.  A trace the caller
+	//	started is kept if the caller kept it.
+	SampleRatio float64
+	// ServiceName defaults to "addressbook"
+	ServiceName string
+	// Output is where TracingStdout writes, defaults to os.Stdout
+	Output io.Writer
+}
+
+const tracerName = "github.com/rjj-work/yum-address-book"
+
+// newTracerProvider starts exporting spans as cfg says
+func newTracerProvider(cfg TracingConfig) (*sdktrace.TracerProvider, error) {
+	var export sdktrace.TracerProviderOption
+	switch cfg.Exporter {
+	case TracingOTLP:
+		opts := []otlptracehttp.Option{}
+		if "" != cfg.Endpoint {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exp, err := otlptracehttp.New(context.Background(), opts...)
+		if nil != err {
+			return nil, fmt.Errorf("Could not start the OTLP exporter: %v", err)
+		}
+		export = sdktrace.WithBatcher(exp)
+	case TracingStdout:
+		out := cfg.Output
+		if nil == out {
+			out = os.Stdout
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(out))
+		if nil != err {
+			return nil, fmt.Errorf("Could not start the stdout exporter: %v", err)
+		}
+		// Each span is written as it ends, so a test can look for it
+		export = sdktrace.WithSyncer(exp)
+	default:
+		return nil, fmt.Errorf("Unknown trace exporter (%s), use %s or %s", cfg.Exporter, TracingOTLP, TracingStdout)
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if 0 < cfg.SampleRatio && 1 > cfg.SampleRatio {
+		sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	}
+	return sdktrace.NewTracerProvider(
+		export,
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", cfg.serviceName()))),
+	), nil
+}
+
+func (cfg TracingConfig) serviceName() string {
+	if "" == cfg.ServiceName {
+		return "addressbook"
+	}
+	return cfg.ServiceName
+}
+
+// tracePropagator reads and writes the W3C traceparent, tracestate and baggage headers
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// tracer makes the spans, a no-op one without a.Tracing
+func (a *Application) tracer() trace.Tracer {
+	if nil == a.tracerProvider {
+		return noop.NewTracerProvider().Tracer(tracerName)
+	}
+	return a.tracerProvider.Tracer(tracerName)
+}
+
+// traceRequests is a span for each request to a route, named "GET /books/{book}" and so on
+func (a *Application) traceRequests() mux.MiddlewareFunc {
+	return otelmux.Middleware(a.Tracing.serviceName(),
+		otelmux.WithTracerProvider(a.tracerProvider),
+		otelmux.WithPropagators(tracePropagator),
+		otelmux.WithSpanNameFormatter(func(route string, r *http.Request) string {
+			return r.Method + " " + route
+		}),
+	)
+}
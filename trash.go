@@ -0,0 +1,116 @@
+// 2026.10.18 rjj: Trash
+// Deleting an entry only moves it to the trash, where it can be restored from until it is
+//	older than Application.TrashRetention and purged for good.
+
+package addressbook
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultTrashRetention is how long deleted entries are kept, unless configured otherwise
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// trashPurgeInterval is how often old trash is purged
+const trashPurgeInterval = time.Hour
+
+// startTrashPurger purges old trash now, and then every trashPurgeInterval.
+func (a *Application) startTrashPurger() {
+	if 0 == a.TrashRetention {
+		a.TrashRetention = defaultTrashRetention
+	}
+	if 0 > a.TrashRetention {
+		// Keep the trash forever
+		return
+	}
+
+	a.purgerStop, a.purgerDone = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(a.purgerDone)
+		for {
+			a.purgeTrash()
+			select {
+			case <-time.After(trashPurgeInterval):
+			case <-a.purgerStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopTrashPurger stops purging, waiting until ctx is done for a purge under way
+func (a *Application) stopTrashPurger(ctx context.Context) {
+	if nil == a.purgerStop {
+		return
+	}
+	close(a.purgerStop)
+	select {
+	case <-a.purgerDone:
+	case <-ctx.Done():
+	}
+}
+
+func (a *Application) purgeTrash() {
+	n, err := a.DB.PurgeDeletedAddressBookEntries(a.TrashRetention)
+	if nil != err {
+		slog.Error("purgeTrash:: could not purge", "err", err)
+		return
+	}
+	if 0 < n {
+		slog.Info("purgeTrash:: purged", "entries", n, "retention", a.TrashRetention.String())
+		a.recordAudit(context.Background(), &AuditRecord{
+			Actor:     systemActor,
+			Action:    AuditPurge,
+			EntityIDs: []int64{},
+			Outcome:   AuditSuccess,
+			Detail:    fmt.Sprintf("%d entries deleted more than %v ago", n, a.TrashRetention),
+		})
+	}
+}
+
+// **************** Trash Handlers ****************
+
+func (a *Application) getTrash(w http.ResponseWriter, r *http.Request) {
+	abes, err := a.db(r).ListDeletedAddressBookEntries()
+	if nil != err {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, abes)
+}
+
+func (a *Application) restoreAddressBookEntry(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"],10,64)
+	if nil != err {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Bad AddressBookEntry ID (%v)", vars["id"]))
+		return
+	}
+
+	auditEntities(r, id)
+	if err = a.db(r).RestoreAddressBookEntry(id); nil != err {
+		if sql.ErrNoRows == err {
+			respondWithError(w, http.StatusNotFound, fmt.Sprintf("AddressBookEntry with ID (%d) is not in the trash.", id))
+		} else if merged, ok := err.(*EntryMergedError); ok {
+			respondWithError(w, http.StatusConflict, merged.Error()+"  It can not be restored.")
+		} else {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	abe, err := a.db(r).GetAddressBookEntry(id)
+	if nil != err {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, abe)
+}
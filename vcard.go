@@ -0,0 +1,575 @@
+// 2026.10.18 rjj: vCard (RFC 6350 / RFC 2426) export and import of AddressBookEntries
+// Only the fields an AddressBookEntry has are mapped:
+//	N / FN	<->	Lastname, Firstname
+//	EMAIL	<->	Email
+//	TEL		<->	Phone
+// Anything else found on import is reported back, not silently dropped.
+
+package addressbook
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+const (
+	vCardVersion3 = "3.0"
+	vCardVersion4 = "4.0"
+
+	// RFC 6350 3.2: lines SHOULD NOT be longer than 75 octets, excluding the line break
+	vCardMaxLineLength = 75
+)
+
+// **************** Export ****************
+
+// vCardEncoder writes each AddressBookEntry as one vCard.
+type vCardEncoder struct {
+	w       *bufio.Writer
+	version string
+}
+
+func newVCardEncoder(w io.Writer, version string) *vCardEncoder {
+	return &vCardEncoder{w: bufio.NewWriter(w), version: version}
+}
+
+// vCards have no header
+func (e *vCardEncoder) Begin() error {
+	return nil
+}
+
+func (e *vCardEncoder) Encode(abe *AddressBookEntry) error {
+	lines := []string{
+		"BEGIN:VCARD",
+		"VERSION:" + e.version,
+		"FN:" + escapeVCardText(strings.TrimSpace(abe.Firstname+" "+abe.Lastname)),
+		"N:" + escapeVCardText(abe.Lastname) + ";" + escapeVCardText(abe.Firstname) + ";;;",
+	}
+	if "" != abe.Email {
+		if vCardVersion3 == e.version {
+			lines = append(lines, "EMAIL;TYPE=INTERNET:"+escapeVCardText(abe.Email))
+		} else {
+			lines = append(lines, "EMAIL:"+escapeVCardText(abe.Email))
+		}
+	}
+	if "" != abe.Phone {
+		// 4.0 TEL defaults to a tel: URI, our phone numbers are free text
+		if vCardVersion3 == e.version {
+			lines = append(lines, "TEL:"+escapeVCardText(abe.Phone))
+		} else {
+			lines = append(lines, "TEL;VALUE=text:"+escapeVCardText(abe.Phone))
+		}
+	}
+	lines = append(lines, "END:VCARD")
+
+	for _, line := range lines {
+		if _, err := e.w.WriteString(foldVCardLine(line) + "\r\n"); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// Nor a trailer
+func (e *vCardEncoder) End() error {
+	return nil
+}
+
+func (e *vCardEncoder) Flush() error {
+	return e.w.Flush()
+}
+
+// escapeVCardText escapes a TEXT value, RFC 6350 3.4
+func escapeVCardText(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		`,`, `\,`,
+		`;`, `\;`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+// foldVCardLine splits a content line into 75 octet pieces, each continuation starting
+//	with a single space.  Multi-byte UTF-8 characters are never split.
+func foldVCardLine(line string) string {
+	if len(line) <= vCardMaxLineLength {
+		return line
+	}
+
+	var b strings.Builder
+	max := vCardMaxLineLength
+	for len(line) > max {
+		cut := max
+		for 0 < cut && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// The leading space counts towards the next line
+		max = vCardMaxLineLength - 1
+	}
+	b.WriteString(line)
+	return b.String()
+}
+
+// vCardVersionFromRequest picks the vCard version from the *version* query parameter, 4.0 by default.
+func vCardVersionFromRequest(r *http.Request) (string, error) {
+	switch v := r.URL.Query().Get("version"); v {
+	case "", vCardVersion4:
+		return vCardVersion4, nil
+	case vCardVersion3:
+		return vCardVersion3, nil
+	default:
+		return "", fmt.Errorf("Unsupported vCard version (%v), expected %s or %s", v, vCardVersion3, vCardVersion4)
+	}
+}
+
+// **************** Import ****************
+
+// vCardProperty is one unfolded content line, e.g.
+//	item1.TEL;TYPE=cell,voice:+1 555 0100
+type vCardProperty struct {
+	Name string
+	// Parameter names are upper case, values are as given.
+	//	vCard 2.1 style bare parameters (TEL;CELL) are stored under TYPE
+	Params map[string][]string
+	Value  string
+	// Line is where the property started in the input, for messages
+	Line int
+}
+
+func (p *vCardProperty) param(name string) []string {
+	return p.Params[name]
+}
+
+// hasParamValue reports if any value of the named parameter matches v, ignoring case
+func (p *vCardProperty) hasParamValue(name, v string) bool {
+	for _, pv := range p.Params[name] {
+		if strings.EqualFold(pv, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// vCardImport is the outcome of reading a vCard file.
+type vCardImport struct {
+	Entries []*AddressBookEntry
+	// Warnings are about data that was dropped, the import can still go ahead
+	Warnings []string
+	// Errors are about cards that could not be used at all
+	Errors []string
+}
+
+// vCardProperties that carry no contact data, so are not worth a warning when dropped
+var vCardIgnoredProperties = map[string]bool{
+	"BEGIN": true, "END": true, "VERSION": true, "PRODID": true, "UID": true, "REV": true, "KIND": true,
+}
+
+// readVCards parses a file of one or more vCards (2.1, 3.0 or 4.0) into AddressBookEntries.
+func readVCards(r io.Reader) (*vCardImport, error) {
+	lines, err := unfoldVCardLines(r)
+	if nil != err {
+		return nil, err
+	}
+
+	imp := &vCardImport{}
+	var card []*vCardProperty
+	var cardCnt, cardLine int
+	inCard := false
+	for _, l := range lines {
+		if "" == strings.TrimSpace(l.text) {
+			continue
+		}
+		p, err := parseVCardLine(l.text, l.num)
+		if nil != err {
+			imp.Errors = append(imp.Errors, err.Error())
+			continue
+		}
+
+		switch {
+		case "BEGIN" == p.Name && strings.EqualFold("VCARD", p.Value):
+			if inCard {
+				imp.Errors = append(imp.Errors, fmt.Sprintf("line %d: BEGIN:VCARD inside card started on line %d", p.Line, cardLine))
+			}
+			inCard = true
+			cardCnt++
+			cardLine = p.Line
+			card = nil
+
+		case "END" == p.Name && strings.EqualFold("VCARD", p.Value):
+			if !inCard {
+				imp.Errors = append(imp.Errors, fmt.Sprintf("line %d: END:VCARD without BEGIN:VCARD", p.Line))
+				continue
+			}
+			inCard = false
+			abe, warnings, err := vCardToAddressBookEntry(card)
+			for _, w := range warnings {
+				imp.Warnings = append(imp.Warnings, fmt.Sprintf("card #%d (line %d): %s", cardCnt, cardLine, w))
+			}
+			if nil != err {
+				imp.Errors = append(imp.Errors, fmt.Sprintf("card #%d (line %d): %v", cardCnt, cardLine, err))
+				continue
+			}
+			imp.Entries = append(imp.Entries, abe)
+
+		case !inCard:
+			imp.Errors = append(imp.Errors, fmt.Sprintf("line %d: %s outside of BEGIN:VCARD/END:VCARD", p.Line, p.Name))
+
+		default:
+			card = append(card, p)
+		}
+	}
+	if inCard {
+		imp.Errors = append(imp.Errors, fmt.Sprintf("card #%d (line %d): missing END:VCARD", cardCnt, cardLine))
+	}
+	return imp, nil
+}
+
+type vCardLine struct {
+	text string
+	num  int
+}
+
+// unfoldVCardLines joins folded lines back together, RFC 6350 3.2, and the
+//	quoted-printable soft line breaks used by vCard 2.1.
+//	Both CRLF and bare LF line endings are accepted.
+func unfoldVCardLines(r io.Reader) ([]vCardLine, error) {
+	br := bufio.NewReader(r)
+	var lines []vCardLine
+	var num int
+	for {
+		raw, err := br.ReadString('\n')
+		if "" == raw && io.EOF == err {
+			break
+		}
+		if nil != err && io.EOF != err {
+			return nil, err
+		}
+		num++
+		raw = strings.TrimRight(raw, "\r\n")
+		if 1 == num {
+			raw = strings.TrimPrefix(raw, "\ufeff")
+		}
+
+		if n := len(lines); 0 < n {
+			prev := &lines[n-1]
+			switch {
+			case strings.HasPrefix(raw, " ") || strings.HasPrefix(raw, "\t"):
+				prev.text += raw[1:]
+				continue
+			case strings.HasSuffix(prev.text, "=") && isQuotedPrintableLine(prev.text):
+				// Soft line break, the "=" is dropped when the value is decoded
+				prev.text += "\r\n" + raw
+				continue
+			}
+		}
+		lines = append(lines, vCardLine{text: raw, num: num})
+
+		if io.EOF == err {
+			break
+		}
+	}
+	return lines, nil
+}
+
+func isQuotedPrintableLine(line string) bool {
+	colon := strings.IndexByte(line, ':')
+	return -1 != colon && strings.Contains(strings.ToUpper(line[:colon]), "QUOTED-PRINTABLE")
+}
+
+// parseVCardLine splits a content line into name, parameters and value, then
+//	undoes any ENCODING and CHARSET so Value is plain UTF-8.
+//	Text escapes are left alone, they depend on the property.
+func parseVCardLine(line string, num int) (*vCardProperty, error) {
+	// The value starts at the first colon not inside a quoted parameter value
+	colon := -1
+	inQuotes := false
+	for i := 0; i < len(line) && -1 == colon; i++ {
+		switch line[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case ':':
+			if !inQuotes {
+				colon = i
+			}
+		}
+	}
+	if -1 == colon {
+		return nil, fmt.Errorf("line %d: not a vCard property, no ':' found", num)
+	}
+
+	p := &vCardProperty{Params: map[string][]string{}, Line: num}
+	parts := splitVCardParams(line[:colon])
+	p.Name = strings.ToUpper(parts[0])
+	// Drop any group prefix, e.g. item1.EMAIL
+	if dot := strings.LastIndexByte(p.Name, '.'); -1 != dot {
+		p.Name = p.Name[dot+1:]
+	}
+	if "" == p.Name {
+		return nil, fmt.Errorf("line %d: property has no name", num)
+	}
+	for _, param := range parts[1:] {
+		k, v := "TYPE", param
+		if eq := strings.IndexByte(param, '='); -1 != eq {
+			k, v = strings.ToUpper(param[:eq]), param[eq+1:]
+		} else if strings.EqualFold("QUOTED-PRINTABLE", param) || strings.EqualFold("BASE64", param) {
+			k = "ENCODING"
+		}
+		for _, pv := range strings.Split(v, ",") {
+			p.Params[k] = append(p.Params[k], strings.Trim(pv, `"`))
+		}
+	}
+
+	value, err := decodeVCardValue(p, line[colon+1:])
+	if nil != err {
+		return nil, fmt.Errorf("line %d: %s: %v", num, p.Name, err)
+	}
+	p.Value = value
+	return p, nil
+}
+
+// splitVCardParams splits "NAME;A=1;B="x;y"" on the semicolons outside of quotes
+func splitVCardParams(s string) []string {
+	var parts []string
+	inQuotes := false
+	last := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case ';':
+			if !inQuotes {
+				parts = append(parts, s[last:i])
+				last = i + 1
+			}
+		}
+	}
+	return append(parts, s[last:])
+}
+
+func decodeVCardValue(p *vCardProperty, value string) (string, error) {
+	raw := []byte(value)
+	for _, enc := range p.param("ENCODING") {
+		switch strings.ToUpper(enc) {
+		case "QUOTED-PRINTABLE":
+			b, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(value)))
+			if nil != err {
+				return "", fmt.Errorf("bad quoted-printable value: %v", err)
+			}
+			raw = b
+		case "B", "BASE64":
+			b, err := base64.StdEncoding.DecodeString(value)
+			if nil != err {
+				return "", fmt.Errorf("bad base64 value: %v", err)
+			}
+			raw = b
+		case "7BIT", "8BIT":
+		default:
+			return "", fmt.Errorf("unsupported ENCODING (%s)", enc)
+		}
+	}
+
+	if charsets := p.param("CHARSET"); 0 < len(charsets) && !strings.EqualFold("UTF-8", charsets[0]) {
+		enc, err := htmlindex.Get(charsets[0])
+		if nil != err {
+			return "", fmt.Errorf("unsupported CHARSET (%s)", charsets[0])
+		}
+		b, err := enc.NewDecoder().Bytes(raw)
+		if nil != err {
+			return "", fmt.Errorf("could not decode CHARSET (%s): %v", charsets[0], err)
+		}
+		raw = b
+	}
+
+	if !utf8.Valid(raw) {
+		return "", fmt.Errorf("value is not UTF-8, and no CHARSET was given")
+	}
+	return string(raw), nil
+}
+
+// unescapeVCardText undoes escapeVCardText, and splits on the unescaped sep, if sep is not 0
+//	e.g. the N property components are separated by ';'
+func unescapeVCardText(s string, sep byte) []string {
+	var parts []string
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case '\\' == c && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n', 'N':
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(s[i])
+			}
+		case 0 != sep && sep == c:
+			parts = append(parts, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return append(parts, b.String())
+}
+
+// vCardToAddressBookEntry maps the properties of one card onto an AddressBookEntry.
+//	Warnings list what did not fit, an error means the card is unusable.
+func vCardToAddressBookEntry(card []*vCardProperty) (*AddressBookEntry, []string, error) {
+	abe := &AddressBookEntry{}
+	var warnings []string
+	var fn string
+	var emails, tels []*vCardProperty
+	unsupported := map[string]bool{}
+
+	for _, p := range card {
+		switch p.Name {
+		case "N":
+			n := unescapeVCardText(p.Value, ';')
+			abe.Lastname = strings.TrimSpace(n[0])
+			if 1 < len(n) {
+				abe.Firstname = strings.TrimSpace(n[1])
+			}
+		case "FN":
+			fn = strings.TrimSpace(unescapeVCardText(p.Value, 0)[0])
+		case "EMAIL":
+			emails = append(emails, p)
+		case "TEL":
+			tels = append(tels, p)
+		default:
+			if !vCardIgnoredProperties[p.Name] {
+				unsupported[p.Name] = true
+			}
+		}
+	}
+
+	// No (usable) N, so fall back to splitting the formatted name
+	if "" == abe.Firstname && "" == abe.Lastname && "" != fn {
+		if sp := strings.LastIndexByte(fn, ' '); -1 != sp {
+			abe.Firstname, abe.Lastname = strings.TrimSpace(fn[:sp]), fn[sp+1:]
+		} else {
+			abe.Lastname = fn
+		}
+	}
+	if "" == abe.Firstname && "" == abe.Lastname {
+		return nil, warnings, fmt.Errorf("no name, expected N or FN")
+	}
+
+	if email := preferredVCardProperty(emails); nil != email {
+		abe.Email = strings.TrimSpace(unescapeVCardText(email.Value, 0)[0])
+		if 1 < len(emails) {
+			warnings = append(warnings, fmt.Sprintf("%d EMAIL properties, only %s was kept", len(emails), abe.Email))
+		}
+	}
+	if tel := preferredVCardProperty(tels); nil != tel {
+		phone := strings.TrimSpace(unescapeVCardText(tel.Value, 0)[0])
+		// 4.0 default value type is a URI
+		if strings.HasPrefix(strings.ToLower(phone), "tel:") {
+			phone = phone[len("tel:"):]
+		}
+		abe.Phone = phone
+		if 1 < len(tels) {
+			warnings = append(warnings, fmt.Sprintf("%d TEL properties, only %s was kept", len(tels), abe.Phone))
+		}
+	}
+
+	names := make([]string, 0, len(unsupported))
+	for name := range unsupported {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		warnings = append(warnings, fmt.Sprintf("unsupported property %s ignored", name))
+	}
+	return abe, warnings, nil
+}
+
+// preferredVCardProperty picks the most preferred of ps: lowest PREF (4.0),
+//	then TYPE=pref (2.1, 3.0), then the first one.
+func preferredVCardProperty(ps []*vCardProperty) *vCardProperty {
+	var best *vCardProperty
+	bestPref := 101	// PREF is 1 to 100
+	for _, p := range ps {
+		pref := 100
+		if vs := p.param("PREF"); 0 < len(vs) {
+			if n, err := strconv.Atoi(vs[0]); nil == err {
+				pref = n
+			}
+		} else if p.hasParamValue("TYPE", "pref") {
+			pref = 1
+		}
+		if pref < bestPref {
+			best, bestPref = p, pref
+		}
+	}
+	return best
+}
+
+// **************** vCard Handlers ****************
+
+// vCard 4.0 by default, ?version=3.0 for older clients
+func (a *Application) getAddressBookEntriesAsVCard(w http.ResponseWriter, r *http.Request) {
+	a.streamAddressBookEntries(w, r, serializers.get("text/vcard"), true)
+}
+
+// The R in cRud, as a vCard
+func (a *Application) getAddressBookEntryAsVCard(w http.ResponseWriter, r *http.Request) {
+	a.respondWithAddressBookEntry(w, r, serializers.get("text/vcard"), true)
+}
+
+// The request body is one or more vCards.
+// Like the CSV import, the *mode* query parameter selects how they are reconciled with
+//	the existing entries.  vCards carry no ID of ours, so upsert-id always adds.
+// Unlike the CSV import there is no *atomic* option, it is always atomic: a card that
+//	cannot be used stops the whole import.  Properties that do not fit an AddressBookEntry are reported.
+func (a *Application) addAddressBookEntriesFromVCard(w http.ResponseWriter, r *http.Request) {
+	mode, err := importModeFromRequest(r)
+	if nil != err {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	imp, err := readVCards(r.Body)
+	if tooBig, ok := bodyTooLarge(err); ok {
+		respondBodyTooLarge(w, r, tooBig)
+		return
+	}
+	if nil != err {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Could not read vCards (%v)", err))
+		return
+	}
+
+	msgs := []string{}
+	msgs = append(msgs, imp.Errors...)
+	msgs = append(msgs, imp.Warnings...)
+	if 0 < len(imp.Errors) || 0 == len(imp.Entries) {
+		msgs = append(msgs, fmt.Sprintf("Rejected %d vCards, nothing imported.  Errors: %d",
+			len(imp.Entries)+len(imp.Errors), len(imp.Errors)))
+		respondWithJSON(w, http.StatusBadRequest, msgs)
+		return
+	}
+
+	result, err := a.db(r).BulkUpsertAddressBookEntries(imp.Entries, mode)
+	if nil != err {
+		respondWithJSON(w, http.StatusInternalServerError,
+			[]string{fmt.Sprintf("Import (%s) failed, nothing imported: %v", mode, err)})
+		return
+	}
+	msgs = append(msgs, fmt.Sprintf("Processed %d vCards.  Inserted: %d  Updated: %d  Warnings: %d",
+		len(imp.Entries), result.Inserted, result.Updated, len(imp.Warnings)))
+	auditDetail(r, "%s, processed %d, inserted %d, updated %d", mode, len(imp.Entries), result.Inserted, result.Updated)
+	respondWithJSON(w, http.StatusOK, msgs)
+}